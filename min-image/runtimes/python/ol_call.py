@@ -0,0 +1,53 @@
+''' Lets Python handlers invoke other lambdas on the same worker '''
+
+import http.client, json, socket
+
+# served by the worker, for this sandbox only
+host_sock_path = "/host/invoke.sock"
+
+class CallError(Exception):
+    ''' the callee (or the worker, on its behalf) returned an error '''
+
+    def __init__(self, status, body):
+        super().__init__(f"call failed with status {status}: {body}")
+        self.status = status
+        self.body = body
+
+class _UnixConnection(http.client.HTTPConnection):
+    def __init__(self, path, timeout):
+        super().__init__("localhost", timeout=timeout)
+        self.path = path
+
+    def connect(self):
+        self.sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        self.sock.settimeout(self.timeout)
+        self.sock.connect(self.path)
+
+def call(name, event=None, timeout_ms=None):
+    '''
+    invoke the lambda called name with event (anything that can be
+    encoded as JSON), returning its (JSON-decoded) result.  The call
+    can't outlive the current invocation; timeout_ms can make its
+    deadline even sooner.  Raises CallError if the call fails.
+    '''
+    headers = {"Content-Type": "application/json"}
+    if timeout_ms is not None:
+        headers["X-OL-Timeout-Ms"] = str(int(timeout_ms))
+
+    # the worker enforces the deadline; the socket timeout is just a
+    # backstop in case it goes away
+    conn = _UnixConnection(host_sock_path, timeout=None)
+    try:
+        conn.request("POST", f"/run/{name}", body=json.dumps(event), headers=headers)
+        resp = conn.getresponse()
+        body = resp.read().decode("utf-8", errors="replace")
+    finally:
+        conn.close()
+
+    if resp.status >= 400:
+        raise CallError(resp.status, body)
+
+    try:
+        return json.loads(body)
+    except ValueError:
+        return body
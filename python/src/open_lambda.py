@@ -7,9 +7,11 @@ from requests import Session
 class OpenLambda:
     ''' Represents a client connection to OpenLambda '''
 
-    def __init__(self, address="localhost:5000"):
+    def __init__(self, address="localhost:5000", api_key=None):
         self._address = address
         self._session = Session()
+        if api_key is not None:
+            self._session.headers["Authorization"] = f"Bearer {api_key}"
 
     def _post(self, path, data=None):
         ''' Issues a _post request to the OL worker '''
@@ -26,6 +28,21 @@ class OpenLambda:
 
         return resp.text
 
+    def run_async(self, fn_name, args):
+        ''' Queue a serverless function, returning the invocation ID '''
+
+        resp = self._post(f"run-async/{fn_name}", args)
+        if resp.status_code != 202:
+            self._check_status_code(resp, "run_async")
+        return resp.json()["id"]
+
+    def get_invocation(self, invocation_id):
+        ''' Returns the status (and result, once done) of an async invocation '''
+
+        resp = self._session.get(f"http://{self._address}/invocations/{invocation_id}")
+        self._check_status_code(resp, "get_invocation")
+        return resp.json()
+
     def create(self, args):
         ''' Create a new sandbox '''
 
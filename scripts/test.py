@@ -5,17 +5,22 @@
 # pylint: disable=global-statement, too-many-statements, fixme, broad-except, too-many-locals, missing-function-docstring
 
 import argparse
+import hashlib
+import hmac
+import json
 import os
+import signal
 import tempfile
 
-from time import time
+from time import time, sleep
 from subprocess import call
 from multiprocessing import Pool
+from multiprocessing.pool import ThreadPool
 
 import requests
 
 from helper import DockerWorker, SockWorker, prepare_open_lambda, setup_config
-from helper import get_current_config, TestConfContext, assert_eq
+from helper import get_current_config, get_worker_output, TestConfContext, assert_eq
 
 from helper.test import set_test_filter, start_tests, check_test_results, set_worker_type, test
 
@@ -63,6 +68,10 @@ def check_status_code(req):
     if req.status_code != 200:
         raise requests.HTTPError(f"STATUS {req.status_code}: {req.text}")
 
+def expect_status(req, status_code):
+    if req.status_code != status_code:
+        raise ValueError(f"expected status code {status_code}, but got {req.status_code}: {req.text}")
+
 @test
 def numpy_test():
     open_lambda = OpenLambda()
@@ -235,8 +244,1215 @@ def flask_test():
     if r.text != "hi\n":
         raise ValueError(f"r.text should be 'hi\n', not {repr(r.text)}")
 
+    # sub-paths, query strings, and methods should reach the app intact
+    r = requests.post(url + "/echo/a/b?x=1")
+    check_status_code(r)
+    expected = {"method": "POST", "path": "a/b", "args": {"x": "1"}}
+    if r.json() != expected:
+        raise ValueError(f"expected {expected}, not {r.json()}")
+
+def write_lambda(reg_dir, name, code, ol_yaml=None):
+    ''' Creates a lambda named name in reg_dir, with code as its f.py (and an optional ol.yaml) '''
+    os.makedirs(os.path.join(reg_dir, name))
+    with open(os.path.join(reg_dir, name, "f.py"), "w", encoding='utf-8') as code_file:
+        code_file.write(code)
+    if ol_yaml is not None:
+        with open(os.path.join(reg_dir, name, "ol.yaml"), "w", encoding='utf-8') as conf_file:
+            conf_file.write(ol_yaml)
+
+@test
+def lambda_config_exec():
+    open_lambda = OpenLambda()
+
+    # environment variables from ol.yaml are visible to the handler
+    result = open_lambda.run("env", None)
+    assert_eq(result, "hello")
+
+    # memory_mb overrides limits.mem_mb
+    result = open_lambda.run("small_mem", None)
+    assert 64-16 <= int(result) <= 64
+
+    # a broken ol.yaml fails invocations with a description of the problem
+    r = requests.post('http://localhost:5000/run/bad_conf', "null")
+    if r.status_code != 500:
+        raise ValueError(f"expected status code 500, but got {r.status_code}")
+    if "not_a_field" not in r.text:
+        raise ValueError(f"expected error about not_a_field, not {repr(r.text)}")
+
+def lambda_config():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        write_lambda(reg_dir, "env",
+                     "import os\n\ndef f(event):\n    return os.environ.get('GREETING')\n",
+                     "environment:\n  GREETING: hello\n")
+
+        # same code as the max_mem_alloc test, but with a lower limit
+        test_reg_dir = get_current_config()['registry']
+        with open(os.path.join(test_reg_dir, "max_mem_alloc", "f.py"), "r", encoding='utf-8') as code:
+            write_lambda(reg_dir, "small_mem", code.read(), "memory_mb: 64\n")
+
+        write_lambda(reg_dir, "bad_conf", "def f(event):\n    return event\n",
+                     "not_a_field: 1\n")
+
+        with TestConfContext(registry=reg_dir):
+            lambda_config_exec()
+
+@test
+def deadline_test():
+    url = 'http://localhost:5000/run/timeout'
+    max_runtime = get_current_config()["limits"]["max_runtime_default"]
+
+    # a handler running past max_runtime gets a 504, on time
+    start = time()
+    r = requests.post(url, str(max_runtime + 3))
+    seconds = time() - start
+    if r.status_code != 504:
+        raise ValueError(f"expected status code 504, but got {r.status_code}")
+    assert seconds < max_runtime + 2
+
+    # the runaway sandbox is replaced, so the next invocation works
+    r = requests.post(url, "0")
+    check_status_code(r)
+
+    # clients may shorten the deadline, but not extend it
+    start = time()
+    r = requests.post(url, "2", headers={"X-OL-Timeout-Ms": "500"})
+    if r.status_code != 504:
+        raise ValueError(f"expected status code 504, but got {r.status_code}")
+    assert time() - start < 2
+
+    r = requests.post(url, str(max_runtime + 1), headers={"X-OL-Timeout-Ms": "60000"})
+    if r.status_code != 504:
+        raise ValueError(f"expected status code 504, but got {r.status_code}")
+
+    r = requests.post(url, "0", headers={"X-OL-Timeout-Ms": "soon"})
+    if r.status_code != 400:
+        raise ValueError(f"expected status code 400, but got {r.status_code}")
+
+def get_metrics():
+    ''' Returns the samples on /metrics, as a map from series (name and labels) to value '''
+    r = requests.get('http://localhost:5000/metrics')
+    check_status_code(r)
+    if not r.headers["Content-Type"].startswith("text/plain"):
+        raise ValueError(f"unexpected Content-Type for metrics: {r.headers['Content-Type']}")
+
+    metrics = {}
+    for line in r.text.splitlines():
+        if line and not line.startswith("#"):
+            series, value = line.rsplit(" ", 1)
+            metrics[series] = float(value)
+    return metrics
+
+@test
+def metrics_test():
+    open_lambda = OpenLambda()
+
+    for pos in range(3):
+        open_lambda.run("echo", pos)
+
+    metrics = get_metrics()
+    assert_eq(metrics['ol_lambda_invocations_total{lambda="echo"}'], 3)
+    assert_eq(metrics['ol_lambda_responses_total{lambda="echo",code="200"}'], 3)
+    assert_eq(metrics['ol_lambda_invocation_seconds_count{lambda="echo"}'], 3)
+    assert_eq(metrics['ol_lambda_invocation_seconds_bucket{lambda="echo",le="+Inf"}'], 3)
+    assert metrics['ol_lambda_cold_starts_total{lambda="echo"}'] >= 1
+
+def read_log_records():
+    ''' Returns the JSON records in worker.out (other lines, e.g., from runtimes, are skipped) '''
+    records = []
+    for line in get_worker_output():
+        try:
+            record = json.loads(line)
+        except ValueError:
+            continue
+        if isinstance(record, dict):
+            records.append(record)
+    return records
+
+@test
+def logging_test():
+    url = 'http://localhost:5000/admin/logging'
+    open_lambda = OpenLambda()
+
+    r = requests.get(url)
+    check_status_code(r)
+    assert_eq(r.json()["format"], "json")
+    assert_eq(r.json()["level"], "info")
+
+    # debug records are left out at the info level...
+    def received(request_id):
+        return [record for record in read_log_records()
+                if record.get("msg") == "Received request to /run/echo/" + request_id]
+
+    open_lambda.run("echo/before", 1)
+    assert_eq(received("before"), [])
+
+    # ...until a subsystem is turned up at runtime, leaving other settings alone
+    r = requests.post(url, json.dumps({"subsystems": {"server": "debug"}}))
+    check_status_code(r)
+    assert_eq(r.json()["subsystems"], {"server": "debug"})
+    assert_eq(r.json()["level"], "info")
+
+    open_lambda.run("echo/after", 2)
+    start = time()
+    while not received("after"):
+        assert time() - start < 5
+        sleep(0.2)
+    record = received("after")[0]
+    assert_eq(record["level"], "debug")
+    assert_eq(record["subsystem"], "server")
+    assert "time" in record
+
+    # other subsystems stay at info, but log with their own fields
+    assert not any(record.get("level") == "debug" and record.get("subsystem") != "server"
+                   for record in read_log_records())
+    assert any(record.get("subsystem") == "lambda" and record.get("lambda") == "echo"
+               for record in read_log_records())
+
+    expect_status(requests.post(url, json.dumps({"level": "loud"})), 400)
+    expect_status(requests.put(url, "{}"), 405)
+
+@test
+def latency_stats_test():
+    open_lambda = OpenLambda()
+
+    for pos in range(20):
+        open_lambda.run("echo", pos)
+
+    stats = open_lambda.get_statistics()
+    assert_eq(stats["LambdaFunc.Invoke.cnt"], 20)
+
+    # every timed operation has percentiles, which can't be out of order
+    names = [key[:-len(".cnt")] for key in stats if key.endswith(".cnt")]
+    assert len(names) > 0
+    for name in names:
+        latencies = [stats[f"{name}.ms-{p}"] for p in ["p50", "p90", "p99", "max"]]
+        if latencies != sorted(latencies):
+            raise ValueError(f"{name} percentiles out of order: {latencies}")
+
+@test
+def drain_test():
+    pid_path = os.path.join(get_current_config()["worker_dir"], "worker.pid")
+    with open(pid_path, "r", encoding='utf-8') as pid_file:
+        pid = int(pid_file.read())
+
+    # start with a sandbox, so the slow invocation starts sleeping right away
+    open_lambda = OpenLambda()
+    open_lambda.run("timeout", 0)
+
+    with ThreadPool(1) as pool:
+        slow = pool.apply_async(requests.post, ('http://localhost:5000/run/timeout', "3"))
+        sleep(1)
+        os.kill(pid, signal.SIGINT)
+
+        # once draining, the worker says so, and turns new invocations away
+        start = time()
+        while True:
+            r = requests.get('http://localhost:5000/status')
+            if r.status_code == 503:
+                break
+            assert time() - start < 1
+        if "draining" not in r.text:
+            raise ValueError(f"expected status to report draining, not {repr(r.text)}")
+
+        r = requests.post('http://localhost:5000/run/echo', "1")
+        if r.status_code != 503:
+            raise ValueError(f"expected status code 503, but got {r.status_code}")
+        if "Retry-After" not in r.headers:
+            raise ValueError(f"'Retry-After' not found in headers: {r.headers}")
+
+        # but the in-flight invocation finishes
+        r = slow.get()
+        check_status_code(r)
+        assert_eq(r.json(), "slept 3 second\n")
+
+    # then the worker exits on its own
+    start = time()
+    while os.path.exists(pid_path):
+        assert time() - start < 30
+        sleep(0.1)
+
+ADMIN_KEY = {"id": "admin", "secret": "admin-secret-0123456789", "scopes": ["admin", "invoke"]}
+ECHO_KEY = {"id": "echo", "secret": "echo-secret-0123456789", "scopes": ["invoke"], "lambdas": ["echo*"]}
+HELLO_KEY = {"id": "hello", "secret": "hello-secret-0123456789", "scopes": ["invoke"], "lambdas": ["hello"]}
+
+@test
+def auth_test():
+    url = 'http://localhost:5000'
+
+    # paths other than public_paths need credentials
+    expect_status(requests.get(f"{url}/status"), 200)
+    expect_status(requests.post(f"{url}/run/echo", "1"), 401)
+    expect_status(requests.get(f"{url}/stats"), 401)
+    expect_status(requests.post(f"{url}/run/echo", "1",
+                                headers={"Authorization": "Bearer not-a-key"}), 401)
+
+    # invoke keys may only run (and poll) the lambdas they match
+    echo_auth = {"Authorization": f"Bearer {ECHO_KEY['secret']}"}
+    expect_status(requests.post(f"{url}/run/echo", "1", headers=echo_auth), 200)
+    expect_status(requests.post(f"{url}/run/hello", "1", headers=echo_auth), 403)
+    expect_status(requests.get(f"{url}/stats", headers=echo_auth), 403)
+
+    open_lambda = OpenLambda(api_key=ECHO_KEY['secret'])
+    invocation_id = open_lambda.run_async("echo", 1)
+    expect_status(requests.get(f"{url}/invocations/{invocation_id}", headers=echo_auth), 200)
+    hello_auth = {"Authorization": f"Bearer {HELLO_KEY['secret']}"}
+    expect_status(requests.get(f"{url}/invocations/{invocation_id}", headers=hello_auth), 403)
+
+    # patterns also cover versions and aliases of the lambdas they match
+    r = requests.post(f"{url}/run/hello@1", "1", headers=hello_auth)
+    if r.status_code in (401, 403):
+        raise ValueError(f"hello key should be allowed to run hello@1, but got {r.status_code}")
+
+    # admin keys may use everything else
+    expect_status(requests.get(f"{url}/stats", headers={"X-OL-Api-Key": ADMIN_KEY['secret']}), 200)
+
+    # signed requests work without sending the secret
+    body = b"2"
+    timestamp = str(int(time()))
+    msg = "\n".join(["POST", "/run/echo", timestamp, hashlib.sha256(body).hexdigest()])
+    sig = hmac.new(ECHO_KEY['secret'].encode(), msg.encode(), hashlib.sha256).hexdigest()
+    headers = {"X-OL-Key-Id": ECHO_KEY['id'], "X-OL-Timestamp": timestamp, "X-OL-Signature": sig}
+    r = requests.post(f"{url}/run/echo", data=body, headers=headers)
+    expect_status(r, 200)
+    assert_eq(r.json(), 2)
+
+    # a signature over a different body is rejected
+    expect_status(requests.post(f"{url}/run/echo", data=b"3", headers=headers), 401)
+
+@test
+def tls_test(cert_file, key_file):
+    url = 'https://localhost:5000'
+
+    # with client_ca_file set, clients must present a certificate
+    try:
+        requests.get(f"{url}/status", verify=cert_file)
+        raise ValueError("worker accepted a client without a certificate")
+    except requests.exceptions.ConnectionError:
+        pass
+
+    r = requests.get(f"{url}/status", verify=cert_file, cert=(cert_file, key_file))
+    check_status_code(r)
+
+    r = requests.post(f"{url}/run/echo", "1", verify=cert_file, cert=(cert_file, key_file))
+    check_status_code(r)
+    assert_eq(r.json(), 1)
+
+    # plain HTTP isn't served
+    expect_status(requests.get('http://localhost:5000/status'), 400)
+
+def tls():
+    with tempfile.TemporaryDirectory() as tls_dir:
+        cert_file = os.path.join(tls_dir, "worker.pem")
+        key_file = os.path.join(tls_dir, "worker.key")
+
+        # one self-signed cert serves as the worker's, the client CA, and the client's
+        return_code = call(['openssl', 'req', '-x509', '-newkey', 'rsa:2048', '-nodes', '-days', '1',
+                            '-keyout', key_file, '-out', cert_file, '-subj', '/CN=localhost',
+                            '-addext', 'subjectAltName=DNS:localhost,IP:127.0.0.1',
+                            '-addext', 'extendedKeyUsage=serverAuth,clientAuth'])
+        assert_eq(return_code, 0)
+
+        with TestConfContext(tls={"cert_file": cert_file, "key_file": key_file,
+                                  "client_ca_file": cert_file}):
+            tls_test(cert_file=cert_file, key_file=key_file)
+
+@test
+def introspection_test():
+    url = 'http://localhost:5000/lambdas'
+
+    # looking a lambda up doesn't load it
+    expect_status(requests.get(f"{url}/secret"), 404)
+
+    open_lambda = OpenLambda()
+    open_lambda.run("secret", None)
+    open_lambda.run("echo", 1)
+
+    r = requests.get(url)
+    check_status_code(r)
+    assert_eq([status["name"] for status in r.json()], ["echo", "secret"])
+
+    r = requests.get(f"{url}/secret")
+    check_status_code(r)
+    status = r.json()
+    assert_eq(status["runtime"], "python")
+    assert_eq(status["outstanding"], 0)
+    assert len(status["instances"]) >= 1
+    assert any(inst.get("sandbox_id") for inst in status["instances"])
+
+    # environment values are hidden, as they often hold secrets
+    assert_eq(status["config"]["environment"], {"TOKEN": "(redacted)"})
+    if "hunter2" in r.text:
+        raise ValueError(f"environment value leaked by /lambdas: {r.text}")
+
+def introspection():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        write_lambda(reg_dir, "echo", "def f(event):\n    return event\n")
+        write_lambda(reg_dir, "secret", "def f(event):\n    return None\n",
+                     "environment:\n  TOKEN: hunter2\n")
+
+        with TestConfContext(registry=reg_dir):
+            introspection_test()
+
+@test
+def lambda_admin_test():
+    url = 'http://localhost:5000/lambdas/echo'
+    open_lambda = OpenLambda()
+
+    # most ops need the lambda to be loaded
+    expect_status(requests.post(f"{url}/quiesce"), 404)
+    expect_status(requests.post(f"{url}/unload"), 404)
+    open_lambda.run("echo", 1)
+
+    expect_status(requests.get(f"{url}/quiesce"), 405)
+    expect_status(requests.post(f"{url}/not-an-op"), 404)
+
+    # quiesce kills the instances, and the next invocation gets new ones
+    r = requests.post(f"{url}/quiesce")
+    check_status_code(r)
+    if "killed" not in r.text:
+        raise ValueError(f"unexpected quiesce response: {repr(r.text)}")
+    assert_eq(open_lambda.run("echo", 2), 2)
+
+    # disabled lambdas fail with a 503 until enabled
+    check_status_code(requests.post(f"{url}/disable"))
+    expect_status(requests.post('http://localhost:5000/run/echo', "3"), 503)
+    check_status_code(requests.post(f"{url}/enable"))
+    assert_eq(open_lambda.run("echo", 3), 3)
+
+    # or until the given number of seconds have passed
+    check_status_code(requests.post(f"{url}/disable?sec=2"))
+    r = requests.post('http://localhost:5000/run/echo', "4")
+    expect_status(r, 503)
+    if "Retry-After" not in r.headers:
+        raise ValueError(f"'Retry-After' not found in headers: {r.headers}")
+    sleep(2.5)
+    assert_eq(open_lambda.run("echo", 4), 4)
+
+    # refresh and unload, after which the lambda is loaded again when invoked
+    check_status_code(requests.post(f"{url}/refresh"))
+    check_status_code(requests.post(f"{url}/unload"))
+    expect_status(requests.get(url), 404)
+
+    # along with its metrics
+    leftover = [series for series in get_metrics() if 'lambda="echo"' in series]
+    assert_eq(leftover, [])
+    assert_eq(open_lambda.run("echo", 5), 5)
+    check_status_code(requests.get(url))
+
+# a WSGI lambda that responds with the headers of its request
+HEADERS_APP = """import json
+
+def app(environ, start_response):
+    headers = {key[5:].replace("_", "-").lower(): val
+               for key, val in environ.items() if key.startswith("HTTP_")}
+    start_response("200 OK", [("Content-Type", "application/json")])
+    return [json.dumps(headers).encode()]
+"""
+
+def read_spans(spans_file, trace_id):
+    ''' Returns the spans of a trace exported to spans_file (OTLP-JSON, one request per line) '''
+    spans = []
+    if not os.path.exists(spans_file):
+        return spans
+
+    with open(spans_file, "r", encoding='utf-8') as lines:
+        for line in lines:
+            for resource_spans in json.loads(line)["resourceSpans"]:
+                for scope_spans in resource_spans["scopeSpans"]:
+                    spans += [span for span in scope_spans["spans"] if span["traceId"] == trace_id]
+    return spans
+
+@test
+def tracing_test(spans_file):
+    url = 'http://localhost:5000/run/headers'
+
+    trace_id = "0af7651916cd43dd8448eb211c80319c"
+    r = requests.post(url, "null", headers={"traceparent": f"00-{trace_id}-b7ad6b7169203331-01"})
+    check_status_code(r)
+
+    # the lambda is called as part of the client's trace, with the request ID
+    seen = r.json()
+    assert_eq(seen["traceparent"].split("-")[1], trace_id)
+    assert_eq(seen["x-request-id"], r.headers["X-Request-Id"])
+
+    # and the worker's spans join that trace (they are exported about once a second)
+    start = time()
+    while not any(span["name"] == "web-request" for span in read_spans(spans_file, trace_id)):
+        assert time() - start < 5
+        sleep(0.5)
+    spans = read_spans(spans_file, trace_id)
+    root = [span for span in spans if span["name"] == "web-request"][0]
+    assert_eq(root["parentSpanId"], "b7ad6b7169203331")
+    attrs = {attr["key"]: attr["value"]["stringValue"] for attr in root["attributes"]}
+    assert_eq(attrs["lambda"], "headers")
+
+    invoke = [span for span in spans if span["name"] == "LambdaFunc.Invoke"][0]
+    assert_eq(invoke["parentSpanId"], root["spanId"])
+    attrs = {attr["key"]: attr["value"]["stringValue"] for attr in invoke["attributes"]}
+    assert_eq(attrs["request_id"], r.headers["X-Request-Id"])
+
+    # unsampled traces aren't recorded, but their context is still passed on
+    trace_id = "4bf92f3577b34da6a3ce929d0e0e4736"
+    r = requests.post(url, "null", headers={"traceparent": f"00-{trace_id}-00f067aa0ba902b7-00"})
+    check_status_code(r)
+    assert_eq(r.json()["traceparent"].split("-")[1], trace_id)
+    sleep(2)
+    assert_eq(read_spans(spans_file, trace_id), [])
+
+def tracing():
+    with tempfile.TemporaryDirectory() as tmp_dir:
+        reg_dir = os.path.join(tmp_dir, "registry")
+        write_lambda(reg_dir, "headers", HEADERS_APP)
+
+        spans_file = os.path.join(tmp_dir, "spans.json")
+        with TestConfContext(registry=reg_dir, tracing={"file": spans_file}):
+            tracing_test(spans_file=spans_file)
+
+@test
+def timing_headers_test():
+    url = 'http://localhost:5000/run/echo'
+
+    # the first invocation needs a new sandbox, later ones reuse it
+    starts = []
+    for pos in range(3):
+        r = requests.post(url, str(pos))
+        check_status_code(r)
+        starts.append(r.headers["X-OL-Start"])
+        for header in ["X-OL-Queue-Ms", "X-OL-Sandbox-Wait-Ms", "X-OL-Exec-Ms"]:
+            assert float(r.headers[header]) >= 0
+        if r.headers["X-OL-Start"] == "warm":
+            assert_eq(float(r.headers["X-OL-Sandbox-Wait-Ms"]), 0)
+
+    assert starts[0] in ("cold", "zygote")
+    for start in starts[1:]:
+        assert start in ("warm", "unpaused")
+
+    # the same start types are counted on /metrics
+    metrics = get_metrics()
+    counted = {start: metrics.get(f'ol_lambda_starts_total{{lambda="echo",start="{start}"}}', 0)
+               for start in set(starts)}
+    assert_eq(counted, {start: starts.count(start) for start in set(starts)})
+
+@test
+def reload_test():
+    url = 'http://localhost:5000'
+    r = requests.post(f"{url}/run/echo", "1")
+    check_status_code(r)
+    assert "X-OL-Start" not in r.headers
+
+    # settings like features.timing_headers can change without a restart
+    with TestConfContext(features={"timing_headers": True}):
+        r = requests.post(f"{url}/admin/reload")
+        check_status_code(r)
+        if not any("timing_headers" in change for change in r.json()["changes"]):
+            raise ValueError(f"expected timing_headers among the changes: {r.text}")
+
+        r = requests.post(f"{url}/run/echo", "2")
+        check_status_code(r)
+        assert "X-OL-Start" in r.headers
+
+        # others need a restart, so the reload is rejected, keeping the old config
+        with TestConfContext(worker_port="5001"):
+            r = requests.post(f"{url}/admin/reload")
+            expect_status(r, 409)
+            if "worker_port" not in r.text:
+                raise ValueError(f"expected error about worker_port, not {repr(r.text)}")
+
+        r = requests.post(f"{url}/run/echo", "3")
+        check_status_code(r)
+        assert "X-OL-Start" in r.headers
+
+    # new limits reach new sandboxes, including those of lambdas loaded before the reload
+    limit = get_current_config()["limits"]["mem_mb"]
+    before = int(OpenLambda().run("max_mem_alloc", None))
+    assert limit-16 <= before <= limit
+
+    with TestConfContext(limits={"mem_mb": limit // 2}):
+        check_status_code(requests.post(f"{url}/admin/reload"))
+        check_status_code(requests.post(f"{url}/lambdas/max_mem_alloc/quiesce"))
+        after = int(OpenLambda().run("max_mem_alloc", None))
+        assert after <= limit // 2 < before
+
+    # SIGHUP reloads too
+    with open(os.path.join(get_current_config()["worker_dir"], "worker.pid"), "r", encoding='utf-8') as pid_file:
+        os.kill(int(pid_file.read()), signal.SIGHUP)
+
+    start = time()
+    while "X-OL-Start" in requests.post(f"{url}/run/echo", "4").headers:
+        assert time() - start < 5
+        sleep(0.1)
+
+# a WSGI lambda that fails unless it is invoked by a schedule with an event of {"n": 1}
+CHECK_SCHEDULE_APP = """import json
+
+def app(environ, start_response):
+    event = json.loads(environ["wsgi.input"].read())
+    ok = (event["source"] == "ol.scheduler" and event.get("detail") == {"n": 1} and
+          event["schedule"] == environ.get("HTTP_X_OL_SCHEDULE"))
+    start_response("200 OK" if ok else "400 Bad Request", [])
+    return [json.dumps(event).encode()]
+"""
+
+@test
+def schedules_test():
+    url = 'http://localhost:5000/schedules'
+
+    # schedules may be added through the API
+    r = requests.put(f"{url}/every-minute",
+                     json.dumps({"lambda": "check_schedule", "cron": "* * * * *", "event": {"n": 1}}))
+    check_status_code(r)
+    assert_eq(r.json()["source"], "api")
+    assert r.json()["next"]
+
+    expect_status(requests.put(f"{url}/bad", json.dumps({"lambda": "echo", "cron": "61 * * * *"})), 400)
+
+    # from config.json, in which case they can't be removed
+    r = requests.get(f"{url}/from-config")
+    check_status_code(r)
+    assert_eq(r.json()["source"], "config")
+    expect_status(requests.delete(f"{url}/from-config"), 400)
+
+    # or from a lambda's ol.yaml, once the worker has pulled it
+    expect_status(requests.get(f"{url}/self_scheduled:tick"), 404)
+    OpenLambda().run("self_scheduled", None)
+    r = requests.get(f"{url}/self_scheduled:tick")
+    check_status_code(r)
+    assert_eq(r.json()["source"], "lambda")
+
+    ids = [schedule["id"] for schedule in requests.get(url).json()]
+    assert_eq(sorted(ids), ["every-minute", "from-config", "self_scheduled:tick"])
+
+    # the lambda runs on schedule, with the event
+    start = time()
+    while requests.get(f"{url}/every-minute").json()["runs"] == 0:
+        assert time() - start < 70
+        sleep(1)
+    while requests.get(f"{url}/every-minute").json()["running"]:
+        sleep(0.1)
+    status = requests.get(f"{url}/every-minute").json()
+    assert_eq(status["last_status"], 200)
+    assert_eq(status["failures"], 0)
+
+    check_status_code(requests.delete(f"{url}/every-minute"))
+    expect_status(requests.get(f"{url}/every-minute"), 404)
+
+def schedules():
+    with tempfile.TemporaryDirectory() as tmp_dir:
+        reg_dir = os.path.join(tmp_dir, "registry")
+        write_lambda(reg_dir, "check_schedule", CHECK_SCHEDULE_APP)
+        write_lambda(reg_dir, "self_scheduled", "def f(event):\n    return None\n",
+                     "schedules:\n  - name: tick\n    cron: \"@daily\"\n")
+
+        # saved schedules shouldn't outlive the test
+        scheduler = {
+            "state_path": os.path.join(tmp_dir, "schedules.json"),
+            "schedules": [{"id": "from-config", "lambda": "check_schedule", "cron": "@yearly"}],
+        }
+        with TestConfContext(registry=reg_dir, scheduler=scheduler):
+            schedules_test()
+
+@test
+def lambda_calls_test():
+    open_lambda = OpenLambda()
+
+    # callees see who called them
+    seen = open_lambda.run("caller", None)
+    assert_eq(seen["x-ol-caller"], "caller")
+
+    metrics = get_metrics()
+    assert_eq(metrics['ol_lambda_internal_calls_total{lambda="caller",callee="headers"}'], 1)
+
+    # callees see the same path whether called by a lambda or through /run/
+    assert_eq(open_lambda.run("path_caller", None), ["/", "/sub/dir"])
+    r = requests.post('http://localhost:5000/run/paths/sub/dir', "null")
+    check_status_code(r)
+    assert_eq(r.json(), "/sub/dir")
+
+    # chains of calls longer than max_call_depth fail with a 508
+    max_depth = get_current_config()["limits"]["max_call_depth"]
+    result = open_lambda.run("recurse", 0)
+    assert_eq(result, {"depth": max_depth, "status": 508})
+
+    # each invocation may only make max_calls calls (from ol.yaml here)
+    result = open_lambda.run("many_calls", None)
+    assert_eq(result, [200, 200, 429])
+
+def lambda_calls():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        write_lambda(reg_dir, "headers", HEADERS_APP)
+        write_lambda(reg_dir, "caller",
+                     "import ol_call\n\n"
+                     "def f(event):\n"
+                     "    return ol_call.call('headers')\n")
+        write_lambda(reg_dir, "paths",
+                     "import json\n\n"
+                     "def app(environ, start_response):\n"
+                     "    start_response('200 OK', [('Content-Type', 'application/json')])\n"
+                     "    return [json.dumps(environ['PATH_INFO']).encode()]\n")
+        write_lambda(reg_dir, "path_caller",
+                     "import ol_call\n\n"
+                     "def f(event):\n"
+                     "    return [ol_call.call('paths'), ol_call.call('paths/sub/dir')]\n")
+        write_lambda(reg_dir, "recurse",
+                     "import ol_call\n\n"
+                     "def f(event):\n"
+                     "    try:\n"
+                     "        return ol_call.call('recurse', event + 1)\n"
+                     "    except ol_call.CallError as err:\n"
+                     "        return {'depth': event, 'status': err.status}\n")
+        write_lambda(reg_dir, "many_calls",
+                     "import ol_call\n\n"
+                     "def f(event):\n"
+                     "    statuses = []\n"
+                     "    for pos in range(3):\n"
+                     "        try:\n"
+                     "            ol_call.call('headers')\n"
+                     "            statuses.append(200)\n"
+                     "        except ol_call.CallError as err:\n"
+                     "            statuses.append(err.status)\n"
+                     "    return statuses\n",
+                     "max_calls: 2\n")
+
+        # every call in the chain holds a sandbox, so keep it short
+        with TestConfContext(registry=reg_dir, limits={"max_call_depth": 2}):
+            lambda_calls_test()
+
+@test
+def versions_test(reg_dir):
+    url = 'http://localhost:5000/run'
+
+    # versions are invoked by name, and the plain name keeps working as before
+    r = requests.post(f"{url}/greet", "null")
+    check_status_code(r)
+    assert_eq(r.json(), "latest")
+    assert "X-OL-Version" not in r.headers
+    assert_eq(OpenLambda().run("greet@1", None), 1)
+    assert_eq(OpenLambda().run("greet@2", None), 2)
+
+    # aliases route to versions by weight, saying which version served them
+    r = requests.post(f"{url}/greet@prod", "null")
+    check_status_code(r)
+    assert_eq(r.json(), 1)
+    assert_eq(r.headers["X-OL-Version"], "1")
+
+    served = set()
+    for _ in range(40):
+        r = requests.post(f"{url}/greet@split", "null")
+        check_status_code(r)
+        assert_eq(str(r.json()), r.headers["X-OL-Version"])
+        served.add(r.headers["X-OL-Version"])
+    assert_eq(served, {"1", "2"})
+
+    expect_status(requests.post(f"{url}/greet@nope", "null"), 404)
+
+    # each version has its own metrics
+    metrics = get_metrics()
+    assert metrics['ol_lambda_invocations_total{lambda="greet@1"}'] >= 1
+    assert metrics['ol_lambda_invocations_total{lambda="greet@2"}'] >= 1
+
+    # editing the alias file promotes a version, within registry_cache_ms
+    with open(os.path.join(reg_dir, "greet.aliases.json"), "w", encoding='utf-8') as aliases:
+        json.dump({"prod": {"2": 1}}, aliases)
+
+    start = time()
+    while requests.post(f"{url}/greet@prod", "null").headers["X-OL-Version"] != "2":
+        assert time() - start < get_current_config()['registry_cache_ms'] / 1000 + 2
+        sleep(0.1)
+
+def versions():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        for name, result in [("greet", "'latest'"), ("greet@1", "1"), ("greet@2", "2")]:
+            with open(os.path.join(reg_dir, f"{name}.py"), "w", encoding='utf-8') as code:
+                code.write(f"def f(event):\n    return {result}\n")
+
+        with open(os.path.join(reg_dir, "greet.aliases.json"), "w", encoding='utf-8') as aliases:
+            json.dump({"prod": {"1": 1}, "split": {"1": 1, "2": 1}}, aliases)
+
+        with TestConfContext(registry=reg_dir, registry_cache_ms=1000):
+            versions_test(reg_dir=reg_dir)
+
+def post_staggered(url, bodies, delay=0.2):
+    ''' POSTs each body to url concurrently (but started in order), returning the responses '''
+    with ThreadPool(len(bodies)) as pool:
+        pending = []
+        for body in bodies:
+            pending.append(pool.apply_async(requests.post, (url, body)))
+            sleep(delay)
+        return [result.get() for result in pending]
+
+@test
+def admission_test():
+    url = 'http://localhost:5000/run'
+    open_lambda = OpenLambda()
+
+    # one instance, and room for one more invocation in the queue
+    open_lambda.run("one_queued", 0)
+    responses = post_staggered(f"{url}/one_queued", ["2"] * 4)
+    codes = [r.status_code for r in responses]
+    assert 200 in codes and 429 in codes
+    assert_eq(set(codes), {200, 429})
+    for r in responses:
+        if r.status_code == 429 and "Retry-After" not in r.headers:
+            raise ValueError(f"'Retry-After' not found in headers: {r.headers}")
+
+    status = requests.get('http://localhost:5000/lambdas/one_queued').json()
+    assert_eq(status["max_instances"], 1)
+    assert_eq(status["max_queued"], 1)
+    assert_eq(status["queue_capacity"], get_current_config()["limits"]["max_queued"])
+    assert_eq(status["queue_full"], codes.count(429))
+
+    # invocations that can't get an instance within max_queue_ms fail
+    open_lambda.run("short_wait", 0)
+    timeout_codes = [r.status_code for r in post_staggered(f"{url}/short_wait", ["2", "2"])]
+    assert_eq(timeout_codes, [200, 503])
+
+    status = requests.get('http://localhost:5000/lambdas/short_wait').json()
+    assert_eq(status["queue_timeouts"], 1)
+
+    metrics = get_metrics()
+    assert_eq(metrics['ol_lambda_rejected_total{lambda="one_queued",reason="queue_full"}'], codes.count(429))
+    assert_eq(metrics['ol_lambda_rejected_total{lambda="short_wait",reason="queue_timeout"}'], 1)
+
+def admission():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        sleep_code = "import time\n\ndef f(event):\n    time.sleep(int(event))\n"
+        write_lambda(reg_dir, "one_queued", sleep_code, "max_instances: 1\nmax_queued: 1\n")
+        write_lambda(reg_dir, "short_wait", sleep_code, "max_instances: 1\nmax_queue_ms: 500\n")
+
+        with TestConfContext(registry=reg_dir):
+            admission_test()
+
+@test
+def autoscaling_test():
+    url = 'http://localhost:5000/run'
+    open_lambda = OpenLambda()
+
+    # the concurrency policy starts an instance per outstanding invocation
+    open_lambda.run("parallel", 0)
+    with ThreadPool(4) as pool:
+        start = time()
+        pending = [pool.apply_async(requests.post, (f"{url}/parallel", "3")) for _ in range(4)]
+        sleep(2)
+        instances = requests.get('http://localhost:5000/lambdas/parallel').json()["instances"]
+        for result in pending:
+            check_status_code(result.get())
+        seconds = time() - start
+    assert_eq(len(instances), 4)
+    assert seconds < 6
+
+    metrics = get_metrics()
+    assert 1 <= metrics['ol_lambda_instances{lambda="parallel"}'] <= 4
+
+    # unknown policies are reported like other config errors
+    r = requests.post(f"{url}/bad_policy", "0")
+    expect_status(r, 500)
+    if "unknown scaling policy" not in r.text:
+        raise ValueError(f"expected error about the scaling policy, not {repr(r.text)}")
+
+def autoscaling():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        sleep_code = "import time\n\ndef f(event):\n    time.sleep(int(event))\n"
+        write_lambda(reg_dir, "parallel", sleep_code,
+                     "max_instances: 4\nscaling:\n  policy: concurrency\n  step: 4\n")
+        write_lambda(reg_dir, "bad_policy", sleep_code, "scaling:\n  policy: guess\n")
+
+        with TestConfContext(registry=reg_dir):
+            autoscaling_test()
+
+@test
+def prewarm_test():
+    url = 'http://localhost:5000'
+
+    # the worker isn't ready until the manifest's lambdas are warm
+    start = time()
+    while requests.get(f"{url}/status").status_code != 200:
+        assert time() - start < 60
+        sleep(0.5)
+
+    status = requests.get(f"{url}/lambdas/warm_me").json()
+    assert status["prewarmed"]
+    assert status["warm_instances"] >= 1
+    assert any(inst.get("sandbox_id") for inst in status["instances"])
+
+    # so even the first invocation doesn't need a new sandbox
+    r = requests.post(f"{url}/run/warm_me", "null")
+    check_status_code(r)
+    assert r.headers["X-OL-Start"] in ("warm", "unpaused")
+
+    # min_instances keeps that many sandboxes ready once the lambda is loaded
+    OpenLambda().run("two_warm", None)
+    start = time()
+    while True:
+        status = requests.get(f"{url}/lambdas/two_warm").json()
+        ready = [inst for inst in status["instances"] if inst.get("sandbox_id")]
+        if status["warm_instances"] == 2 and len(ready) == 2:
+            break
+        assert time() - start < 30
+        sleep(0.5)
+    assert_eq(status["min_instances"], 2)
+
+def prewarm():
+    with tempfile.TemporaryDirectory() as tmp_dir:
+        reg_dir = os.path.join(tmp_dir, "registry")
+        write_lambda(reg_dir, "warm_me", "def f(event):\n    return event\n")
+        write_lambda(reg_dir, "two_warm", "def f(event):\n    return event\n", "min_instances: 2\n")
+
+        manifest = os.path.join(tmp_dir, "prewarm.json")
+        with open(manifest, "w", encoding='utf-8') as manifest_file:
+            json.dump({"lambdas": ["warm_me"]}, manifest_file)
+
+        with TestConfContext(registry=reg_dir, prewarm_manifest=manifest,
+                             features={"timing_headers": True}):
+            prewarm_test()
+
+@test
+def idle_test():
+    url = 'http://localhost:5000'
+
+    # within idle_grace_ms, the sandbox is still running
+    check_status_code(requests.post(f"{url}/run/graceful", "null"))
+    sleep(0.5)
+    r = requests.post(f"{url}/run/graceful", "null")
+    check_status_code(r)
+    assert_eq(r.headers["X-OL-Start"], "warm")
+
+    status = requests.get(f"{url}/lambdas/graceful").json()
+    assert_eq(status["idle_grace_ms"], 2000)
+    assert status["grace_hits"] >= 1
+    assert_eq(status["pauses"], 0)
+
+    # after that, it is paused
+    start = time()
+    while requests.get(f"{url}/lambdas/graceful").json()["pauses"] == 0:
+        assert time() - start < 10
+        sleep(0.5)
+
+    # sandboxes idle for idle_ttl_sec are destroyed, so the next invocation needs a new one
+    check_status_code(requests.post(f"{url}/run/short_lived", "null"))
+    start = time()
+    while True:
+        status = requests.get(f"{url}/lambdas/short_lived").json()
+        if status["idle_destroys"] >= 1:
+            break
+        assert time() - start < 10
+        sleep(0.5)
+    assert not any(inst.get("sandbox_id") for inst in status["instances"])
+
+    metrics = get_metrics()
+    assert metrics['ol_lambda_idle_destroys_total{lambda="short_lived"}'] >= 1
+
+    r = requests.post(f"{url}/run/short_lived", "null")
+    check_status_code(r)
+    assert r.headers["X-OL-Start"] in ("cold", "zygote")
+
+def idle():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        write_lambda(reg_dir, "graceful", "def f(event):\n    return event\n", "idle_grace_ms: 2000\n")
+        write_lambda(reg_dir, "short_lived", "def f(event):\n    return event\n", "idle_ttl_sec: 1\n")
+
+        with TestConfContext(registry=reg_dir, features={"timing_headers": True}):
+            idle_test()
+
+@test
+def code_refresh_test(reg_dir):
+    url = 'http://localhost:5000/lambdas/changing'
+    open_lambda = OpenLambda()
+    assert_eq(open_lambda.run("changing", None), 1)
+
+    # a refresh that fails is reported, and the current code keeps serving
+    with open(os.path.join(reg_dir, "changing", "ol.yaml"), "w", encoding='utf-8') as conf:
+        conf.write("not_a_field: 1\n")
+    check_status_code(requests.post(f"{url}/refresh"))
+
+    start = time()
+    while True:
+        assert_eq(open_lambda.run("changing", None), 1)
+        status = requests.get(url).json()
+        if status["refresh_failures"] > 0:
+            break
+        assert time() - start < 10
+        sleep(0.2)
+    if "not_a_field" not in status["refresh_error"]:
+        raise ValueError(f"expected error about not_a_field, not {repr(status['refresh_error'])}")
+    assert get_metrics()['ol_lambda_code_refresh_failures_total{lambda="changing"}'] >= 1
+
+    # new code is pulled in the background, so the invocation starting the
+    # refresh is still served by the old code, and later ones by the new
+    os.remove(os.path.join(reg_dir, "changing", "ol.yaml"))
+    with open(os.path.join(reg_dir, "changing", "f.py"), "w", encoding='utf-8') as code:
+        code.write("def f(event):\n    return 2\n")
+    check_status_code(requests.post(f"{url}/refresh"))
+    assert_eq(open_lambda.run("changing", None), 1)
+
+    start = time()
+    while open_lambda.run("changing", None) != 2:
+        assert time() - start < 10
+        sleep(0.2)
+    assert "refresh_error" not in requests.get(url).json()
+
+def code_refresh():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        write_lambda(reg_dir, "changing", "def f(event):\n    return 1\n")
+
+        # only refresh when asked to
+        with TestConfContext(registry=reg_dir, registry_cache_ms=60000):
+            code_refresh_test(reg_dir=reg_dir)
+
+@test
+def rolling_update_test(reg_dir):
+    url = 'http://localhost:5000'
+    code_path = os.path.join(reg_dir, "rolling", "f.py")
+    open_lambda = OpenLambda()
+    assert_eq(open_lambda.run("rolling", 0), 1)
+
+    with ThreadPool(1) as pool:
+        slow = pool.apply_async(requests.post, (f"{url}/run/rolling", "3"))
+        sleep(1)
+
+        with open(code_path, "w", encoding='utf-8') as code:
+            code.write("import time\n\ndef f(event):\n    time.sleep(int(event))\n    return 2\n")
+        check_status_code(requests.post(f"{url}/lambdas/rolling/refresh"))
+
+        # new invocations move to the new code...
+        start = time()
+        while open_lambda.run("rolling", 0) != 2:
+            assert time() - start < 10
+            sleep(0.2)
+
+        # ...but the update doesn't cut off the one in flight
+        r = slow.get()
+        check_status_code(r)
+        assert_eq(r.json(), 1)
+
+    # once the old instances have exited, the update is done
+    start = time()
+    while "rollout" in requests.get(f"{url}/lambdas/rolling").json():
+        assert time() - start < 10
+        sleep(0.2)
+    status = requests.get(f"{url}/lambdas/rolling").json()
+    assert not any(inst.get("retiring") for inst in status["instances"])
+    assert_eq(open_lambda.run("rolling", 0), 2)
+
+def rolling_update():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        write_lambda(reg_dir, "rolling", "import time\n\ndef f(event):\n    time.sleep(int(event))\n    return 1\n")
+
+        with TestConfContext(registry=reg_dir, registry_cache_ms=60000):
+            rolling_update_test(reg_dir=reg_dir)
+
+@test
+def failed_rollout_test(reg_dir):
+    url = 'http://localhost:5000'
+    open_lambda = OpenLambda()
+    assert_eq(open_lambda.run("rollback", 0), 1)
+
+    # new code that can't create a sandbox (too little memory to start)
+    broken = {"f.py": "def f(event):\n    return 2\n",
+              "ol.yaml": "memory_mb: 1\n"}
+    for name, content in broken.items():
+        with open(os.path.join(reg_dir, "rollback", name), "w", encoding='utf-8') as code:
+            code.write(content)
+    check_status_code(requests.post(f"{url}/lambdas/rollback/refresh"))
+
+    # the update is abandoned, and reported like a failed refresh
+    start = time()
+    while True:
+        assert_eq(open_lambda.run("rollback", 0), 1)
+        status = requests.get(f"{url}/lambdas/rollback").json()
+        if status["refresh_failures"] > 0:
+            break
+        assert time() - start < 30
+        sleep(0.5)
+    if "abandoned update" not in status["refresh_error"]:
+        raise ValueError(f"unexpected refresh_error: {repr(status['refresh_error'])}")
+    assert "rollout" not in status
+
+    # the old code keeps serving, and scales up again under load
+    with ThreadPool(4) as pool:
+        pending = [pool.apply_async(requests.post, (f"{url}/run/rollback", "3")) for _ in range(4)]
+        sleep(2)
+        instances = requests.get(f"{url}/lambdas/rollback").json()["instances"]
+        for result in pending:
+            r = result.get()
+            check_status_code(r)
+            assert_eq(r.json(), 1)
+    assert_eq(len(instances), 4)
+    assert not any(inst.get("retiring") for inst in instances)
+
+def failed_rollout():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        write_lambda(reg_dir, "rollback",
+                     "import time\n\ndef f(event):\n    time.sleep(int(event))\n    return 1\n",
+                     "max_instances: 4\nscaling:\n  policy: concurrency\n  step: 4\n")
+
+        with TestConfContext(registry=reg_dir, registry_cache_ms=60000, features={"import_cache": ""}):
+            failed_rollout_test(reg_dir=reg_dir)
+
+@test
+def cancellation_test():
+    url = 'http://localhost:5000'
+    open_lambda = OpenLambda()
+    open_lambda.run("nap", 0)
+
+    expect_status(requests.delete(f"{url}/invocations/no-such-invocation"), 404)
+
+    # a running invocation, by the request ID the client chose
+    with ThreadPool(1) as pool:
+        slow = pool.apply_async(requests.post, (f"{url}/run/nap", "5"),
+                                {"headers": {"X-Request-Id": "cancel-running"}})
+        sleep(1)
+        r = requests.delete(f"{url}/invocations/cancel-running")
+        check_status_code(r)
+        assert_eq(r.json(), {"id": "cancel-running", "cancelled": "running"})
+        expect_status(slow.get(), 499)
+    expect_status(requests.delete(f"{url}/invocations/cancel-running"), 404)
+
+    # a queued one (nap has a single instance), which never runs
+    with ThreadPool(2) as pool:
+        running = pool.apply_async(requests.post, (f"{url}/run/nap", "2"))
+        sleep(0.5)
+        queued = pool.apply_async(requests.post, (f"{url}/run/nap", "2"),
+                                  {"headers": {"X-Request-Id": "cancel-queued"}})
+        sleep(0.5)
+        r = requests.delete(f"{url}/invocations/cancel-queued")
+        check_status_code(r)
+        assert_eq(r.json()["cancelled"], "queued")
+        expect_status(queued.get(), 499)
+        check_status_code(running.get())
+
+    # an async one, whose record says it was cancelled
+    invocation_id = open_lambda.run_async("nap", 5)
+    sleep(1)
+    check_status_code(requests.delete(f"{url}/invocations/{invocation_id}"))
+    start = time()
+    while open_lambda.get_invocation(invocation_id)["state"] != "cancelled":
+        assert time() - start < 10
+        sleep(0.2)
+    expect_status(requests.delete(f"{url}/invocations/{invocation_id}"), 409)
+
+    # clients that go away cancel their invocations too
+    try:
+        requests.post(f"{url}/run/nap", "5", timeout=1)
+        raise ValueError("expected the request to time out")
+    except requests.exceptions.ReadTimeout:
+        pass
+
+    # (whether the invocation was still queued, behind the handlers of
+    # earlier ones that kept running, or running)
+    start = time()
+    while requests.get(f"{url}/lambdas/nap").json()["cancelled"] < 4:
+        assert time() - start < 5
+        sleep(0.2)
+
+    metrics = get_metrics()
+    counted = sum(metrics.get(f'ol_lambda_cancelled_total{{lambda="nap",stage="{stage}"}}', 0)
+                  for stage in ["queued", "running"])
+    assert_eq(counted, 4)
+
+CANCEL_KEYS = [
+    {"id": "alice", "secret": "alice-secret-0123456789", "scopes": ["admin", "invoke"]},
+    {"id": "bob", "secret": "bob-secret-0123456789", "scopes": ["invoke"]},
+]
+
+@test
+def cancellation_auth_test():
+    url = 'http://localhost:5000'
+    alice = {"Authorization": f"Bearer {CANCEL_KEYS[0]['secret']}", "X-Request-Id": "alices-request"}
+    bob = {"Authorization": f"Bearer {CANCEL_KEYS[1]['secret']}"}
+
+    # clients choose their request IDs, so only the key that started an
+    # invocation may cancel it by its request ID
+    with ThreadPool(1) as pool:
+        slow = pool.apply_async(requests.post, (f"{url}/run/nap", "5"), {"headers": alice})
+        sleep(1)
+        expect_status(requests.delete(f"{url}/invocations/alices-request", headers=bob), 404)
+        check_status_code(requests.delete(f"{url}/invocations/alices-request", headers=alice))
+        expect_status(slow.get(), 499)
+
+    # the same goes for polling and cancelling async invocations
+    alice = {"Authorization": alice["Authorization"]}
+    r = requests.post(f"{url}/run-async/nap", "5", headers=alice)
+    expect_status(r, 202)
+    async_url = f"{url}/invocations/{r.json()['id']}"
+    expect_status(requests.get(async_url, headers=bob), 404)
+    expect_status(requests.delete(async_url, headers=bob), 404)
+    check_status_code(requests.get(async_url, headers=alice))
+    check_status_code(requests.delete(async_url, headers=alice))
+
+    start = time()
+    while True:
+        r = requests.get(async_url, headers=alice)
+        check_status_code(r)
+        if r.json()["state"] == "cancelled":
+            break
+        assert time() - start < 10
+        sleep(0.2)
+
+def cancellation():
+    with tempfile.TemporaryDirectory() as reg_dir:
+        write_lambda(reg_dir, "nap", "import time\n\ndef f(event):\n    time.sleep(int(event))\n",
+                     "max_instances: 1\n")
+
+        with TestConfContext(registry=reg_dir):
+            cancellation_test()
+
+        with TestConfContext(registry=reg_dir, auth={"enabled": True, "public_paths": ["/status", "/pid"],
+                                                     "keys": CANCEL_KEYS}):
+            cancellation_auth_test()
+
+def wait_invocation(invocation_id):
+    ''' Polls an async invocation until it has finished, returning its record '''
+    open_lambda = OpenLambda()
+    start = time()
+    while True:
+        record = open_lambda.get_invocation(invocation_id)
+        if record["state"] not in ("queued", "running"):
+            return record
+        assert time() - start < 30
+        sleep(0.2)
+
+@test
+def async_test():
+    url = 'http://localhost:5000'
+    open_lambda = OpenLambda()
+
+    # the invocation is queued, and the result fetched later
+    invocation_id = open_lambda.run_async("echo", {"hello": "world"})
+    record = wait_invocation(invocation_id)
+    assert_eq(record["state"], "done")
+    assert_eq(record["lambda"], "echo")
+    assert_eq(record["status_code"], 200)
+    assert_eq(json.loads(record["result"]), {"hello": "world"})
+
+    expect_status(requests.get(f"{url}/invocations/no-such-invocation"), 404)
+    expect_status(requests.post(f"{url}/run-async/", "null"), 400)
+
+    return {"invocation_id": invocation_id}
+
+@test
+def async_restart_test(invocation_id):
+    # results are kept in invocations_dir, so they outlive the worker
+    record = OpenLambda().get_invocation(invocation_id)
+    assert_eq(record["state"], "done")
+    assert_eq(json.loads(record["result"]), {"hello": "world"})
+
+def async_invocations():
+    with tempfile.TemporaryDirectory() as invocations_dir:
+        with TestConfContext(invocations_dir=invocations_dir):
+            result = async_test()
+            if result is not None:
+                async_restart_test(invocation_id=result["invocation_id"])
+
 def run_tests():
     ping_test()
+    async_invocations()
+    metrics_test()
+    with TestConfContext(logging={"format": "json", "level": "info"}):
+        logging_test()
+    latency_stats_test()
+    with TestConfContext(features={"timing_headers": True}):
+        timing_headers_test()
+    reload_test()
 
     # do smoke tests under various configs
     with TestConfContext(features={"import_cache": ""}):
@@ -255,11 +1471,67 @@ def run_tests():
     # make sure we can use WSGI apps based on frameworks like Flask
     flask_test()
 
+    # per-lambda settings from ol.yaml
+    lambda_config()
+
+    # max_instances, max_queued and max_queue_ms
+    admission()
+
+    # cancelling invocations by ID, or by disconnecting
+    cancellation()
+
+    # prewarm manifest and min_instances
+    prewarm()
+
+    # pausing and destroying idle sandboxes
+    idle()
+
+    # scaling policies from ol.yaml
+    autoscaling()
+
+    # numbered versions and weighted aliases
+    versions()
+
+    # lambdas calling other lambdas through the host socket
+    lambda_calls()
+
+    # cron schedules from the API, config.json, and ol.yaml
+    schedules()
+
+    # inspecting loaded lambdas, and managing them
+    introspection()
+    lambda_admin_test()
+
+    # in-flight invocations finish before the worker stops
+    drain_test()
+
+    # spans, and trace context passed to lambdas
+    tracing()
+
+    # API keys and signed requests
+    with TestConfContext(auth={"enabled": True, "public_paths": ["/status", "/pid"],
+                               "keys": [ADMIN_KEY, ECHO_KEY, HELLO_KEY]}):
+        auth_test()
+
+    # HTTPS and mutual TLS
+    tls()
+
+    # runaway invocations are cut off at their deadline
+    with TestConfContext(limits={"max_runtime_default": 2}):
+        deadline_test()
+
     # make sure code updates get pulled within the cache time
     with tempfile.TemporaryDirectory() as reg_dir:
         with TestConfContext(registry=reg_dir, registry_cache_ms=3000):
             update_code()
 
+    # ... without making invocations wait, or failing them if the new code is broken
+    code_refresh()
+
+    # ... replacing instances gradually
+    rolling_update()
+    failed_rollout()
+
     # test heavy load
     with TestConfContext():
         stress_one_lambda(procs=1, seconds=15)
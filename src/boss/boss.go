@@ -12,6 +12,7 @@ import (
 	"syscall"
 	"github.com/open-lambda/open-lambda/ol/boss/cloudvm"
 	"github.com/open-lambda/open-lambda/ol/boss/autoscaling"
+	"github.com/open-lambda/open-lambda/ol/common"
 )
 
 const (
@@ -19,11 +20,13 @@ const (
 	BOSS_STATUS_PATH = "/status"
 	SCALING_PATH     = "/scaling/worker_count"
 	SHUTDOWN_PATH    = "/shutdown"
+	SCHEDULES_PATH   = "/schedules"
 )
 
 type Boss struct {
 	workerPool *cloudvm.WorkerPool
 	autoScaler  autoscaling.Scaling
+	scheduler  *common.Scheduler
 }
 
 func (b *Boss) BossStatus(w http.ResponseWriter, r *http.Request) {
@@ -45,6 +48,7 @@ func (b *Boss) BossStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func (b *Boss) Close(_ http.ResponseWriter, _ *http.Request) {
+	b.scheduler.Stop()
 	b.workerPool.Close()
 	if Conf.Scaling == "threshold-scaler" {
 		b.autoScaler.Close()
@@ -98,6 +102,16 @@ func (b *Boss) ScalingWorker(w http.ResponseWriter, r *http.Request) {
 func BossMain() (err error) {
 	fmt.Printf("WARNING!  Boss incomplete (only use this as part of development process).\n")
 
+	workerTransport, err := common.ClientTransport(&Conf.Worker_tls)
+	if err != nil {
+		return fmt.Errorf("could not load worker_tls files: %v", err)
+	}
+	cloudvm.SetWorkerTLS(workerTransport)
+
+	if err := common.StartTracing(&Conf.Tracing, "ol-boss"); err != nil {
+		return fmt.Errorf("could not start tracing: %v", err)
+	}
+
 	pool, err := cloudvm.NewWorkerPool(Conf.Platform, Conf.Worker_Cap)
 	if err != nil {
 		return err
@@ -112,10 +126,20 @@ func BossMain() (err error) {
 		boss.autoScaler.Launch(boss.workerPool)
 	}
 
+	// scheduled invocations are forwarded to workers like any other
+	boss.scheduler, err = common.NewScheduler(&Conf.Scheduler, func(_ string, w http.ResponseWriter, r *http.Request) {
+		boss.workerPool.RunLambda(w, r)
+	})
+	if err != nil {
+		return err
+	}
+
 	http.HandleFunc(BOSS_STATUS_PATH, boss.BossStatus)
 	http.HandleFunc(SCALING_PATH, boss.ScalingWorker)
 	http.HandleFunc(RUN_PATH, boss.workerPool.RunLambda)
 	http.HandleFunc(SHUTDOWN_PATH, boss.Close)
+	http.HandleFunc(SCHEDULES_PATH, boss.scheduler.HandleHTTP)
+	http.HandleFunc(SCHEDULES_PATH+"/", boss.scheduler.HandleHTTP)
 
 	// clean up if signal hits us
 	c := make(chan os.Signal, 1)
@@ -125,10 +149,22 @@ func BossMain() (err error) {
 		<-c
 		log.Printf("received kill signal, cleaning up")
 		boss.Close(nil, nil)
+		common.StopTracing()
 		os.Exit(0)
 	}()
 
 	port := fmt.Sprintf(":%s", Conf.Boss_port)
+	server := &http.Server{Addr: port}
+	server.TLSConfig, err = common.ServerTLSConfig(&Conf.TLS)
+	if err != nil {
+		return fmt.Errorf("could not load TLS files: %v", err)
+	}
+
+	// should never return if successful
+	if server.TLSConfig != nil {
+		fmt.Printf("Listen on port %s (TLS)\n", port)
+		return server.ListenAndServeTLS("", "")
+	}
 	fmt.Printf("Listen on port %s\n", port)
-	return http.ListenAndServe(port, nil) // should never return if successful
+	return server.ListenAndServe()
 }
@@ -11,6 +11,8 @@ import (
 	"sync/atomic"
 	"time"
 	"errors"
+
+	"github.com/open-lambda/open-lambda/ol/common"
 )
 
 func NewWorkerPool(platform string, worker_cap int) (*WorkerPool, error) {
@@ -293,12 +295,21 @@ func (pool *WorkerPool) RunLambda(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 
+	span := common.StartRequestSpan("RunLambda", r.Header)
+	defer span.End()
+
 	worker := <-pool.queue
 	pool.queue <- worker
 	atomic.AddInt32(&worker.numTask, 1)
 	atomic.AddInt32(&pool.totalTask, 1)
 
+	// the worker's spans (or, with tracing off, the client's) are
+	// children of this one
+	fwdSpan := common.StartSpan("ForwardTask", span, common.SPAN_CLIENT)
+	fwdSpan.SetAttr("worker", worker.workerId)
+	fwdSpan.Inject(r.Header)
 	pool.ForwardTask(w, r, worker)
+	fwdSpan.End()
 
 	atomic.AddInt32(&worker.numTask, -1)
 	atomic.AddInt32(&pool.totalTask, -1)
@@ -392,17 +403,34 @@ func (pool *WorkerPool) StatusCluster() map[string]int {
 	return output
 }
 
+// how requests are forwarded to workers (https once SetWorkerTLS
+// is given a config)
+var workerScheme = "http"
+var workerClient = &http.Client{}
+
+// SetWorkerTLS makes the boss connect to workers over TLS, using
+// transport (or plain http, if transport is nil)
+func SetWorkerTLS(transport *http.Transport) {
+	if transport == nil {
+		workerScheme = "http"
+		workerClient = &http.Client{}
+		return
+	}
+
+	workerScheme = "https"
+	workerClient = &http.Client{Transport: transport}
+}
+
 // forward request to worker
 // TODO: this is kept for other platforms
 func forwardTaskHelper(w http.ResponseWriter, req *http.Request, workerIp string) error {
 	host := fmt.Sprintf("%s:%d", workerIp, 5000) //TODO: read from config
-	req.URL.Scheme = "http"
+	req.URL.Scheme = workerScheme
 	req.URL.Host = host
 	req.Host = host
 	req.RequestURI = ""
 
-	client := http.Client{}
-	resp, err := client.Do(req)
+	resp, err := workerClient.Do(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return err
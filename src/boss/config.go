@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 	"github.com/open-lambda/open-lambda/ol/boss/cloudvm"
+	"github.com/open-lambda/open-lambda/ol/common"
 )
 
 var Conf *Config
@@ -17,9 +19,27 @@ type Config struct {
 	Boss_port  string              `json:"boss_port"`
 	Worker_Cap int                 `json:"worker_cap"`
 	Gcp        *cloudvm.GcpConfig  `json:"gcp"`
+
+	// TLS for the boss's own listener
+	TLS common.TLSConfig `json:"tls"`
+
+	// how the boss connects to workers (e.g., with a client cert,
+	// for workers that require mutual TLS)
+	Worker_tls common.TLSClientConfig `json:"worker_tls"`
+
+	// where to export spans of forwarded requests (off by default)
+	Tracing common.TracingConfig `json:"tracing"`
+
+	// lambdas to invoke on a schedule (through the workers)
+	Scheduler common.SchedulerConfig `json:"scheduler"`
 }
 
 func LoadDefaults() error {
+	schedulesPath, err := filepath.Abs("boss-schedules.json")
+	if err != nil {
+		return err
+	}
+
 	Conf = &Config{
 		Platform:   "mock",
 		Scaling:    "manual",
@@ -27,6 +47,10 @@ func LoadDefaults() error {
 		Boss_port:  "5000",
 		Worker_Cap: 4,
 		Gcp: cloudvm.GetGcpConfigDefaults(),
+		Scheduler: common.SchedulerConfig{
+			State_path: schedulesPath,
+			Schedules:  []common.ScheduleSpec{},
+		},
 	}
 
 	return checkConf()
@@ -55,6 +79,22 @@ func checkConf() error {
 		return fmt.Errorf("Scaling type '%s' not implemented", Conf.Scaling)
 	}
 
+	if err := Conf.TLS.Check(); err != nil {
+		return err
+	}
+
+	if err := Conf.Tracing.Check(); err != nil {
+		return err
+	}
+
+	if err := Conf.Worker_tls.Check(); err != nil {
+		return fmt.Errorf("worker_tls: %v", err)
+	}
+
+	if err := Conf.Scheduler.Check(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -0,0 +1,248 @@
+package common
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// authentication for the worker's HTTP API
+//
+// Clients identify themselves with one of the configured keys,
+// either by sending its secret directly (an API key), or by signing
+// the request with it (HMAC).  Each key has scopes: "invoke" allows
+// running lambdas (optionally only those whose names match some
+// patterns), and "admin" allows everything else (stats, pprof,
+// debug, etc).
+
+const (
+	AUTH_SCOPE_INVOKE = "invoke"
+	AUTH_SCOPE_ADMIN  = "admin"
+
+	// API keys may be passed as "Authorization: Bearer <secret>"
+	// or in this header
+	AUTH_API_KEY_HEADER = "X-OL-Api-Key"
+
+	// signed requests carry these three headers
+	AUTH_KEY_ID_HEADER    = "X-OL-Key-Id"
+	AUTH_TIMESTAMP_HEADER = "X-OL-Timestamp"
+	AUTH_SIGNATURE_HEADER = "X-OL-Signature"
+)
+
+type AuthConfig struct {
+	// if false, every request is allowed (as before auth existed)
+	Enabled bool `json:"enabled"`
+
+	// paths anybody may request, without credentials (e.g., for
+	// health checks).  A path ending in "/" covers everything
+	// beneath it.
+	Public_paths []string `json:"public_paths"`
+
+	// how far (in seconds) the timestamp of a signed request may
+	// be from the worker's clock
+	Max_skew_sec int `json:"max_skew_sec"`
+
+	Keys []AuthKey `json:"keys"`
+}
+
+type AuthKey struct {
+	// names the key in signed requests and logs
+	ID string `json:"id"`
+
+	Secret string `json:"secret"`
+
+	// "invoke" and/or "admin"
+	Scopes []string `json:"scopes"`
+
+	// which lambdas may be invoked with this key, as path.Match
+	// patterns (e.g., "reports-*").  Empty means all of them.  A
+	// pattern matching a lambda's name also covers its versions
+	// and aliases (e.g., "reports" covers "reports@2").
+	Lambdas []string `json:"lambdas"`
+}
+
+func (conf *AuthConfig) check() error {
+	if conf.Enabled && len(conf.Keys) == 0 {
+		return fmt.Errorf("auth is enabled, but auth.keys is empty")
+	}
+
+	if conf.Max_skew_sec < 0 {
+		return fmt.Errorf("auth.max_skew_sec may not be negative")
+	}
+
+	ids := map[string]bool{}
+	for _, key := range conf.Keys {
+		if key.ID == "" {
+			return fmt.Errorf("every key in auth.keys needs an id")
+		} else if ids[key.ID] {
+			return fmt.Errorf("auth key id '%s' is used more than once", key.ID)
+		}
+		ids[key.ID] = true
+
+		if len(key.Secret) < 16 {
+			return fmt.Errorf("secret of auth key '%s' must be at least 16 characters", key.ID)
+		}
+
+		for _, scope := range key.Scopes {
+			if scope != AUTH_SCOPE_INVOKE && scope != AUTH_SCOPE_ADMIN {
+				return fmt.Errorf("auth key '%s' has unknown scope '%s'", key.ID, scope)
+			}
+		}
+
+		for _, pattern := range key.Lambdas {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("auth key '%s' has bad lambda pattern '%s': %v", key.ID, pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsPublic tells whether urlPath may be requested without credentials
+func (conf *AuthConfig) IsPublic(urlPath string) bool {
+	for _, public := range conf.Public_paths {
+		if urlPath == public {
+			return true
+		}
+		if strings.HasSuffix(public, "/") && strings.HasPrefix(urlPath, public) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyBySecret returns the key with the given secret, or nil.  Every
+// key is compared in constant time, so timing doesn't leak secrets.
+func (conf *AuthConfig) KeyBySecret(secret string) *AuthKey {
+	var found *AuthKey
+	for i := range conf.Keys {
+		if subtle.ConstantTimeCompare([]byte(conf.Keys[i].Secret), []byte(secret)) == 1 {
+			found = &conf.Keys[i]
+		}
+	}
+	return found
+}
+
+// KeyByID returns the key with the given ID, or nil
+func (conf *AuthConfig) KeyByID(id string) *AuthKey {
+	for i := range conf.Keys {
+		if conf.Keys[i].ID == id {
+			return &conf.Keys[i]
+		}
+	}
+	return nil
+}
+
+func (key *AuthKey) HasScope(scope string) bool {
+	for _, other := range key.Scopes {
+		if other == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// MayInvoke tells whether the key can be used to run the named lambda
+func (key *AuthKey) MayInvoke(lambda string) bool {
+	if !key.HasScope(AUTH_SCOPE_INVOKE) {
+		return false
+	}
+
+	if len(key.Lambdas) == 0 {
+		return true
+	}
+
+	// strip any version or alias ("name@ref")
+	baseName := lambda
+	if i := strings.LastIndex(lambda, "@"); i >= 0 {
+		baseName = lambda[:i]
+	}
+
+	for _, pattern := range key.Lambdas {
+		if ok, _ := path.Match(pattern, lambda); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, baseName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// context key for the ID of the key a request was authenticated with
+type authKeyIDKey struct{}
+
+// WithAuthKeyID returns a copy of r that remembers it was
+// authenticated with the key with the given ID
+func WithAuthKeyID(r *http.Request, keyID string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authKeyIDKey{}, keyID))
+}
+
+// AuthKeyID returns the ID of the key a request (with context ctx)
+// was authenticated with, or "" if it wasn't (e.g., auth is disabled)
+func AuthKeyID(ctx context.Context) string {
+	keyID, _ := ctx.Value(authKeyIDKey{}).(string)
+	return keyID
+}
+
+// RequestSignature computes the hex-encoded HMAC-SHA256 a client
+// must send in X-OL-Signature.  The signed string is the method,
+// request URI (path and query), timestamp (seconds since the epoch,
+// as sent in X-OL-Timestamp), and hex SHA-256 of the body, joined by
+// newlines.
+func RequestSignature(secret, method, requestURI, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	msg := method + "\n" + requestURI + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WorkerGet sends a GET to the (local) worker, using the first
+// admin key in the config if auth is enabled (and https if TLS is).
+// This is for admin commands that have already loaded the worker's
+// config.
+func WorkerGet(url string) (*http.Response, error) {
+	return workerRequest("GET", url)
+}
+
+// WorkerPost is like WorkerGet, but sends an (empty) POST
+func WorkerPost(url string) (*http.Response, error) {
+	return workerRequest("POST", url)
+}
+
+func workerRequest(method string, url string) (*http.Response, error) {
+	client := http.DefaultClient
+	if Conf.TLS.Enabled() {
+		tlsConf, err := localWorkerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+		url = "https://" + strings.TrimPrefix(url, "http://")
+	}
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if Conf.Auth.Enabled {
+		for _, key := range Conf.Auth.Keys {
+			if key.HasScope(AUTH_SCOPE_ADMIN) {
+				req.Header.Set("Authorization", "Bearer "+key.Secret)
+				break
+			}
+		}
+	}
+
+	return client.Do(req)
+}
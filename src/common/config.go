@@ -7,6 +7,7 @@ import (
 	"log"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/urfave/cli/v2"
@@ -64,10 +65,35 @@ type Config struct {
 	// which OCI implementation to use for the docker sandbox (e.g., runc or runsc)
 	Docker_runtime string `json:"docker_runtime"`
 
+	// map from host names (e.g., "api.example.com") or path
+	// prefixes (e.g., "/api/") to lambda names, so requests outside
+	// of /run/ can be routed to a lambda.  Path prefixes must start
+	// and end with "/", are stripped before forwarding, and may not
+	// be under the worker's own endpoints (e.g., /run/ or /admin/).
+	Lambda_routes map[string]string `json:"lambda_routes"`
+
+	// optional path to a JSON file listing lambdas to get ready
+	// (code, packages, Zygotes and sandboxes) when the worker
+	// starts, before /status reports it ready, e.g.:
+	// {"lambdas": ["hello", "resize@prod"]}
+	Prewarm_manifest string `json:"prewarm_manifest"`
+
+	// directory where asynchronous invocations (/run-async) are
+	// saved.  It must be outside worker_dir (which is wiped when the
+	// worker starts), so queued invocations survive a restart.
+	Invocations_dir string `json:"invocations_dir"`
+
 	Limits   LimitsConfig   `json:"limits"`
 	Features FeaturesConfig `json:"features"`
 	Trace    TraceConfig    `json:"trace"`
 	Storage  StorageConfig  `json:"storage"`
+	Logging  LoggingConfig  `json:"logging"`
+	Auth     AuthConfig     `json:"auth"`
+	TLS      TLSConfig      `json:"tls"`
+	Tracing  TracingConfig  `json:"tracing"`
+
+	Scheduler SchedulerConfig `json:"scheduler"`
+	Scaling   ScalingConfig   `json:"scaling"`
 }
 
 type FeaturesConfig struct {
@@ -75,6 +101,9 @@ type FeaturesConfig struct {
 	Import_cache        string `json:"import_cache"`
 	Downsize_paused_mem bool   `json:"downsize_paused_mem"`
 	Enable_seccomp      bool   `json:"enable_seccomp"`
+
+	// add X-OL-Start and timing headers to invocation responses
+	Timing_headers bool `json:"timing_headers"`
 }
 
 type TraceConfig struct {
@@ -127,6 +156,64 @@ type LimitsConfig struct {
 	// how much memory do we use for an admin lambda that is used
 	// for pip installs?
 	Installer_mem_mb int `json:"installer_mem_mb"`
+
+	// how many asynchronous invocations (/run-async) may be
+	// dispatched to lambdas at once?  The rest wait on disk.
+	Async_concurrency int `json:"async_concurrency"`
+
+	// how many seconds after an asynchronous invocation finishes
+	// may its result be fetched?  (0 means results are kept until
+	// deleted by hand)
+	Async_ttl_sec int `json:"async_ttl_sec"`
+
+	// on shutdown, how many seconds may in-flight invocations
+	// take to finish before sandboxes are torn down?
+	Drain_grace_sec int `json:"drain_grace_sec"`
+
+	// unload lambdas (instances, code, and all) that haven't been
+	// invoked for this many seconds (0 means never)
+	Unload_idle_sec int `json:"unload_idle_sec"`
+
+	// lambdas may call each other (via /host/invoke.sock), but
+	// chains of calls may be at most this long
+	Max_call_depth int `json:"max_call_depth"`
+
+	// how many calls may each invocation make (-1 means no limit)?
+	// Lambdas may lower or raise this with max_calls in ol.yaml.
+	Max_calls int `json:"max_calls"`
+
+	// admission control: at most how many instances may each
+	// lambda have (0 means no limit), how many invocations may
+	// wait for one, and for how many milliseconds (0 means until
+	// their deadline)?  Lambdas may set their own limits in
+	// ol.yaml, but max_queued also sizes each lambda's queues, so
+	// a lambda can only lower that one.
+	Max_instances int `json:"max_instances"`
+	Max_queued    int `json:"max_queued"`
+	Max_queue_ms  int `json:"max_queue_ms"`
+
+	// how many instances of each lambda should keep a sandbox
+	// created (and paused) even when idle?  Lambdas may set their
+	// own min_instances in ol.yaml.
+	Min_instances int `json:"min_instances"`
+
+	// keep idle sandboxes unpaused for this many milliseconds
+	// after their last invocation (0 means pause right away), and
+	// destroy them once idle for this many seconds (0 means keep
+	// them until evicted).  Lambdas may set their own in ol.yaml.
+	Idle_grace_ms int `json:"idle_grace_ms"`
+	Idle_ttl_sec  int `json:"idle_ttl_sec"`
+
+	// rolling code updates: how many instances beyond the count
+	// when the update began may run, and how many fewer than that
+	// may be ready (if both are 0, max surge is 1)
+	Update_max_surge       int `json:"update_max_surge"`
+	Update_max_unavailable int `json:"update_max_unavailable"`
+
+	// destroy the sandbox of an invocation cancelled while running
+	// (otherwise, the handler may finish, and later invocations
+	// wait for it)
+	Cancel_destroys_sandbox bool `json:"cancel_destroys_sandbox"`
 }
 
 // Choose reasonable defaults for a worker deployment (based on memory capacity).
@@ -136,6 +223,8 @@ func LoadDefaults(olPath string) error {
 	registryDir := filepath.Join(olPath, "registry")
 	baseImgDir := filepath.Join(olPath, "lambda")
 	zygoteTreePath := filepath.Join(olPath, "default-zygotes-40.json")
+	schedulesPath := filepath.Join(olPath, "schedules.json")
+	invocationsDir := filepath.Join(olPath, "invocations")
 	packagesDir := filepath.Join(baseImgDir, "packages")
 
 	// split anything above 512 MB evenly between handler and import cache
@@ -161,6 +250,8 @@ func LoadDefaults(olPath string) error {
 		Registry_cache_ms: 5000, // 5 seconds
 		Mem_pool_mb:       memPoolMb,
 		Import_cache_tree: zygoteTreePath,
+		Lambda_routes:     map[string]string{},
+		Invocations_dir:   invocationsDir,
 		Limits: LimitsConfig{
 			Procs:               10,
 			Mem_mb:              50,
@@ -168,6 +259,13 @@ func LoadDefaults(olPath string) error {
 			Max_runtime_default: 30,
 			Installer_mem_mb:    Max(250, Min(500, memPoolMb/2)),
 			Swappiness:          0,
+			Async_concurrency:   32,
+			Async_ttl_sec:       24 * 60 * 60,
+			Drain_grace_sec:     30,
+			Max_call_depth:      8,
+			Max_calls:           100,
+			Max_queued:          1024,
+			Update_max_surge:    1,
 		},
 		Features: FeaturesConfig{
 			Import_cache:        "tree",
@@ -186,6 +284,21 @@ func LoadDefaults(olPath string) error {
 			Scratch: "",
 			Code:    "",
 		},
+		Logging: LoggingConfig{
+			Format:     "text",
+			Level:      "info",
+			Subsystems: map[string]string{},
+		},
+		Auth: AuthConfig{
+			Enabled:      false,
+			Public_paths: []string{"/status", "/pid"},
+			Max_skew_sec: 300,
+			Keys:         []AuthKey{},
+		},
+		Scheduler: SchedulerConfig{
+			State_path: schedulesPath,
+			Schedules:  []ScheduleSpec{},
+		},
 	}
 
 	return checkConf()
@@ -208,16 +321,25 @@ func LoadConf(path string) error {
 }
 
 func checkConf() error {
-	if !path.IsAbs(Conf.Worker_dir) {
+	if err := Conf.check(); err != nil {
+		return err
+	}
+	return Conf.applyLogging()
+}
+
+// check validates the config (filling in defaults for sections that
+// older configs lack), without putting any of it into effect
+func (conf *Config) check() error {
+	if !path.IsAbs(conf.Worker_dir) {
 		return fmt.Errorf("Worker_dir cannot be relative")
 	}
 
-	if Conf.Sandbox == "sock" {
-		if Conf.SOCK_base_path == "" {
+	if conf.Sandbox == "sock" {
+		if conf.SOCK_base_path == "" {
 			return fmt.Errorf("must specify sock_base_path")
 		}
 
-		if !path.IsAbs(Conf.SOCK_base_path) {
+		if !path.IsAbs(conf.SOCK_base_path) {
 			return fmt.Errorf("sock_base_path cannot be relative")
 		}
 
@@ -228,27 +350,144 @@ func checkConf() error {
 		// evicted.
 		//
 		// TODO: revise evictor and relax this
-		minMem := 2 * Max(Conf.Limits.Installer_mem_mb, Conf.Limits.Mem_mb)
-		if minMem > Conf.Mem_pool_mb {
+		minMem := 2 * Max(conf.Limits.Installer_mem_mb, conf.Limits.Mem_mb)
+		if minMem > conf.Mem_pool_mb {
 			return fmt.Errorf("memPoolMb must be at least %d", minMem)
 		}
-	} else if Conf.Sandbox == "docker" {
-		if Conf.Pkgs_dir == "" {
+	} else if conf.Sandbox == "docker" {
+		if conf.Pkgs_dir == "" {
 			return fmt.Errorf("must specify packages directory")
 		}
 
-		if !path.IsAbs(Conf.Pkgs_dir) {
+		if !path.IsAbs(conf.Pkgs_dir) {
 			return fmt.Errorf("Pkgs_dir cannot be relative")
 		}
 
-		if Conf.Features.Import_cache != "" {
+		if conf.Features.Import_cache != "" {
 			return fmt.Errorf("features.import_cache must be disabled for docker Sandbox")
 		}
 	} else {
-		return fmt.Errorf("Unknown Sandbox type '%s'", Conf.Sandbox)
+		return fmt.Errorf("Unknown Sandbox type '%s'", conf.Sandbox)
+	}
+
+	for route, name := range conf.Lambda_routes {
+		if route == "" || name == "" {
+			return fmt.Errorf("lambda_routes may not contain empty host/prefix or lambda names")
+		}
+
+		if strings.HasPrefix(route, "/") && !strings.HasSuffix(route, "/") {
+			return fmt.Errorf("lambda_routes prefix '%s' must end with '/'", route)
+		} else if !strings.HasPrefix(route, "/") && strings.Contains(route, "/") {
+			return fmt.Errorf("lambda_routes host '%s' may not contain '/'", route)
+		}
+
+		// (prefixes that would take over the worker's own
+		// endpoints are rejected when the routes are registered)
+	}
+
+	if conf.Limits.Unload_idle_sec < 0 {
+		return fmt.Errorf("limits.unload_idle_sec may not be negative")
+	}
+
+	if conf.Limits.Max_call_depth < 0 || conf.Limits.Max_calls < -1 {
+		return fmt.Errorf("limits.max_call_depth may not be negative, nor limits.max_calls less than -1 (no limit)")
+	}
+	// configs written before lambdas could call each other
+	if conf.Limits.Max_call_depth == 0 {
+		conf.Limits.Max_call_depth = 8
+	}
+	if conf.Limits.Max_calls == 0 {
+		conf.Limits.Max_calls = 100
+	}
+
+	if conf.Limits.Drain_grace_sec < 0 {
+		return fmt.Errorf("limits.drain_grace_sec may not be negative")
+	}
+	// configs written before the worker drained on shutdown
+	if conf.Limits.Drain_grace_sec == 0 {
+		conf.Limits.Drain_grace_sec = 30
+	}
+
+	if conf.Limits.Max_instances < 0 || conf.Limits.Max_queued < 0 || conf.Limits.Max_queue_ms < 0 || conf.Limits.Min_instances < 0 {
+		return fmt.Errorf("limits.max_instances, limits.max_queued, limits.max_queue_ms and limits.min_instances may not be negative")
+	}
+
+	if conf.Limits.Idle_grace_ms < 0 || conf.Limits.Idle_ttl_sec < 0 {
+		return fmt.Errorf("limits.idle_grace_ms and limits.idle_ttl_sec may not be negative")
 	}
 
-	return nil
+	if conf.Limits.Update_max_surge < 0 || conf.Limits.Update_max_unavailable < 0 {
+		return fmt.Errorf("limits.update_max_surge and limits.update_max_unavailable may not be negative")
+	}
+
+	if conf.Prewarm_manifest != "" && !path.IsAbs(conf.Prewarm_manifest) {
+		return fmt.Errorf("prewarm_manifest cannot be relative")
+	}
+
+	// configs written before async invocations were kept outside
+	// the worker dir
+	if conf.Invocations_dir == "" {
+		conf.Invocations_dir = filepath.Join(filepath.Dir(conf.Worker_dir), "invocations")
+	}
+	if !path.IsAbs(conf.Invocations_dir) {
+		return fmt.Errorf("invocations_dir cannot be relative")
+	}
+	if rel, err := filepath.Rel(conf.Worker_dir, conf.Invocations_dir); err == nil && !strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("invocations_dir may not be inside worker_dir, which is wiped when the worker starts")
+	}
+	if conf.Limits.Async_ttl_sec < 0 || conf.Limits.Async_concurrency < 0 {
+		return fmt.Errorf("limits.async_ttl_sec and limits.async_concurrency may not be negative")
+	}
+	if conf.Limits.Async_concurrency == 0 {
+		conf.Limits.Async_concurrency = 32
+	}
+	// configs written before the queues were configurable
+	if conf.Limits.Max_queued == 0 {
+		conf.Limits.Max_queued = 1024
+	}
+
+	if err := conf.Scaling.Check(); err != nil {
+		return err
+	}
+	conf.Scaling.fillDefaults()
+
+	if err := conf.Auth.check(); err != nil {
+		return err
+	}
+
+	if err := conf.TLS.Check(); err != nil {
+		return err
+	}
+
+	if err := conf.Tracing.Check(); err != nil {
+		return err
+	}
+
+	if err := conf.Scheduler.Check(); err != nil {
+		return err
+	}
+
+	// configs written before the logging section existed
+	if conf.Logging.Format == "" {
+		conf.Logging.Format = "text"
+	}
+	if conf.Logging.Level == "" {
+		conf.Logging.Level = "info"
+	}
+
+	return conf.Logging.check()
+}
+
+// applyLogging puts the config's logging settings (and trace flags)
+// into effect
+func (conf *Config) applyLogging() error {
+	logConf := conf.Logging
+	logConf.Subsystems = map[string]string{}
+	for subsystem, level := range conf.Logging.Subsystems {
+		logConf.Subsystems[subsystem] = level
+	}
+	applyTraceFlags(&logConf, conf.Trace)
+	return SetLogging(logConf)
 }
 
 // SandboxConfJson marshals the Sandbox_config of the Config into a JSON string.
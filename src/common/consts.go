@@ -6,3 +6,14 @@ const (
 	RT_PYTHON RuntimeType = iota
 	RT_NATIVE             = iota
 )
+
+func (rt RuntimeType) String() string {
+	switch rt {
+	case RT_PYTHON:
+		return "python"
+	case RT_NATIVE:
+		return "native"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,200 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression, with the usual five
+// fields (minute, hour, day of month, month, day of week).  Each
+// field may be "*", a number, a range ("1-5"), a list ("1,3,5"), or
+// any of those with a step ("*/15", "0-30/10").  Months and days of
+// week may also be given by name ("jan", "mon"), and Sunday is 0 or
+// 7.  The macros @yearly (or @annually), @monthly, @weekly, @daily
+// (or @midnight) and @hourly are also accepted.
+//
+// As in cron, if both day of month and day of week are restricted
+// (neither is "*"), a time matches if either of them does.
+type CronSchedule struct {
+	expr string
+
+	// bit i is set if value i matches
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	// was the field "*" (or "*/n")?
+	domStar bool
+	dowStar bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// ParseCron parses a cron expression (see CronSchedule)
+func ParseCron(expr string) (*CronSchedule, error) {
+	fieldsExpr := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(fieldsExpr)]; ok {
+		fieldsExpr = macro
+	}
+
+	fields := strings.Fields(fieldsExpr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' should have 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+
+	sched := &CronSchedule{expr: expr}
+	var err error
+	if sched.minute, _, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("bad minute in '%s': %v", expr, err)
+	}
+	if sched.hour, _, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("bad hour in '%s': %v", expr, err)
+	}
+	if sched.dom, sched.domStar, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("bad day of month in '%s': %v", expr, err)
+	}
+	if sched.month, _, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("bad month in '%s': %v", expr, err)
+	}
+	if sched.dow, sched.dowStar, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return nil, fmt.Errorf("bad day of week in '%s': %v", expr, err)
+	}
+
+	// 7 is another name for Sunday
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+
+	return sched, nil
+}
+
+func parseCronField(field string, min int, max int, names map[string]int) (bits uint64, star bool, err error) {
+	parseNum := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("'%s' is not a number", s)
+		}
+		if n < min || n > max {
+			return 0, fmt.Errorf("%d is not between %d and %d", n, min, max)
+		}
+		return n, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, false, fmt.Errorf("bad step in '%s'", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rangePart == "*" {
+			star = star || field == part
+		} else if i := strings.Index(rangePart, "-"); i >= 0 {
+			if lo, err = parseNum(rangePart[:i]); err != nil {
+				return 0, false, err
+			}
+			if hi, err = parseNum(rangePart[i+1:]); err != nil {
+				return 0, false, err
+			}
+			if lo > hi {
+				return 0, false, fmt.Errorf("range '%s' is backwards", rangePart)
+			}
+		} else {
+			if lo, err = parseNum(rangePart); err != nil {
+				return 0, false, err
+			}
+			// "5/10" means starting at 5, every 10
+			if step == 1 {
+				hi = lo
+			}
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, star, nil
+}
+
+func (sched *CronSchedule) String() string {
+	return sched.expr
+}
+
+// Matches tells whether t (to the minute) is one of the scheduled times
+func (sched *CronSchedule) Matches(t time.Time) bool {
+	if sched.minute&(1<<uint(t.Minute())) == 0 ||
+		sched.hour&(1<<uint(t.Hour())) == 0 ||
+		sched.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	return sched.dayMatches(t)
+}
+
+// Next returns the first scheduled time after t (in t's time zone),
+// or the zero time if there is none within five years (e.g., for
+// "0 0 30 2 *", which asks for February 30th)
+func (sched *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		if sched.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !sched.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if sched.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if sched.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// does t's day match (ignoring the time of day)?
+func (sched *CronSchedule) dayMatches(t time.Time) bool {
+	domOK := sched.dom&(1<<uint(t.Day())) != 0
+	dowOK := sched.dow&(1<<uint(t.Weekday())) != 0
+	if sched.domStar || sched.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
@@ -0,0 +1,323 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leveled, structured logging
+//
+// Each subsystem (sandbox, cgroup, etc.) gets a Logger, and may log
+// at a different verbosity than the others.  Loggers carry fields
+// (e.g., lambda name or sandbox ID) that are attached to every
+// record, either as key=val pairs after the message (text format) or
+// as top-level keys (json format), so records can be parsed by a log
+// pipeline without guessing at free-form suffixes.
+
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	if level < LOG_DEBUG || level > LOG_ERROR {
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+	return logLevelNames[level]
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, other := range logLevelNames {
+		if strings.ToLower(name) == other {
+			return LogLevel(i), nil
+		}
+	}
+	return LOG_INFO, fmt.Errorf("unknown log level '%s' (expected one of %v)", name, logLevelNames)
+}
+
+// subsystems that can be given their own verbosity
+var LOG_SUBSYSTEMS = []string{"sandbox", "cgroup", "evictor", "mempool", "packages", "zygote", "lambda", "server", "tracing", "scheduler"}
+
+type LoggingConfig struct {
+	// "text" or "json"
+	Format string `json:"format"`
+
+	// default level for every subsystem: debug, info, warn, or error
+	Level string `json:"level"`
+
+	// per-subsystem overrides of the default level
+	Subsystems map[string]string `json:"subsystems"`
+}
+
+func (conf *LoggingConfig) check() error {
+	if conf.Format != "text" && conf.Format != "json" {
+		return fmt.Errorf("logging.format must be 'text' or 'json', not '%s'", conf.Format)
+	}
+
+	if _, err := ParseLogLevel(conf.Level); err != nil {
+		return fmt.Errorf("logging.level: %v", err)
+	}
+
+	for subsystem, level := range conf.Subsystems {
+		found := false
+		for _, other := range LOG_SUBSYSTEMS {
+			found = found || subsystem == other
+		}
+		if !found {
+			return fmt.Errorf("unknown logging subsystem '%s' (expected one of %v)", subsystem, LOG_SUBSYSTEMS)
+		}
+		if _, err := ParseLogLevel(level); err != nil {
+			return fmt.Errorf("logging.subsystems.%s: %v", subsystem, err)
+		}
+	}
+
+	return nil
+}
+
+// settings currently in effect (these may be changed at runtime,
+// so they're kept apart from Conf)
+var logging = struct {
+	sync.RWMutex
+	conf   LoggingConfig
+	json   bool
+	level  LogLevel
+	levels map[string]LogLevel
+}{
+	conf:   LoggingConfig{Format: "text", Level: "info", Subsystems: map[string]string{}},
+	level:  LOG_INFO,
+	levels: map[string]LogLevel{},
+}
+
+// serializes writes of JSON records (text goes through the log package)
+var logWriteMutex sync.Mutex
+
+// where JSON records go, and the log package flags to restore when
+// switching back to text
+var logOutput io.Writer = os.Stderr
+var logTextFlags int
+
+// SetLogging validates and applies new log settings
+func SetLogging(conf LoggingConfig) error {
+	if conf.Subsystems == nil {
+		conf.Subsystems = map[string]string{}
+	}
+	if err := conf.check(); err != nil {
+		return err
+	}
+
+	level, _ := ParseLogLevel(conf.Level)
+	levels := map[string]LogLevel{}
+	subsystems := map[string]string{}
+	for subsystem, name := range conf.Subsystems {
+		levels[subsystem], _ = ParseLogLevel(name)
+		subsystems[subsystem] = strings.ToLower(name)
+	}
+	conf.Level = strings.ToLower(conf.Level)
+	conf.Subsystems = subsystems
+
+	logging.Lock()
+	defer logging.Unlock()
+	asJSON := conf.Format == "json"
+	logWriteMutex.Lock()
+	defer logWriteMutex.Unlock()
+	if asJSON && !logging.json {
+		logOutput = log.Writer()
+		logTextFlags = log.Flags()
+		log.SetFlags(0)
+		log.SetOutput(plainLogWriter{})
+	} else if !asJSON && logging.json {
+		log.SetOutput(logOutput)
+		log.SetFlags(logTextFlags)
+	}
+
+	logging.conf = conf
+	logging.json = asJSON
+	logging.level = level
+	logging.levels = levels
+	return nil
+}
+
+// GetLogging returns a copy of the log settings currently in effect
+func GetLogging() LoggingConfig {
+	logging.RLock()
+	defer logging.RUnlock()
+
+	conf := logging.conf
+	conf.Subsystems = map[string]string{}
+	for subsystem, level := range logging.conf.Subsystems {
+		conf.Subsystems[subsystem] = level
+	}
+	return conf
+}
+
+// Logger writes records for one subsystem, tagged with some fields
+type Logger struct {
+	subsystem string
+	fields    []logField
+}
+
+type logField struct {
+	key string
+	val any
+}
+
+func NewLogger(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// With returns a logger that also attaches the given key/value
+// pairs (e.g., With("lambda", name, "sandbox", id)) to each record
+func (l *Logger) With(keyvals ...any) *Logger {
+	if len(keyvals)%2 != 0 {
+		panic("Logger.With expects key/value pairs")
+	}
+
+	fields := make([]logField, len(l.fields), len(l.fields)+len(keyvals)/2)
+	copy(fields, l.fields)
+	for i := 0; i < len(keyvals); i += 2 {
+		fields = append(fields, logField{fmt.Sprintf("%v", keyvals[i]), keyvals[i+1]})
+	}
+	return &Logger{subsystem: l.subsystem, fields: fields}
+}
+
+// Enabled tells whether records at the given level will be written,
+// so callers can skip building expensive messages
+func (l *Logger) Enabled(level LogLevel) bool {
+	logging.RLock()
+	defer logging.RUnlock()
+
+	min, ok := logging.levels[l.subsystem]
+	if !ok {
+		min = logging.level
+	}
+	return level >= min
+}
+
+func (l *Logger) Debugf(format string, args ...any) {
+	l.logf(LOG_DEBUG, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...any) {
+	l.logf(LOG_INFO, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...any) {
+	l.logf(LOG_WARN, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...any) {
+	l.logf(LOG_ERROR, format, args...)
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+
+	logging.RLock()
+	asJSON := logging.json
+	logging.RUnlock()
+
+	if !asJSON {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%-5s [%s] %s", strings.ToUpper(level.String()), l.subsystem, msg)
+		for _, field := range l.fields {
+			fmt.Fprintf(&sb, " %s=%s", field.key, formatLogValue(field.val))
+		}
+		log.Print(sb.String())
+		return
+	}
+
+	record := map[string]any{}
+	for _, field := range l.fields {
+		record[field.key] = field.val
+	}
+	record["time"] = time.Now().Format(time.RFC3339Nano)
+	record["level"] = level.String()
+	record["subsystem"] = l.subsystem
+	record["msg"] = msg
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		// a field couldn't be encoded; keep the message anyway
+		b, _ = json.Marshal(map[string]any{
+			"time":      record["time"],
+			"level":     record["level"],
+			"subsystem": l.subsystem,
+			"msg":       msg,
+			"log_error": err.Error(),
+		})
+	}
+
+	logWriteMutex.Lock()
+	defer logWriteMutex.Unlock()
+	logOutput.Write(append(b, '\n'))
+}
+
+// quote values containing spaces, quotes or '=' so key=val pairs
+// can be split unambiguously
+func formatLogValue(val any) string {
+	s := fmt.Sprintf("%v", val)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// fold the older trace flags into the per-subsystem levels, so
+// existing configs that set them keep getting the same output
+func applyTraceFlags(conf *LoggingConfig, trace TraceConfig) {
+	if conf.Subsystems == nil {
+		conf.Subsystems = map[string]string{}
+	}
+
+	flags := map[string]bool{
+		"cgroup":   trace.Cgroups,
+		"mempool":  trace.Memory,
+		"evictor":  trace.Evictor,
+		"packages": trace.Package,
+	}
+
+	for name, on := range flags {
+		if _, ok := conf.Subsystems[name]; !ok && on {
+			conf.Subsystems[name] = "debug"
+		}
+	}
+}
+
+// plainLogWriter wraps lines written through the log package by code
+// that doesn't use a Logger (while the json format is on), so every
+// line of output is still a JSON record
+type plainLogWriter struct{}
+
+func (plainLogWriter) Write(p []byte) (int, error) {
+	b, err := json.Marshal(map[string]any{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": LOG_INFO.String(),
+		"msg":   strings.TrimRight(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	logWriteMutex.Lock()
+	defer logWriteMutex.Unlock()
+	if _, err := logOutput.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
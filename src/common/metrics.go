@@ -0,0 +1,306 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// process-global metrics, exported in the Prometheus text format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/)
+//
+// Unlike the stats above (which aggregate latencies by name), metrics
+// are labelled (e.g., by lambda name) so they can be broken down on a
+// dashboard.  Families are declared once (usually as package-level
+// vars), then updated through the series returned by With.
+
+// latency buckets (in seconds) used unless a histogram asks for others
+var DefaultLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string // counter, gauge, or histogram
+	labelNames []string
+	buckets    []float64
+
+	mutex  sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+
+	// counters and gauges
+	value float64
+
+	// histograms (bucketCounts are not cumulative)
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+var metricsMutex sync.Mutex
+var metricFamilies []*metricFamily
+
+func newMetricFamily(name, help, kind string, buckets []float64, labelNames []string) *metricFamily {
+	family := &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*metricSeries),
+	}
+
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	for _, other := range metricFamilies {
+		if other.name == name {
+			panic(fmt.Sprintf("metric %s registered twice", name))
+		}
+	}
+	metricFamilies = append(metricFamilies, family)
+	return family
+}
+
+// lookup (or create) the series for some label values; caller must
+// hold the family mutex
+func (family *metricFamily) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(family.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d",
+			family.name, len(family.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s := family.series[key]
+	if s == nil {
+		s = &metricSeries{labelValues: labelValues}
+		if family.kind == "histogram" {
+			s.bucketCounts = make([]uint64, len(family.buckets))
+		}
+		family.series[key] = s
+	}
+	return s
+}
+
+// remove the series for some label values (e.g., when the thing it
+// describes goes away)
+func (family *metricFamily) delete(labelValues []string) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	delete(family.series, strings.Join(labelValues, "\xff"))
+}
+
+// remove every series that has labelValue for the label labelName
+func (family *metricFamily) deleteMatching(labelName string, labelValue string) {
+	pos := -1
+	for i, name := range family.labelNames {
+		if name == labelName {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return
+	}
+
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	for key, s := range family.series {
+		if s.labelValues[pos] == labelValue {
+			delete(family.series, key)
+		}
+	}
+}
+
+// DeleteMetrics removes the series of every metric that has
+// labelValue for the label labelName (e.g., all those of a lambda
+// that was unloaded)
+func DeleteMetrics(labelName string, labelValue string) {
+	metricsMutex.Lock()
+	families := append([]*metricFamily{}, metricFamilies...)
+	metricsMutex.Unlock()
+
+	for _, family := range families {
+		family.deleteMatching(labelName, labelValue)
+	}
+}
+
+// CounterVec is a family of counters (values that only go up)
+type CounterVec struct{ family *metricFamily }
+
+type Counter struct {
+	family      *metricFamily
+	labelValues []string
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newMetricFamily(name, help, "counter", nil, labelNames)}
+}
+
+func (vec *CounterVec) With(labelValues ...string) Counter {
+	return Counter{vec.family, labelValues}
+}
+
+func (vec *CounterVec) Delete(labelValues ...string) {
+	vec.family.delete(labelValues)
+}
+
+func (c Counter) Add(x float64) {
+	if x < 0 {
+		panic("counters cannot decrease")
+	}
+	c.family.mutex.Lock()
+	defer c.family.mutex.Unlock()
+	c.family.get(c.labelValues).value += x
+}
+
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// GaugeVec is a family of gauges (values that go up and down)
+type GaugeVec struct{ family *metricFamily }
+
+type Gauge struct {
+	family      *metricFamily
+	labelValues []string
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newMetricFamily(name, help, "gauge", nil, labelNames)}
+}
+
+func (vec *GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{vec.family, labelValues}
+}
+
+func (vec *GaugeVec) Delete(labelValues ...string) {
+	vec.family.delete(labelValues)
+}
+
+func (g Gauge) Set(x float64) {
+	g.family.mutex.Lock()
+	defer g.family.mutex.Unlock()
+	g.family.get(g.labelValues).value = x
+}
+
+func (g Gauge) Add(x float64) {
+	g.family.mutex.Lock()
+	defer g.family.mutex.Unlock()
+	g.family.get(g.labelValues).value += x
+}
+
+// HistogramVec is a family of histograms with fixed buckets
+type HistogramVec struct{ family *metricFamily }
+
+type Histogram struct {
+	family      *metricFamily
+	labelValues []string
+}
+
+// buckets are upper bounds, in increasing order (nil means DefaultLatencyBuckets)
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	return &HistogramVec{newMetricFamily(name, help, "histogram", buckets, labelNames)}
+}
+
+func (vec *HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{vec.family, labelValues}
+}
+
+func (vec *HistogramVec) Delete(labelValues ...string) {
+	vec.family.delete(labelValues)
+}
+
+func (h Histogram) Observe(x float64) {
+	h.family.mutex.Lock()
+	defer h.family.mutex.Unlock()
+	s := h.family.get(h.labelValues)
+	idx := sort.SearchFloat64s(h.family.buckets, x)
+	if idx < len(s.bucketCounts) {
+		s.bucketCounts[idx] += 1
+	}
+	s.sum += x
+	s.count += 1
+}
+
+func escapeLabelValue(val string) string {
+	val = strings.ReplaceAll(val, `\`, `\\`)
+	val = strings.ReplaceAll(val, "\n", `\n`)
+	return strings.ReplaceAll(val, `"`, `\"`)
+}
+
+func formatFloat(x float64) string {
+	if math.IsInf(x, +1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", x)
+}
+
+// render labels, plus an optional extra one (e.g., le for buckets)
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	parts := []string{}
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (family *metricFamily) write(w io.Writer) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+
+	keys := make([]string, 0, len(family.series))
+	for key := range family.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := family.series[key]
+		if family.kind != "histogram" {
+			labels := formatLabels(family.labelNames, s.labelValues, "", "")
+			fmt.Fprintf(w, "%s%s %s\n", family.name, labels, formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range family.buckets {
+			cumulative += s.bucketCounts[i]
+			labels := formatLabels(family.labelNames, s.labelValues, "le", formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, labels, cumulative)
+		}
+		labels := formatLabels(family.labelNames, s.labelValues, "le", "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, labels, s.count)
+		labels = formatLabels(family.labelNames, s.labelValues, "", "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", family.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", family.name, labels, s.count)
+	}
+}
+
+// WriteMetrics writes every registered metric to w, in the Prometheus
+// text exposition format
+func WriteMetrics(w io.Writer) {
+	metricsMutex.Lock()
+	families := append([]*metricFamily{}, metricFamilies...)
+	metricsMutex.Unlock()
+
+	for _, family := range families {
+		family.write(w)
+	}
+}
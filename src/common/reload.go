@@ -0,0 +1,215 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// reloading the config of a running worker
+//
+// Most of the worker reads Conf whenever it needs a setting, so some
+// settings can be changed just by swapping in a new Conf (each read
+// sees either the old config or the new one).  Others are only read
+// at startup (ports, directories, the sandbox type, etc), so changing
+// them requires a restart; reloads that change them are rejected.
+
+// settings (JSON paths) that may change without a restart.  A path
+// covers everything beneath it.
+var HOT_RELOAD_SETTINGS = []string{
+	"log_output",
+	"registry_cache_ms",
+	"mem_pool_mb",
+	"limits",
+	"features.timing_headers",
+	"features.downsize_paused_mem",
+	"features.enable_seccomp",
+	"trace",
+	"logging",
+	"auth",
+	"scheduler.schedules",
+	"scaling",
+}
+
+// exceptions to HOT_RELOAD_SETTINGS, which are only read at startup
+var RESTART_SETTINGS = []string{
+	"limits.async_concurrency",
+}
+
+// settings whose values shouldn't be shown when describing changes
+var SECRET_SETTINGS = []string{
+	"auth.keys",
+}
+
+// only one reload at a time
+var reloadMutex sync.Mutex
+
+// ReloadConf reads the config at path, and if it is valid and only
+// changes settings that can be changed without a restart, makes it
+// the current config.  It returns the previous config, and the
+// changes (one "setting: old -> new" per changed setting).  If any
+// setting that requires a restart was changed, nothing is applied,
+// and the error lists those changes.
+func ReloadConf(path string) (old *Config, changes []string, err error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	configRaw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open config (%v): %v", path, err.Error())
+	}
+
+	newConf := &Config{}
+	if err := json.Unmarshal(configRaw, newConf); err != nil {
+		return nil, nil, fmt.Errorf("could not parse config (%v): %v", path, err.Error())
+	}
+
+	if err := newConf.check(); err != nil {
+		return nil, nil, fmt.Errorf("invalid config (%v): %v", path, err)
+	}
+
+	old = Conf
+	diffs, err := diffConf(old, newConf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	restart := []string{}
+	for _, diff := range diffs {
+		if !isHotReloadable(diff.setting) {
+			restart = append(restart, diff.String())
+		}
+		changes = append(changes, diff.String())
+	}
+	if len(restart) > 0 {
+		return nil, nil, fmt.Errorf("these changes require a restart (so nothing was reloaded):\n  %s", strings.Join(restart, "\n  "))
+	}
+
+	// only re-apply logging if its settings changed in the file,
+	// so adjustments made at runtime (via /admin/logging) stick
+	loggingChanged := false
+	for _, diff := range diffs {
+		if matchesSetting(diff.setting, "logging") || matchesSetting(diff.setting, "trace") {
+			loggingChanged = true
+		}
+	}
+	if loggingChanged {
+		if err := newConf.applyLogging(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	Conf = newConf
+	return old, changes, nil
+}
+
+type confDiff struct {
+	setting string
+	old     string
+	new     string
+}
+
+func (diff confDiff) String() string {
+	for _, secret := range SECRET_SETTINGS {
+		if matchesSetting(diff.setting, secret) {
+			return diff.setting + ": (changed)"
+		}
+	}
+	return fmt.Sprintf("%s: %s -> %s", diff.setting, diff.old, diff.new)
+}
+
+// does setting equal pattern, or fall beneath it?
+func matchesSetting(setting string, pattern string) bool {
+	return setting == pattern || strings.HasPrefix(setting, pattern+".")
+}
+
+func isHotReloadable(setting string) bool {
+	for _, pattern := range RESTART_SETTINGS {
+		if matchesSetting(setting, pattern) {
+			return false
+		}
+	}
+	for _, pattern := range HOT_RELOAD_SETTINGS {
+		if matchesSetting(setting, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffConf compares the JSON encodings of two configs, setting by
+// setting (nested objects are compared key by key; anything else,
+// such as a list, as a whole)
+func diffConf(a *Config, b *Config) ([]confDiff, error) {
+	flatA, err := flattenConf(a)
+	if err != nil {
+		return nil, err
+	}
+	flatB, err := flattenConf(b)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]bool{}
+	for setting := range flatA {
+		settings[setting] = true
+	}
+	for setting := range flatB {
+		settings[setting] = true
+	}
+
+	diffs := []confDiff{}
+	for setting := range settings {
+		valA, okA := flatA[setting]
+		valB, okB := flatB[setting]
+		if !okA {
+			valA = "(none)"
+		}
+		if !okB {
+			valB = "(none)"
+		}
+		if valA != valB {
+			diffs = append(diffs, confDiff{setting, valA, valB})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].setting < diffs[j].setting
+	})
+	return diffs, nil
+}
+
+func flattenConf(conf *Config) (map[string]string, error) {
+	b, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree map[string]any
+	if err := json.Unmarshal(b, &tree); err != nil {
+		return nil, err
+	}
+
+	flat := map[string]string{}
+	var flatten func(prefix string, val any)
+	flatten = func(prefix string, val any) {
+		if obj, ok := val.(map[string]any); ok && len(obj) > 0 {
+			for key, sub := range obj {
+				if prefix == "" {
+					flatten(key, sub)
+				} else {
+					flatten(prefix+"."+key, sub)
+				}
+			}
+			return
+		}
+
+		b, _ := json.Marshal(val)
+		flat[prefix] = string(b)
+	}
+	flatten("", tree)
+	return flat, nil
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"fmt"
+)
+
+// autoscaling policies (see worker/lambda/scaling.go)
+const (
+	// one instance per Work_ms of outstanding work (the original
+	// policy, and the default)
+	SCALING_WORK = "work"
+
+	// one instance per Target_concurrency outstanding invocations
+	SCALING_CONCURRENCY = "concurrency"
+
+	// enough instances for the recent arrival rate at the recent
+	// execution time (Little's law), or for what is outstanding
+	// now, whichever is more
+	SCALING_PREDICTIVE = "predictive"
+)
+
+var SCALING_POLICIES = []string{SCALING_WORK, SCALING_CONCURRENCY, SCALING_PREDICTIVE}
+
+// ScalingConfig controls how many instances each lambda has.  It is
+// the "scaling" section of the worker config, and a lambda's ol.yaml
+// may have its own, whose fields (those that are set) take precedence.
+// The bounds on instances are min_instances and max_instances (see
+// LimitsConfig).
+type ScalingConfig struct {
+	// one of SCALING_POLICIES
+	Policy string `json:"policy" yaml:"policy"`
+
+	// invocations per instance to aim for (concurrency and
+	// predictive policies)
+	Target_concurrency int `json:"target_concurrency" yaml:"target_concurrency"`
+
+	// milliseconds of outstanding work per instance to aim for
+	// (work policy)
+	Work_ms int `json:"work_ms" yaml:"work_ms"`
+
+	// start or stop at most this many instances at a time, and
+	// at most once per Interval_ms
+	Step        int `json:"step" yaml:"step"`
+	Interval_ms int `json:"interval_ms" yaml:"interval_ms"`
+
+	// only stop instances once the policy has wanted fewer for
+	// this long (so brief lulls don't cause cold starts)
+	Scale_down_delay_ms int `json:"scale_down_delay_ms" yaml:"scale_down_delay_ms"`
+}
+
+// Check validates the settings (zero values are allowed, and mean
+// the default, or for a lambda, the worker's setting)
+func (conf *ScalingConfig) Check() error {
+	if conf.Policy != "" {
+		known := false
+		for _, policy := range SCALING_POLICIES {
+			known = known || conf.Policy == policy
+		}
+		if !known {
+			return fmt.Errorf("unknown scaling policy '%s' (expected one of %v)", conf.Policy, SCALING_POLICIES)
+		}
+	}
+
+	if conf.Target_concurrency < 0 || conf.Work_ms < 0 || conf.Step < 0 ||
+		conf.Interval_ms < 0 || conf.Scale_down_delay_ms < 0 {
+		return fmt.Errorf("scaling settings may not be negative")
+	}
+
+	return nil
+}
+
+// fillDefaults sets any unset fields to their defaults (which keep
+// the behavior of workers from before the policy was configurable)
+func (conf *ScalingConfig) fillDefaults() {
+	if conf.Policy == "" {
+		conf.Policy = SCALING_WORK
+	}
+	if conf.Target_concurrency == 0 {
+		conf.Target_concurrency = 1
+	}
+	if conf.Work_ms == 0 {
+		conf.Work_ms = 10
+	}
+	if conf.Step == 0 {
+		conf.Step = 1
+	}
+	if conf.Interval_ms == 0 {
+		conf.Interval_ms = 100
+	}
+}
+
+// Override returns a copy of conf, with the fields that are set in
+// other replacing its own
+func (conf ScalingConfig) Override(other ScalingConfig) ScalingConfig {
+	if other.Policy != "" {
+		conf.Policy = other.Policy
+	}
+	if other.Target_concurrency != 0 {
+		conf.Target_concurrency = other.Target_concurrency
+	}
+	if other.Work_ms != 0 {
+		conf.Work_ms = other.Work_ms
+	}
+	if other.Step != 0 {
+		conf.Step = other.Step
+	}
+	if other.Interval_ms != 0 {
+		conf.Interval_ms = other.Interval_ms
+	}
+	if other.Scale_down_delay_ms != 0 {
+		conf.Scale_down_delay_ms = other.Scale_down_delay_ms
+	}
+	return conf
+}
@@ -0,0 +1,653 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduled (cron) invocations
+//
+// A Scheduler invokes lambdas at the times given by cron expressions.
+// Schedules come from the server's config, from the lambdas' own
+// configs, or from the admin API.  The scheduled time of each run is
+// saved (to SchedulerConfig.State_path) before the lambda is invoked,
+// so a restarted server neither repeats a run nor forgets the outcome
+// of the last one.  Runs that were due while the server was down are
+// skipped, as are runs that come due while the previous run of the
+// same schedule is still going.
+
+const (
+	SCHEDULE_SOURCE_CONFIG = "config"
+	SCHEDULE_SOURCE_LAMBDA = "lambda"
+	SCHEDULE_SOURCE_API    = "api"
+
+	// scheduled invocations carry this header (with the schedule's ID)
+	SCHEDULE_HEADER = "X-OL-Schedule"
+
+	// how much of a failed run's response to keep
+	SCHEDULE_MAX_ERROR_BYTES = 512
+)
+
+var ErrScheduleNotFound = errors.New("no schedule with that ID")
+
+var scheduleIDRegex = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+var schedulerLog = NewLogger("scheduler")
+
+type SchedulerConfig struct {
+	// file where the last run of each schedule is saved (along
+	// with schedules added by lambdas or the admin API).  Empty
+	// means nothing is saved, so a restart forgets them.
+	State_path string `json:"state_path"`
+
+	Schedules []ScheduleSpec `json:"schedules"`
+}
+
+func (conf *SchedulerConfig) Check() error {
+	if conf.State_path != "" && !filepath.IsAbs(conf.State_path) {
+		return fmt.Errorf("scheduler.state_path cannot be relative")
+	}
+
+	ids := map[string]bool{}
+	for _, spec := range conf.Schedules {
+		if err := spec.Check(); err != nil {
+			return fmt.Errorf("scheduler.schedules: %v", err)
+		} else if ids[spec.ID] {
+			return fmt.Errorf("scheduler.schedules: ID '%s' is used more than once", spec.ID)
+		}
+		ids[spec.ID] = true
+	}
+
+	return nil
+}
+
+// ScheduleSpec says when to invoke a lambda
+type ScheduleSpec struct {
+	ID     string `json:"id"`
+	Lambda string `json:"lambda"`
+	Cron   string `json:"cron"`
+
+	// passed to the lambda as the "detail" of the event
+	Event any `json:"event,omitempty"`
+
+	// SCHEDULE_SOURCE_CONFIG, SCHEDULE_SOURCE_LAMBDA or
+	// SCHEDULE_SOURCE_API (set by the Scheduler)
+	Source string `json:"source,omitempty"`
+}
+
+func (spec *ScheduleSpec) Check() error {
+	if !scheduleIDRegex.MatchString(spec.ID) {
+		return fmt.Errorf("bad schedule ID '%s' (may only contain letters, digits, '_', '.', ':' and '-')", spec.ID)
+	}
+	if spec.Lambda == "" {
+		return fmt.Errorf("schedule '%s' does not name a lambda", spec.ID)
+	}
+	if _, err := ParseCron(spec.Cron); err != nil {
+		return fmt.Errorf("schedule '%s': %v", spec.ID, err)
+	}
+	if _, err := json.Marshal(spec.Event); err != nil {
+		return fmt.Errorf("schedule '%s': event cannot be encoded as JSON: %v", spec.ID, err)
+	}
+	return nil
+}
+
+// ScheduleRuns records how a schedule's runs went
+type ScheduleRuns struct {
+	// scheduled time of the latest run, and when it actually
+	// started and finished (zero if still running)
+	LastScheduled *time.Time `json:"last_scheduled,omitempty"`
+	LastStarted   *time.Time `json:"last_started,omitempty"`
+	LastFinished  *time.Time `json:"last_finished,omitempty"`
+
+	// response status of the latest finished run, and the start
+	// of its response body if it failed (status >= 400)
+	LastStatus int    `json:"last_status,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+
+	Runs     int64 `json:"runs"`
+	Failures int64 `json:"failures"`
+
+	// runs not started because the previous one was still going
+	Skipped int64 `json:"skipped"`
+}
+
+// ScheduleStatus describes a schedule, for the admin API
+type ScheduleStatus struct {
+	ScheduleSpec
+	ScheduleRuns
+	Next    *time.Time `json:"next,omitempty"`
+	Running bool       `json:"running"`
+}
+
+// ScheduleInvokeFunc runs a lambda, writing its response to w.  r is
+// a POST to /run/<lambda> carrying the scheduled event.
+type ScheduleInvokeFunc func(lambda string, w http.ResponseWriter, r *http.Request)
+
+type schedule struct {
+	spec    ScheduleSpec
+	cron    *CronSchedule
+	runs    ScheduleRuns
+	next    time.Time
+	running bool
+}
+
+type Scheduler struct {
+	invoke    ScheduleInvokeFunc
+	statePath string
+
+	// protects schedules (by ID) and the state file
+	mutex     sync.Mutex
+	schedules map[string]*schedule
+
+	// wake makes the task recompute when the next run is due;
+	// closing stop (once, via stopOnce) makes it exit (closing done)
+	wake     chan bool
+	stop     chan bool
+	stopOnce sync.Once
+	done     chan bool
+}
+
+// on-disk format of SchedulerConfig.State_path
+type scheduleRecord struct {
+	Spec ScheduleSpec `json:"spec"`
+	Runs ScheduleRuns `json:"runs"`
+}
+
+// NewScheduler starts running the schedules in conf (plus those saved
+// in conf.State_path by a previous run), calling invoke for each run
+func NewScheduler(conf *SchedulerConfig, invoke ScheduleInvokeFunc) (*Scheduler, error) {
+	sched := &Scheduler{
+		invoke:    invoke,
+		statePath: conf.State_path,
+		schedules: map[string]*schedule{},
+		wake:      make(chan bool, 1),
+		stop:      make(chan bool),
+		done:      make(chan bool),
+	}
+
+	if err := sched.load(); err != nil {
+		return nil, err
+	}
+	if err := sched.SetConfigSchedules(conf.Schedules); err != nil {
+		return nil, err
+	}
+
+	go sched.task()
+	return sched, nil
+}
+
+// load schedules and their runs saved by a previous process
+func (sched *Scheduler) load() error {
+	if sched.statePath == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(sched.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var records []scheduleRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("could not parse %s: %v", sched.statePath, err)
+	}
+
+	now := time.Now()
+	for _, record := range records {
+		cron, err := ParseCron(record.Spec.Cron)
+		if err != nil {
+			schedulerLog.With("schedule", record.Spec.ID).Warnf("dropping saved schedule: %v", err)
+			continue
+		}
+		sched.schedules[record.Spec.ID] = &schedule{
+			spec: record.Spec,
+			cron: cron,
+			runs: record.Runs,
+			next: cron.Next(now),
+		}
+	}
+
+	schedulerLog.Infof("loaded %d schedules from %s", len(sched.schedules), sched.statePath)
+	return nil
+}
+
+// save schedules and their runs.  Caller must hold mutex.
+func (sched *Scheduler) save() {
+	if sched.statePath == "" {
+		return
+	}
+
+	records := []scheduleRecord{}
+	for _, s := range sched.schedules {
+		records = append(records, scheduleRecord{s.spec, s.runs})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Spec.ID < records[j].Spec.ID
+	})
+
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err == nil {
+		// write to a temp file first, so a crash never leaves
+		// a partial file
+		tmp := sched.statePath + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, sched.statePath)
+		}
+	}
+	if err != nil {
+		schedulerLog.Errorf("could not save schedules to %s: %v", sched.statePath, err)
+	}
+}
+
+// put adds or replaces a schedule (keeping the record of its runs, if
+// it already existed).  Caller must hold mutex, and save after.
+func (sched *Scheduler) put(spec ScheduleSpec) error {
+	if err := spec.Check(); err != nil {
+		return err
+	}
+	cron, _ := ParseCron(spec.Cron)
+
+	s := sched.schedules[spec.ID]
+	if s == nil {
+		s = &schedule{}
+		sched.schedules[spec.ID] = s
+	}
+	s.spec = spec
+	s.cron = cron
+	s.next = cron.Next(time.Now())
+	return nil
+}
+
+// replace all schedules from source (and, if lambda isn't empty, for
+// that lambda) with specs
+func (sched *Scheduler) replace(source string, lambda string, specs []ScheduleSpec) error {
+	for i := range specs {
+		specs[i].Source = source
+		if err := specs[i].Check(); err != nil {
+			return err
+		}
+	}
+
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	keep := map[string]bool{}
+	for _, spec := range specs {
+		if s := sched.schedules[spec.ID]; s != nil && s.spec.Source != source {
+			return fmt.Errorf("schedule ID '%s' is already used by a schedule from %s", spec.ID, s.spec.Source)
+		}
+		keep[spec.ID] = true
+	}
+
+	for id, s := range sched.schedules {
+		if s.spec.Source == source && (lambda == "" || s.spec.Lambda == lambda) && !keep[id] {
+			delete(sched.schedules, id)
+			schedulerLog.With("schedule", id).Infof("removed schedule (no longer in %s)", source)
+		}
+	}
+	for _, spec := range specs {
+		sched.put(spec)
+	}
+
+	sched.save()
+	sched.poke()
+	return nil
+}
+
+// SetConfigSchedules replaces the schedules that came from the
+// server's config
+func (sched *Scheduler) SetConfigSchedules(specs []ScheduleSpec) error {
+	return sched.replace(SCHEDULE_SOURCE_CONFIG, "", append([]ScheduleSpec{}, specs...))
+}
+
+// SetLambdaSchedules replaces the schedules that came from the named
+// lambda's own config.  Their IDs are prefixed with "<lambda>:".
+func (sched *Scheduler) SetLambdaSchedules(lambda string, specs []ScheduleSpec) error {
+	prefixed := []ScheduleSpec{}
+	for _, spec := range specs {
+		spec.ID = lambda + ":" + spec.ID
+		spec.Lambda = lambda
+		prefixed = append(prefixed, spec)
+	}
+	return sched.replace(SCHEDULE_SOURCE_LAMBDA, lambda, prefixed)
+}
+
+// Put adds or replaces a schedule (via the admin API)
+func (sched *Scheduler) Put(spec ScheduleSpec) error {
+	spec.Source = SCHEDULE_SOURCE_API
+
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	if s := sched.schedules[spec.ID]; s != nil && s.spec.Source != SCHEDULE_SOURCE_API {
+		return fmt.Errorf("schedule '%s' comes from %s, so it can only be changed there", spec.ID, s.spec.Source)
+	}
+	if err := sched.put(spec); err != nil {
+		return err
+	}
+
+	sched.save()
+	sched.poke()
+	schedulerLog.With("schedule", spec.ID, "lambda", spec.Lambda).Infof("scheduled for '%s'", spec.Cron)
+	return nil
+}
+
+// Remove deletes a schedule added with Put, or one from a lambda's
+// config (e.g., after the lambda is deleted from the registry; it
+// comes back if the lambda is pulled again with that schedule)
+func (sched *Scheduler) Remove(id string) error {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	s := sched.schedules[id]
+	if s == nil {
+		return ErrScheduleNotFound
+	} else if s.spec.Source == SCHEDULE_SOURCE_CONFIG {
+		return fmt.Errorf("schedule '%s' comes from %s, so it can only be removed there", id, s.spec.Source)
+	}
+	delete(sched.schedules, id)
+
+	sched.save()
+	sched.poke()
+	schedulerLog.With("schedule", id).Infof("removed schedule")
+	return nil
+}
+
+func (s *schedule) status() ScheduleStatus {
+	status := ScheduleStatus{
+		ScheduleSpec: s.spec,
+		ScheduleRuns: s.runs,
+		Running:      s.running,
+	}
+	if !s.next.IsZero() {
+		next := s.next
+		status.Next = &next
+	}
+	return status
+}
+
+// Schedules lists every schedule, sorted by ID
+func (sched *Scheduler) Schedules() []ScheduleStatus {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	result := []ScheduleStatus{}
+	for _, s := range sched.schedules {
+		result = append(result, s.status())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Schedule describes one schedule
+func (sched *Scheduler) Schedule(id string) (ScheduleStatus, error) {
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	s := sched.schedules[id]
+	if s == nil {
+		return ScheduleStatus{}, ErrScheduleNotFound
+	}
+	return s.status(), nil
+}
+
+// make the task look at the schedules again.  Never blocks.
+func (sched *Scheduler) poke() {
+	select {
+	case sched.wake <- true:
+	default:
+	}
+}
+
+// task sleeps until the next run is due, then starts every run that
+// is due
+func (sched *Scheduler) task() {
+	defer close(sched.done)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		sched.mutex.Lock()
+		now := time.Now()
+		next := now.Add(time.Hour)
+		for _, s := range sched.schedules {
+			if !s.next.IsZero() && !s.next.After(now) {
+				sched.start(s, now)
+			}
+			if !s.next.IsZero() && s.next.Before(next) {
+				next = s.next
+			}
+		}
+		sched.mutex.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+
+		select {
+		case <-timer.C:
+		case <-sched.wake:
+		case <-sched.stop:
+			return
+		}
+	}
+}
+
+// start a run of s that was due at s.next.  Caller must hold mutex.
+func (sched *Scheduler) start(s *schedule, now time.Time) {
+	slot := s.next
+	s.next = s.cron.Next(now)
+	logger := schedulerLog.With("schedule", s.spec.ID, "lambda", s.spec.Lambda)
+
+	// the clock went backwards, or another process shares the
+	// state file
+	if s.runs.LastScheduled != nil && !slot.After(*s.runs.LastScheduled) {
+		logger.Warnf("not repeating run scheduled for %v", slot)
+		return
+	}
+
+	if s.running {
+		logger.Warnf("skipping run scheduled for %v (previous run still going)", slot)
+		s.runs.Skipped++
+		return
+	}
+
+	// save before invoking, so a restart doesn't repeat the run
+	s.running = true
+	s.runs.LastScheduled = &slot
+	s.runs.LastStarted = &now
+	s.runs.LastFinished = nil
+	sched.save()
+
+	go sched.run(s, s.spec, slot)
+}
+
+func (sched *Scheduler) run(s *schedule, spec ScheduleSpec, slot time.Time) {
+	logger := schedulerLog.With("schedule", spec.ID, "lambda", spec.Lambda)
+
+	span := StartRequestSpan("scheduled-invocation", http.Header{})
+	span.SetAttr("lambda", spec.Lambda)
+	span.SetAttr("schedule", spec.ID)
+	unbind := span.Bind()
+	defer func() {
+		unbind()
+		span.End()
+	}()
+
+	event := map[string]any{
+		"source":   "ol.scheduler",
+		"schedule": spec.ID,
+		"time":     slot.Format(time.RFC3339),
+	}
+	if spec.Event != nil {
+		event["detail"] = spec.Event
+	}
+	body, _ := json.Marshal(event)
+
+	resp := &scheduledResponse{header: http.Header{}}
+	r, err := http.NewRequest("POST", "/run/"+spec.Lambda, bytes.NewReader(body))
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(err.Error()))
+	} else {
+		r.RequestURI = r.URL.Path
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(SCHEDULE_HEADER, spec.ID)
+		span.Inject(r.Header)
+		sched.invoke(spec.Lambda, resp, r)
+	}
+
+	status := resp.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttr("http.status_code", status)
+
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	now := time.Now()
+	s.running = false
+	s.runs.LastFinished = &now
+	s.runs.LastStatus = status
+	s.runs.LastError = ""
+	s.runs.Runs++
+	if status >= 400 {
+		s.runs.Failures++
+		s.runs.LastError = strings.TrimSpace(resp.body.String())
+		span.SetError(fmt.Sprintf("status %d", status))
+		logger.Warnf("run scheduled for %v failed with status %d: %s", slot, status, s.runs.LastError)
+	} else {
+		logger.Infof("run scheduled for %v returned status %d", slot, status)
+	}
+
+	// s may have been removed or replaced while running, in which
+	// case there is nothing to save
+	if sched.schedules[spec.ID] == s {
+		sched.save()
+	}
+}
+
+// Stop starts no more runs (runs in progress continue).  It may be
+// called more than once (e.g., by a shutdown request, then a signal).
+func (sched *Scheduler) Stop() {
+	sched.stopOnce.Do(func() {
+		close(sched.stop)
+	})
+	<-sched.done
+}
+
+// HandleHTTP serves the admin API for schedules:
+//
+// GET /schedules: list all schedules, with their last and next runs
+// GET /schedules/<id>: describe one schedule
+// PUT /schedules/<id>: add or replace a schedule, e.g., with a body of {"lambda": "report", "cron": "0 9 * * mon-fri"}
+// DELETE /schedules/<id>: remove a schedule
+//
+// Only schedules added with PUT can be replaced this way, and those
+// from the server's config can't be removed.
+func (sched *Scheduler) HandleHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schedules"), "/")
+
+	var result any
+	var err error
+	switch {
+	case id == "" && r.Method == "GET":
+		result = sched.Schedules()
+	case id == "":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	case r.Method == "GET":
+		result, err = sched.Schedule(id)
+	case r.Method == "PUT" || r.Method == "POST":
+		spec := ScheduleSpec{}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&spec); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("could not parse schedule: %v\n", err)))
+			return
+		}
+		if spec.ID != "" && spec.ID != id {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("schedule ID '%s' in body does not match '%s' in path\n", spec.ID, id)))
+			return
+		}
+		spec.ID = id
+		if err = sched.Put(spec); err == nil {
+			result, err = sched.Schedule(id)
+		}
+	case r.Method == "DELETE":
+		if err = sched.Remove(id); err == nil {
+			result = map[string]string{"removed": id}
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, ErrScheduleNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	b, err := json.MarshalIndent(result, "", "\t")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// captures the status of a scheduled run, and the start of its body
+type scheduledResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (resp *scheduledResponse) Header() http.Header {
+	return resp.header
+}
+
+func (resp *scheduledResponse) Write(b []byte) (int, error) {
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	if room := SCHEDULE_MAX_ERROR_BYTES - resp.body.Len(); room > 0 {
+		resp.body.Write(b[:Min(len(b), room)])
+	}
+	return len(b), nil
+}
+
+func (resp *scheduledResponse) WriteHeader(status int) {
+	if resp.status == 0 {
+		resp.status = status
+	}
+}
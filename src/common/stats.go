@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"math"
 	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -37,6 +39,68 @@ func (r *RollingAvg) Add(num int) {
 	r.Avg = r.sum / r.nums.Len()
 }
 
+// upper bounds (inclusive, in ms) of the latency histogram buckets.
+// Each bucket is ~10% wider than the one before, so percentiles are
+// accurate to within ~10% from 1 ms up to an hour (anything slower
+// lands in the last bucket, but max is tracked exactly).
+var latencyBucketsMs = makeLatencyBuckets()
+
+func makeLatencyBuckets() []int64 {
+	buckets := []int64{0}
+	for b := 1.0; b < 3600*1000; b *= 1.1 {
+		ms := int64(math.Ceil(b))
+		if ms > buckets[len(buckets)-1] {
+			buckets = append(buckets, ms)
+		}
+	}
+	return buckets
+}
+
+// LATENCY_PERCENTILES are reported for every timer in SnapshotStats,
+// as "<name>.ms-p<N>"
+var LATENCY_PERCENTILES = []int{50, 90, 99}
+
+type latencyHistogram struct {
+	counts []int64
+	total  int64
+	max    int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int64, len(latencyBucketsMs))}
+}
+
+func (h *latencyHistogram) add(ms int64) {
+	idx := sort.Search(len(latencyBucketsMs), func(i int) bool {
+		return latencyBucketsMs[i] >= ms
+	})
+	if idx == len(latencyBucketsMs) {
+		idx -= 1
+	}
+	h.counts[idx] += 1
+	h.total += 1
+	if ms > h.max {
+		h.max = ms
+	}
+}
+
+// percentile returns the upper bound of the bucket containing the
+// p-th percentile sample (but never more than the max seen)
+func (h *latencyHistogram) percentile(p int) int64 {
+	rank := int64(math.Ceil(float64(p) / 100 * float64(h.total)))
+	var seen int64
+	for i, cnt := range h.counts {
+		seen += cnt
+		if seen >= rank && seen > 0 {
+			if latencyBucketsMs[i] > h.max {
+				return h.max
+			}
+			return latencyBucketsMs[i]
+		}
+	}
+	return h.max
+}
+
 // process-global stats server
 
 type msLatencyMsg struct {
@@ -61,16 +125,25 @@ func initTaskOnce() {
 func statsTask() {
 	msCounts := make(map[string]int64)
 	msSums := make(map[string]int64)
+	msHists := make(map[string]*latencyHistogram)
 
 	for raw := range statsChan {
 		switch msg := raw.(type) {
 		case *msLatencyMsg:
 			msCounts[msg.name] += 1
 			msSums[msg.name] += msg.x
+			if msHists[msg.name] == nil {
+				msHists[msg.name] = newLatencyHistogram()
+			}
+			msHists[msg.name].add(msg.x)
 		case *snapshotMsg:
 			for k, cnt := range msCounts {
 				msg.stats[k+".cnt"] = cnt
 				msg.stats[k+".ms-avg"] = msSums[k] / cnt
+				for _, p := range LATENCY_PERCENTILES {
+					msg.stats[fmt.Sprintf("%s.ms-p%d", k, p)] = msHists[k].percentile(p)
+				}
+				msg.stats[k+".ms-max"] = msHists[k].max
 			}
 			msg.done <- true
 		default:
@@ -84,6 +157,11 @@ func record(name string, x int64) {
 	statsChan <- &msLatencyMsg{name, x}
 }
 
+// RecordMs records a latency that wasn't measured with T0/T1
+func RecordMs(name string, ms int64) {
+	record(name, ms)
+}
+
 func SnapshotStats() map[string]int64 {
 	initTaskOnce()
 	stats := make(map[string]int64)
@@ -97,14 +175,24 @@ type Latency struct {
 	name         string
 	t0           time.Time
 	Milliseconds int64
+
+	// if this goroutine is working for a traced request, the
+	// phase is also recorded as a span
+	span   *Span
+	unbind func()
 }
 
 // record start time
 func T0(name string) *Latency {
-	return &Latency{
+	l := &Latency{
 		name: name,
 		t0:   time.Now(),
 	}
+
+	if l.span = StartSpan(name, CurrentSpan(), SPAN_INTERNAL); l.span != nil {
+		l.unbind = l.span.Bind()
+	}
+	return l
 }
 
 // measure latency to end time, and record it
@@ -122,11 +210,22 @@ func (l *Latency) T1() {
 	}
 	l.t0 = zero
 
+	if l.span != nil {
+		l.unbind()
+		l.span.End()
+	}
+
 	if Conf.Trace.Latency {
 		log.Printf("%s=%d ms", l.name, l.Milliseconds)
 	}
 }
 
+// Span returns the span recording this phase (nil if the phase isn't
+// part of a traced request)
+func (l *Latency) Span() *Span {
+	return l.span
+}
+
 // start measuring a sub latency
 func (l *Latency) T0(name string) *Latency {
 	return T0(l.name + "/" + name)
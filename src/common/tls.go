@@ -0,0 +1,383 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS for the worker and boss listeners, and for the boss's
+// connections to workers.  Certificates and CAs are read from PEM
+// files, and re-read whenever the files change, so certs can be
+// rotated without a restart.
+
+// how often to check whether cert files have changed
+const TLS_RELOAD_CHECK_INTERVAL = time.Second
+
+// TLSConfig describes a TLS listener.  TLS is off unless a
+// certificate is given.
+type TLSConfig struct {
+	// PEM certificate (chain) and private key of this server
+	Cert_file string `json:"cert_file"`
+	Key_file  string `json:"key_file"`
+
+	// if set, clients must present a certificate signed by one of
+	// the CAs in this PEM file (mutual TLS)
+	Client_ca_file string `json:"client_ca_file"`
+
+	// client certificate and key (PEM) that admin commands on this
+	// host (e.g., ol worker status) present under mutual TLS.  If
+	// empty, cert_file and key_file are presented, so that
+	// certificate must then allow client authentication.
+	Admin_cert_file string `json:"admin_cert_file"`
+	Admin_key_file  string `json:"admin_key_file"`
+}
+
+// TLSClientConfig describes how to connect to a TLS server
+type TLSClientConfig struct {
+	// connect with https (rather than http)?
+	Enabled bool `json:"enabled"`
+
+	// CAs (PEM) that server certificates must be signed by; the
+	// system's CAs are used if empty
+	Ca_file string `json:"ca_file"`
+
+	// client certificate and key (PEM) to present, for servers
+	// that require mutual TLS
+	Cert_file string `json:"cert_file"`
+	Key_file  string `json:"key_file"`
+
+	// name to check server certificates against, if it differs
+	// from the host connected to (e.g., when dialing by IP)
+	Server_name string `json:"server_name"`
+}
+
+func (conf *TLSConfig) Enabled() bool {
+	return conf.Cert_file != ""
+}
+
+func (conf *TLSConfig) Check() error {
+	if (conf.Cert_file == "") != (conf.Key_file == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if conf.Client_ca_file != "" && conf.Cert_file == "" {
+		return fmt.Errorf("tls.client_ca_file requires tls.cert_file and tls.key_file")
+	}
+	if (conf.Admin_cert_file == "") != (conf.Admin_key_file == "") {
+		return fmt.Errorf("tls.admin_cert_file and tls.admin_key_file must be set together")
+	}
+	if conf.Admin_cert_file != "" && conf.Client_ca_file == "" {
+		return fmt.Errorf("tls.admin_cert_file is only used with tls.client_ca_file")
+	}
+
+	// otherwise admin commands would be turned away
+	if conf.Client_ca_file != "" {
+		certFile, keyFile := conf.adminCert()
+		if err := checkClientCert(certFile, keyFile, conf.Client_ca_file); err != nil {
+			return fmt.Errorf("admin commands could not connect under mutual TLS: %v", err)
+		}
+	}
+	return nil
+}
+
+// adminCert returns the files of the certificate that admin commands
+// present to a worker requiring client certificates
+func (conf *TLSConfig) adminCert() (certFile string, keyFile string) {
+	if conf.Admin_cert_file != "" {
+		return conf.Admin_cert_file, conf.Admin_key_file
+	}
+	return conf.Cert_file, conf.Key_file
+}
+
+// checkClientCert makes sure the certificate in certFile would be
+// accepted as a client certificate by a server trusting caFile
+func checkClientCert(certFile, keyFile, caFile string) error {
+	r, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+	cert, pool, _ := r.get()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, der := range cert.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			opts.Intermediates.AddCert(c)
+		}
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return fmt.Errorf("%s is not valid for client authentication (it needs the clientAuth extended key usage, and a CA in %s): %v", certFile, caFile, err)
+	}
+	return nil
+}
+
+func (conf *TLSClientConfig) Check() error {
+	if (conf.Cert_file == "") != (conf.Key_file == "") {
+		return fmt.Errorf("client cert_file and key_file must be set together")
+	}
+	if !conf.Enabled && (conf.Ca_file != "" || conf.Cert_file != "") {
+		return fmt.Errorf("client TLS files are set, but TLS is not enabled")
+	}
+	return nil
+}
+
+// certReloader holds a certificate and/or CA pool loaded from PEM
+// files, re-reading them when their modification times change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mutex    sync.Mutex
+	checked  time.Time
+	modTimes []time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, _, err := r.get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{}
+	for _, path := range []string{r.certFile, r.keyFile, r.caFile} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// get returns the current certificate and CA pool (either may be nil
+// if not configured).  If reloading fails (e.g., a file is only half
+// written), the previous ones are kept and used.
+func (r *certReloader) get() (*tls.Certificate, *x509.CertPool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.modTimes != nil && time.Since(r.checked) < TLS_RELOAD_CHECK_INTERVAL {
+		return r.cert, r.pool, nil
+	}
+	r.checked = time.Now()
+
+	modTimes := []time.Time{}
+	changed := r.modTimes == nil
+	for i, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return r.reloadFailed(err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+		changed = changed || !info.ModTime().Equal(r.modTimes[i])
+	}
+	if !changed {
+		return r.cert, r.pool, nil
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return r.reloadFailed(err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return r.reloadFailed(err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return r.reloadFailed(fmt.Errorf("no certificates found in %s", r.caFile))
+		}
+	}
+
+	if r.modTimes != nil {
+		log.Printf("reloaded TLS files %v", r.files())
+	}
+	r.cert, r.pool, r.modTimes = cert, pool, modTimes
+	return r.cert, r.pool, nil
+}
+
+func (r *certReloader) reloadFailed(err error) (*tls.Certificate, *x509.CertPool, error) {
+	if r.modTimes == nil {
+		// never loaded successfully, so nothing to fall back on
+		return nil, nil, err
+	}
+	log.Printf("could not reload TLS files %v (keeping previous ones): %v", r.files(), err)
+	return r.cert, r.pool, nil
+}
+
+// ServerTLSConfig returns a tls.Config for a listener, or nil if
+// conf doesn't enable TLS
+func ServerTLSConfig(conf *TLSConfig) (*tls.Config, error) {
+	if !conf.Enabled() {
+		return nil, nil
+	}
+
+	r, err := newCertReloader(conf.Cert_file, conf.Key_file, conf.Client_ca_file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+
+		// build the config for each connection, so it uses
+		// the latest certs
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool, err := r.get()
+			if err != nil {
+				return nil, err
+			}
+
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				c.ClientCAs = pool
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}, nil
+}
+
+// ClientTransport returns an http.Transport for connecting to servers
+// over TLS (e.g., the boss connecting to workers), or nil if conf
+// doesn't enable TLS.  Server certificates are checked against
+// conf.Server_name or, if that is empty, the host (name or IP) being
+// dialed.
+func ClientTransport(conf *TLSClientConfig) (*http.Transport, error) {
+	if !conf.Enabled {
+		return nil, nil
+	}
+
+	r, err := newCertReloader(conf.Cert_file, conf.Key_file, conf.Ca_file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			dialer := &tls.Dialer{Config: clientTLSConfig(conf, r, host)}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// clientTLSConfig returns a tls.Config for connecting to host
+func clientTLSConfig(conf *TLSClientConfig, r *certReloader, host string) *tls.Config {
+	serverName := conf.Server_name
+	if serverName == "" {
+		serverName = host
+	}
+
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if conf.Cert_file != "" {
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _, err := r.get()
+			return cert, err
+		}
+	}
+
+	if conf.Ca_file != "" {
+		// the CA pool may be reloaded, so it can't be fixed in
+		// RootCAs; verify against the current pool ourselves
+		// instead (the standard verification is skipped)
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			_, pool, err := r.get()
+			if err != nil {
+				return err
+			}
+			return verifyPeer(cs, pool, serverName)
+		}
+	}
+
+	return c
+}
+
+// localWorkerTLSConfig is for admin commands connecting to a worker
+// on this host (using its config).  Rather than trusting a CA, the
+// worker must present exactly the certificate in its cert_file.  If
+// the worker requires client certs, the admin certificate (see
+// TLSConfig.adminCert) is offered.
+func localWorkerTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(Conf.TLS.Cert_file, Conf.TLS.Key_file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 || !bytes.Equal(cs.PeerCertificates[0].Raw, cert.Certificate[0]) {
+				return errors.New("worker did not present the certificate in its tls.cert_file")
+			}
+			return nil
+		},
+	}
+	if Conf.TLS.Client_ca_file != "" {
+		adminCert, err := tls.LoadX509KeyPair(Conf.TLS.adminCert())
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{adminCert}
+	}
+	return c, nil
+}
+
+// verifyPeer checks the server's certificate chain against roots, and
+// that it is valid for serverName (a host name or IP)
+func verifyPeer(cs tls.ConnectionState, roots *x509.CertPool, serverName string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
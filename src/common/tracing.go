@@ -0,0 +1,476 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// request tracing
+//
+// Invocations carry a W3C trace context (the traceparent header) from
+// the boss, through the worker, to the lambda.  Along the way, spans
+// are recorded for the request and for the T0/T1 phases it passes
+// through, and exported in OTLP-JSON (to a file, or to a collector),
+// so a single slow request can be explained by its own span tree.
+//
+// Most phases are measured deep in code that has no notion of which
+// request it is working for, so rather than threading a context
+// through every call, the span a goroutine is working for is bound
+// to that goroutine (see Span.Bind).  T0 starts a child of the bound
+// span (if any), and binds the child until T1.
+
+const TRACEPARENT_HEADER = "traceparent"
+
+// how many finished spans may wait for export (more are dropped),
+// and how often they are exported
+const TRACE_QUEUE_SIZE = 4096
+const TRACE_EXPORT_INTERVAL = time.Second
+
+type TracingConfig struct {
+	// append spans to this file, one OTLP-JSON export request
+	// per line
+	File string `json:"file"`
+
+	// and/or POST them to this OTLP/HTTP collector URL (e.g.,
+	// http://localhost:4318/v1/traces)
+	Endpoint string `json:"endpoint"`
+
+	// service.name of the exported spans
+	Service_name string `json:"service_name"`
+}
+
+func (conf *TracingConfig) Enabled() bool {
+	return conf.File != "" || conf.Endpoint != ""
+}
+
+func (conf *TracingConfig) Check() error {
+	if conf.Endpoint != "" && !strings.HasPrefix(conf.Endpoint, "http://") && !strings.HasPrefix(conf.Endpoint, "https://") {
+		return fmt.Errorf("tracing.endpoint must be an http:// or https:// URL, not '%s'", conf.Endpoint)
+	}
+	return nil
+}
+
+var tracingLog = NewLogger("tracing")
+
+// TraceContext identifies a span, as in a traceparent header
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// ParseTraceparent parses a traceparent header
+// ("00-<trace-id>-<span-id>-<flags>"), returning false if it is
+// missing or malformed
+func ParseTraceparent(header string) (TraceContext, bool) {
+	var tc TraceContext
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tc, false
+	}
+	// version 00 has exactly 4 parts; later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return tc, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(tc.TraceID) {
+		return tc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(tc.SpanID) {
+		return tc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || len(parts[3]) != 2 {
+		return tc, false
+	}
+
+	copy(tc.TraceID[:], traceID)
+	copy(tc.SpanID[:], spanID)
+	tc.Sampled = flags&1 == 1
+	return tc, tc.IsValid()
+}
+
+// IsValid is false if either ID is all zeros
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+func (tc TraceContext) Traceparent() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(tc.TraceID[:]), hex.EncodeToString(tc.SpanID[:]), flags)
+}
+
+// OTLP span kinds
+type SpanKind int
+
+const (
+	SPAN_INTERNAL SpanKind = 1
+	SPAN_SERVER   SpanKind = 2
+	SPAN_CLIENT   SpanKind = 3
+)
+
+// Span is one timed operation within a trace.  All methods may be
+// called on a nil Span (as returned when tracing is off), and do
+// nothing.
+type Span struct {
+	ctx      TraceContext
+	parentID [8]byte
+	name     string
+	kind     SpanKind
+	start    time.Time
+
+	mutex  sync.Mutex
+	end    time.Time
+	attrs  map[string]string
+	errMsg string
+}
+
+// StartRequestSpan starts the span for an incoming request, as a
+// child of the request's traceparent (if any), or of a new trace.
+// Returns nil if tracing is off.
+func StartRequestSpan(name string, header http.Header) *Span {
+	if !TracingEnabled() {
+		return nil
+	}
+
+	parent, ok := ParseTraceparent(header.Get(TRACEPARENT_HEADER))
+	if !ok {
+		parent = TraceContext{Sampled: true}
+		rand.Read(parent.TraceID[:])
+	}
+	return newSpan(name, parent, SPAN_SERVER)
+}
+
+// StartSpan starts a child of parent (nil if parent is nil)
+func StartSpan(name string, parent *Span, kind SpanKind) *Span {
+	if parent == nil {
+		return nil
+	}
+	return newSpan(name, parent.ctx, kind)
+}
+
+func newSpan(name string, parent TraceContext, kind SpanKind) *Span {
+	s := &Span{
+		ctx:      parent,
+		parentID: parent.SpanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    map[string]string{},
+	}
+	rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+func (s *Span) Context() TraceContext {
+	if s == nil {
+		return TraceContext{}
+	}
+	return s.ctx
+}
+
+// Inject sets the traceparent header, so the receiver's spans are
+// children of s
+func (s *Span) Inject(header http.Header) {
+	if s != nil {
+		header.Set(TRACEPARENT_HEADER, s.ctx.Traceparent())
+	}
+}
+
+func (s *Span) SetAttr(key string, val any) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attrs[key] = fmt.Sprintf("%v", val)
+}
+
+// SetError marks the operation as failed
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.errMsg = msg
+}
+
+// End records the span's end time, and queues it for export (if
+// sampled).  Only the first call has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mutex.Unlock()
+
+	if ended || !s.ctx.Sampled {
+		return
+	}
+
+	tracing.RLock()
+	defer tracing.RUnlock()
+	if tracing.spans == nil {
+		return
+	}
+	select {
+	case tracing.spans <- s:
+	default:
+		atomic.AddInt64(&tracing.dropped, 1)
+	}
+}
+
+// goroutine ID => span that goroutine is working for
+var boundSpans sync.Map
+
+// Bind makes s the parent of T0/T1 phases (and CurrentSpan) on the
+// calling goroutine, until the returned function is called (which
+// restores whatever was bound before)
+func (s *Span) Bind() (unbind func()) {
+	if s == nil {
+		return func() {}
+	}
+
+	id := GetGoroutineID()
+	prev, _ := boundSpans.Load(id)
+	boundSpans.Store(id, s)
+
+	return func() {
+		if prev == nil {
+			boundSpans.Delete(id)
+		} else {
+			boundSpans.Store(id, prev)
+		}
+	}
+}
+
+// CurrentSpan returns the span bound to the calling goroutine, if any
+func CurrentSpan() *Span {
+	if !TracingEnabled() {
+		return nil
+	}
+	if s, ok := boundSpans.Load(GetGoroutineID()); ok {
+		return s.(*Span)
+	}
+	return nil
+}
+
+// exporter state
+var tracing = struct {
+	sync.RWMutex
+	on      int32 // atomic, so T0 can check cheaply
+	conf    TracingConfig
+	spans   chan *Span
+	done    chan bool
+	dropped int64 // atomic
+}{}
+
+func TracingEnabled() bool {
+	return atomic.LoadInt32(&tracing.on) == 1
+}
+
+// StartTracing starts exporting spans as configured (if conf enables
+// tracing), with defaultService as the service.name if conf doesn't
+// give one
+func StartTracing(conf *TracingConfig, defaultService string) error {
+	if !conf.Enabled() {
+		return nil
+	}
+
+	tracing.Lock()
+	defer tracing.Unlock()
+
+	if tracing.spans != nil {
+		return fmt.Errorf("tracing already started")
+	}
+
+	tracing.conf = *conf
+	if tracing.conf.Service_name == "" {
+		tracing.conf.Service_name = defaultService
+	}
+
+	var file *os.File
+	if conf.File != "" {
+		var err error
+		file, err = os.OpenFile(conf.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	tracing.spans = make(chan *Span, TRACE_QUEUE_SIZE)
+	tracing.done = make(chan bool)
+	go traceExportTask(tracing.conf, tracing.spans, tracing.done, file)
+	atomic.StoreInt32(&tracing.on, 1)
+
+	tracingLog.Infof("exporting spans to %s", strings.TrimSpace(conf.File+" "+conf.Endpoint))
+	return nil
+}
+
+// StopTracing exports any spans that are still queued, then stops
+func StopTracing() {
+	atomic.StoreInt32(&tracing.on, 0)
+
+	tracing.Lock()
+	spans, done := tracing.spans, tracing.done
+	tracing.spans = nil
+	tracing.Unlock()
+
+	if spans != nil {
+		close(spans)
+		<-done
+	}
+}
+
+func traceExportTask(conf TracingConfig, spans chan *Span, done chan bool, file *os.File) {
+	defer close(done)
+	if file != nil {
+		defer file.Close()
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	ticker := time.NewTicker(TRACE_EXPORT_INTERVAL)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	export := func() {
+		if dropped := atomic.SwapInt64(&tracing.dropped, 0); dropped > 0 {
+			tracingLog.Warnf("dropped %d spans (export queue full)", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		b, err := json.Marshal(otlpRequest(conf.Service_name, batch))
+		batch = []*Span{}
+		if err != nil {
+			tracingLog.Errorf("could not encode spans: %v", err)
+			return
+		}
+
+		if file != nil {
+			if _, err := file.Write(append(b, '\n')); err != nil {
+				tracingLog.Warnf("could not write spans to %s: %v", conf.File, err)
+			}
+		}
+
+		if conf.Endpoint != "" {
+			resp, err := client.Post(conf.Endpoint, "application/json", bytes.NewReader(b))
+			if err != nil {
+				tracingLog.Warnf("could not export spans to %s: %v", conf.Endpoint, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				tracingLog.Warnf("could not export spans to %s: %s", conf.Endpoint, resp.Status)
+			}
+		}
+	}
+
+	for {
+		select {
+		case s, ok := <-spans:
+			if !ok {
+				export()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= TRACE_QUEUE_SIZE/8 {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+// OTLP-JSON encoding (see opentelemetry-proto's
+// ExportTraceServiceRequest).  IDs are hex, and 64-bit times are
+// decimal strings.
+
+type otlpKeyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            map[string]any `json:"status,omitempty"`
+}
+
+func otlpAttr(key, val string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: map[string]string{"stringValue": val}}
+}
+
+func otlpRequest(service string, spans []*Span) map[string]any {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mutex.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for key, val := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpAttr(key, val))
+		}
+		if s.errMsg != "" {
+			// STATUS_CODE_ERROR
+			span.Status = map[string]any{"code": 2, "message": s.errMsg}
+		}
+		s.mutex.Unlock()
+
+		encoded = append(encoded, span)
+	}
+
+	return map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": []otlpKeyValue{otlpAttr("service.name", service)},
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]string{"name": "open-lambda"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/fsouza/go-dockerclient v1.10.1
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/urfave/cli/v2 v2.25.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -6,7 +6,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -142,7 +141,7 @@ func pprofMem(ctx *cli.Context) error {
 	}
 
 	url := fmt.Sprintf("http://localhost:%s/pprof/mem", common.Conf.Worker_port)
-	response, err := http.Get(url)
+	response, err := common.WorkerGet(url)
 	if err != nil {
 		return fmt.Errorf("could not send GET to %s", url)
 	}
@@ -179,7 +178,7 @@ func pprofCpuStart(ctx *cli.Context) error {
 	}
 
 	url := fmt.Sprintf("http://localhost:%s/pprof/cpu-start", common.Conf.Worker_port)
-	response, err := http.Get(url)
+	response, err := common.WorkerGet(url)
 	if err != nil {
 		return fmt.Errorf("Could not send GET to %s", url)
 	}
@@ -212,7 +211,7 @@ func pprofCpuStop(ctx *cli.Context) error {
 	}
 
 	url := fmt.Sprintf("http://localhost:%s/pprof/cpu-stop", common.Conf.Worker_port)
-	response, err := http.Get(url)
+	response, err := common.WorkerGet(url)
 	if err != nil {
 		return fmt.Errorf("Could not send GET to %s", url)
 	}
@@ -74,6 +74,19 @@ func upCmd(ctx *cli.Context) error {
 		return err
 	}
 
+	// on reload, re-read config.json (re-applying the same overrides)
+	server.ConfigSource = func() (string, error) {
+		confPath := filepath.Join(olPath, "config.json")
+		if overrides == "" {
+			return confPath, nil
+		}
+		overridesPath := confPath + ".overrides"
+		if err := overrideOpts(confPath, overridesPath, overrides); err != nil {
+			return "", err
+		}
+		return overridesPath, nil
+	}
+
 	// PREP STEP 3: stop any prior worker that may be running
 	if err := stopOL(olPath); err != nil {
 		return err
@@ -149,7 +162,7 @@ func upCmd(ctx *cli.Context) error {
 
 			// is it reachable?
 			url := fmt.Sprintf("http://localhost:%s/pid", common.Conf.Worker_port)
-			response, err := http.Get(url)
+			response, err := common.WorkerGet(url)
 			if err != nil {
 				pingErr = err
 				time.Sleep(100 * time.Millisecond)
@@ -195,7 +208,7 @@ func statusCmd(ctx *cli.Context) error {
 
 	fmt.Printf("Worker Ping:\n")
 	url := fmt.Sprintf("http://localhost:%s/status", common.Conf.Worker_port)
-	response, err := http.Get(url)
+	response, err := common.WorkerGet(url)
 	if err != nil {
 		return fmt.Errorf("could not send GET to %s", url)
 	}
@@ -210,6 +223,76 @@ func statusCmd(ctx *cli.Context) error {
 	return nil
 }
 
+// lambdaOpCmd returns the action for an admin operation on one
+// lambda (the "lambda <op>" commands of the admin tool)
+func lambdaOpCmd(op string) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return fmt.Errorf("usage: ol worker lambda %s [OPTIONS...] <lambda-name>", op)
+		}
+		name := ctx.Args().First()
+
+		olPath, err := common.GetOlPath(ctx)
+		if err != nil {
+			return err
+		}
+		err = common.LoadConf(filepath.Join(olPath, "config.json"))
+		if err != nil {
+			return err
+		}
+
+		url := fmt.Sprintf("http://localhost:%s/lambdas/%s/%s", common.Conf.Worker_port, name, op)
+		if op == "disable" && ctx.Int("sec") > 0 {
+			url += fmt.Sprintf("?sec=%d", ctx.Int("sec"))
+		}
+
+		response, err := common.WorkerPost(url)
+		if err != nil {
+			return fmt.Errorf("could not send POST to %s: %v", url, err)
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read body from POST to %s", url)
+		}
+
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s [%s]", strings.TrimSpace(string(body)), response.Status)
+		}
+		fmt.Printf("%s", body)
+		return nil
+	}
+}
+
+// reloadCmd corresponds to the "reload" command of the admin tool.
+func reloadCmd(ctx *cli.Context) error {
+	olPath, err := common.GetOlPath(ctx)
+	if err != nil {
+		return err
+	}
+	err = common.LoadConf(filepath.Join(olPath, "config.json"))
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://localhost:%s/admin/reload", common.Conf.Worker_port)
+	response, err := common.WorkerPost(url)
+	if err != nil {
+		return fmt.Errorf("could not send POST to %s: %v", url, err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read body from POST to %s", url)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s [%s]", strings.TrimSpace(string(body)), response.Status)
+	}
+	fmt.Printf("%s", body)
+	return nil
+}
+
 // down corresponds to the "down" command of the admin tool.
 func downCmd(ctx *cli.Context) error {
 	olPath, err := common.GetOlPath(ctx)
@@ -351,6 +434,61 @@ func WorkerCommands() []*cli.Command {
 			Flags:       []cli.Flag{&pathFlag},
 			Action:      statusCmd,
 		},
+		&cli.Command{
+			Name:      "reload",
+			Usage:     "Re-read the config of a running worker (same as sending it SIGHUP)",
+			UsageText: "ol worker reload [OPTIONS...]",
+			Flags:     []cli.Flag{&pathFlag},
+			Action:    reloadCmd,
+		},
+		&cli.Command{
+			Name:      "lambda",
+			Usage:     "Admin operations on a lambda loaded by a running worker",
+			UsageText: "ol worker lambda <op> [OPTIONS...] <lambda-name>",
+			Subcommands: []*cli.Command{
+				&cli.Command{
+					Name:      "refresh",
+					Usage:     "Re-pull the lambda's code on its next invocation",
+					UsageText: "ol worker lambda refresh [OPTIONS...] <lambda-name>",
+					Flags:     []cli.Flag{&pathFlag},
+					Action:    lambdaOpCmd("refresh"),
+				},
+				&cli.Command{
+					Name:      "quiesce",
+					Usage:     "Kill the lambda's instances (after they finish their current invocations)",
+					UsageText: "ol worker lambda quiesce [OPTIONS...] <lambda-name>",
+					Flags:     []cli.Flag{&pathFlag},
+					Action:    lambdaOpCmd("quiesce"),
+				},
+				&cli.Command{
+					Name:      "disable",
+					Usage:     "Reject invocations of the lambda (with a 503) until it is enabled",
+					UsageText: "ol worker lambda disable [OPTIONS...] <lambda-name>",
+					Flags: []cli.Flag{
+						&pathFlag,
+						&cli.IntFlag{
+							Name:  "sec",
+							Usage: "Enable the lambda again after this many seconds",
+						},
+					},
+					Action: lambdaOpCmd("disable"),
+				},
+				&cli.Command{
+					Name:      "enable",
+					Usage:     "Allow invocations of a disabled lambda",
+					UsageText: "ol worker lambda enable [OPTIONS...] <lambda-name>",
+					Flags:     []cli.Flag{&pathFlag},
+					Action:    lambdaOpCmd("enable"),
+				},
+				&cli.Command{
+					Name:      "unload",
+					Usage:     "Kill the lambda's instances and delete its code (fails if it's being invoked)",
+					UsageText: "ol worker lambda unload [OPTIONS...] <lambda-name>",
+					Flags:     []cli.Flag{&pathFlag},
+					Action:    lambdaOpCmd("unload"),
+				},
+			},
+		},
 		&cli.Command{
 			Name:      "force-cleanup",
 			Usage:     "Developer use only.  Cleanup cgroups and mount points (only needed when OL halted unexpectedly or there's a bug)",
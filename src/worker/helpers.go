@@ -196,7 +196,10 @@ func stopOL(_ string) error {
 		return fmt.Errorf("Failed to send SIGINT to PID %d (%s).  May require manual cleanup.\n", pid, err.Error())
 	}
 
-	for i := 0; i < 600; i++ {
+	// the worker first lets in-flight invocations finish, for up
+	// to the drain grace period, before cleaning up
+	waitSec := 60 + common.Conf.Limits.Drain_grace_sec
+	for i := 0; i < waitSec*10; i++ {
 		err := p.Signal(syscall.Signal(0))
 		if err != nil {
 			fmt.Printf("OL worker process stopped successfully.\n")
@@ -205,7 +208,7 @@ func stopOL(_ string) error {
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	return fmt.Errorf("worker didn't stop after 60s")
+	return fmt.Errorf("worker didn't stop after %ds", waitSec)
 }
 
 // modify the config.json file based on settings from cmdline: -o opt1=val1,opt2=val2,...
@@ -0,0 +1,129 @@
+package lambda
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// admission control
+//
+// Each lambda has a cap on its instances (so one busy lambda can't
+// take over the whole memory pool), on the invocations waiting for
+// an instance, and on how long they may wait.  Invocations that
+// arrive to a full queue get a 429, and those that wait too long get
+// a 503, both with a Retry-After estimate.  The limits come from the
+// lambda's ol.yaml, or else from common.Conf.Limits.
+
+// reasons for rejecting invocations (in stats and metrics)
+const (
+	REJECT_QUEUE_FULL    = "queue_full"
+	REJECT_QUEUE_TIMEOUT = "queue_timeout"
+)
+
+// states of an invocation waiting for an instance (Invocation.queueState)
+const (
+	invQueued    int32 = iota
+	invClaimed         // taken by an instance
+	invAbandoned       // rejected after waiting too long
+)
+
+// claim is called by an instance that takes req from the queue.  It
+// returns false if req has been abandoned (so the client already got
+// a response), in which case the instance must not serve it.
+func (req *Invocation) claim() bool {
+	if !atomic.CompareAndSwapInt32(&req.queueState, invQueued, invClaimed) {
+		return false
+	}
+	if req.queueTimer != nil {
+		req.queueTimer.Stop()
+	}
+	return true
+}
+
+// abandon gives up on req, unless an instance already claimed it
+func (req *Invocation) abandon() bool {
+	return atomic.CompareAndSwapInt32(&req.queueState, invQueued, invAbandoned)
+}
+
+func (req *Invocation) abandoned() bool {
+	return atomic.LoadInt32(&req.queueState) == invAbandoned
+}
+
+// maxInstances is the most instances the autoscaler may start (0
+// means no limit)
+func (f *LambdaFunc) maxInstances() int {
+	if f.conf != nil && f.conf.Max_instances > 0 {
+		return f.conf.Max_instances
+	}
+	return common.Conf.Limits.Max_instances
+}
+
+// maxQueued is how many invocations may wait for an instance.  This
+// can't exceed the size of instChan (fixed when f was created, so
+// raising limits.max_queued with a reload only affects lambdas loaded
+// after it).
+func (f *LambdaFunc) maxQueued() int {
+	max := common.Conf.Limits.Max_queued
+	if f.conf != nil && f.conf.Max_queued > 0 {
+		max = f.conf.Max_queued
+	}
+	return common.Min(max, cap(f.instChan))
+}
+
+// maxQueueWait is how long an invocation may wait for an instance,
+// counting from its arrival (0 means only its deadline applies)
+func (f *LambdaFunc) maxQueueWait() time.Duration {
+	ms := common.Conf.Limits.Max_queue_ms
+	if f.conf != nil && f.conf.Max_queue_ms > 0 {
+		ms = f.conf.Max_queue_ms
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// retryAfterSec estimates how many seconds it would take the
+// instances to work through the invocations queued ahead of a new one
+func retryAfterSec(queued int, instances int, avgExecMs int) int {
+	sec := float64(queued*avgExecMs) / float64(common.Max(instances, 1)) / 1000
+	return common.Max(int(math.Ceil(sec)), 1)
+}
+
+// reject responds to an invocation that admission control turned
+// away (the caller must still signal req.done)
+func (f *LambdaFunc) reject(req *Invocation, statusCode int, reason string, retrySec int, msg string) {
+	if reason == REJECT_QUEUE_FULL {
+		atomic.AddInt64(&f.queueFull, 1)
+	} else {
+		atomic.AddInt64(&f.queueTimeouts, 1)
+	}
+	rejectedMetric.With(f.name, reason).Inc()
+	f.logger().With("request", req.id).Debugf("rejected invocation: %s", msg)
+
+	req.w.Header().Set("Retry-After", strconv.Itoa(retrySec))
+	req.w.WriteHeader(statusCode)
+	req.w.Write([]byte(msg + "\n"))
+}
+
+// expireQueued rejects req if no instance claims it within the
+// lambda's max queue wait (claiming it stops the timer).  Called by
+// the Task just before req is queued, so instances see the timer.
+func (f *LambdaFunc) expireQueued(req *Invocation, retrySec int) {
+	maxWait := f.maxQueueWait()
+	if maxWait <= 0 {
+		return
+	}
+
+	req.queueTimer = time.AfterFunc(maxWait-time.Since(req.arrival), func() {
+		if req.abandon() {
+			// the instance that eventually takes req from
+			// the queue returns it to the Task unserved
+			f.reject(req, http.StatusServiceUnavailable, REJECT_QUEUE_TIMEOUT, retrySec,
+				"invocation waited too long for an instance (max_queue_ms)")
+			req.done <- true
+		}
+	})
+}
@@ -0,0 +1,606 @@
+package lambda
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+const (
+	ASYNC_QUEUED    = "queued"
+	ASYNC_RUNNING   = "running"
+	ASYNC_DONE      = "done"
+	ASYNC_CANCELLED = "cancelled"
+)
+
+var ErrInvocationNotFound = errors.New("no invocation with that ID")
+var ErrDraining = errors.New("worker is draining and not accepting invocations")
+var invocationIDRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// how often finished invocations are checked for expiry
+const ASYNC_EXPIRE_INTERVAL = time.Minute
+
+// AsyncInvoker accepts invocations that run in the background.
+// Each one is saved to disk (in the invocations dir, outside the
+// worker dir) as soon as it is submitted, and the record is updated
+// in place as it moves from queued to running to done, so clients can
+// poll for the result by ID instead of holding a connection open.
+// Invocations that were queued or running when the worker stopped
+// are run when it starts again, and records of finished ones are
+// deleted once limits.async_ttl_sec has passed.
+type AsyncInvoker struct {
+	lmgr *LambdaMgr
+	dir  string
+
+	// IDs of new invocations are sent here; a single task keeps
+	// the backlog and feeds the dispatchers through workChan
+	submitChan chan string
+	workChan   chan string
+	stopChan   chan bool
+
+	// submitted invocations that are not yet done
+	pending int64
+
+	// protects record files from concurrent read-modify-write,
+	// and cancels (which cancel running invocations, by ID)
+	mutex   sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+// AsyncInvocation is the on-disk record of an asynchronous invocation
+type AsyncInvocation struct {
+	ID        string     `json:"id"`
+	Lambda    string     `json:"lambda"`
+	State     string     `json:"state"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+
+	// auth key it was submitted with (if auth is enabled); only
+	// that key may poll or cancel it
+	KeyID string `json:"key_id,omitempty"`
+
+	// request to replay against the lambda
+	Method     string      `json:"method,omitempty"`
+	RequestURI string      `json:"request_uri,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+
+	// set when a running invocation is cancelled, so it is
+	// recorded as cancelled even if the lambda finishes anyway
+	CancelRequested bool `json:"cancel_requested,omitempty"`
+
+	// populated once the lambda has responded
+	StatusCode int    `json:"status_code,omitempty"`
+	Result     string `json:"result,omitempty"`
+}
+
+// captures a lambda's response in memory, so it can be saved once
+// the invocation completes
+type bufferedResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (resp *bufferedResponse) Header() http.Header {
+	return resp.header
+}
+
+func (resp *bufferedResponse) Write(b []byte) (int, error) {
+	if resp.statusCode == 0 {
+		resp.statusCode = http.StatusOK
+	}
+	return resp.body.Write(b)
+}
+
+func (resp *bufferedResponse) WriteHeader(statusCode int) {
+	if resp.statusCode == 0 {
+		resp.statusCode = statusCode
+	}
+}
+
+func NewAsyncInvoker(lmgr *LambdaMgr) (*AsyncInvoker, error) {
+	dir := common.Conf.Invocations_dir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	invoker := &AsyncInvoker{
+		lmgr:       lmgr,
+		dir:        dir,
+		submitChan: make(chan string, 256),
+		workChan:   make(chan string),
+		stopChan:   make(chan bool),
+		cancels:    make(map[string]context.CancelFunc),
+	}
+
+	backlog, err := invoker.resume()
+	if err != nil {
+		return nil, err
+	}
+	invoker.expire()
+
+	atomic.AddInt64(&invoker.pending, int64(backlog.Len()))
+	go invoker.queueTask(backlog)
+	go invoker.expireTask()
+	for i := 0; i < common.Conf.Limits.Async_concurrency; i++ {
+		go invoker.dispatchTask()
+	}
+
+	return invoker, nil
+}
+
+func newInvocationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (invoker *AsyncInvoker) recordPath(id string) string {
+	return filepath.Join(invoker.dir, id+".json")
+}
+
+// write to a temp file first, so readers never see a partial record
+func (invoker *AsyncInvoker) saveRecord(inv *AsyncInvocation) error {
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	path := invoker.recordPath(inv.ID)
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (invoker *AsyncInvoker) loadRecord(id string) (*AsyncInvocation, error) {
+	if !invocationIDRegex.MatchString(id) {
+		return nil, ErrInvocationNotFound
+	}
+
+	b, err := ioutil.ReadFile(invoker.recordPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrInvocationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	inv := &AsyncInvocation{}
+	if err := json.Unmarshal(b, inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// apply fn to the saved record with the given ID
+func (invoker *AsyncInvoker) updateRecord(id string, fn func(*AsyncInvocation)) (*AsyncInvocation, error) {
+	invoker.mutex.Lock()
+	defer invoker.mutex.Unlock()
+
+	inv, err := invoker.loadRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	fn(inv)
+	return inv, invoker.saveRecord(inv)
+}
+
+// InvokeAsync saves the request for the named lambda and queues it,
+// returning the ID that can later be passed to GetInvocation
+func (invoker *AsyncInvoker) InvokeAsync(name string, r *http.Request) (string, error) {
+	// admitted until it's counted as pending, so a drain that
+	// starts in between still waits for it
+	release, ok := invoker.lmgr.Admit()
+	if !ok {
+		return "", ErrDraining
+	}
+	defer release()
+
+	id, err := newInvocationID()
+	if err != nil {
+		return "", err
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+
+	inv := &AsyncInvocation{
+		ID:         id,
+		Lambda:     name,
+		State:      ASYNC_QUEUED,
+		Submitted:  time.Now(),
+		KeyID:      common.AuthKeyID(r.Context()),
+		Method:     r.Method,
+		RequestURI: r.RequestURI,
+		Header:     recordedHeader(r.Header),
+		Body:       body,
+	}
+
+	invoker.mutex.Lock()
+	err = invoker.saveRecord(inv)
+	invoker.mutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	atomic.AddInt64(&invoker.pending, 1)
+	select {
+	case invoker.submitChan <- id:
+	case <-invoker.stopChan:
+		// it's saved as queued, so it will run once the
+		// worker starts again
+		atomic.AddInt64(&invoker.pending, -1)
+	}
+	return id, nil
+}
+
+// headers that are not saved with an async invocation: credentials
+// (records stay on disk for limits.async_ttl_sec), and hop-by-hop
+// headers, which only concerned the connection it was submitted on
+var unrecordedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	common.AUTH_API_KEY_HEADER,
+	common.AUTH_KEY_ID_HEADER,
+	common.AUTH_TIMESTAMP_HEADER,
+	common.AUTH_SIGNATURE_HEADER,
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// recordedHeader returns the part of a request's header that is
+// saved with (and replayed from) an async invocation's record
+func recordedHeader(header http.Header) http.Header {
+	recorded := header.Clone()
+	for _, field := range header.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			recorded.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range unrecordedHeaders {
+		recorded.Del(name)
+	}
+	return recorded
+}
+
+// GetInvocation returns the current record for an invocation
+// submitted with the auth key keyID (the original request is omitted).
+// Others' invocations are ErrInvocationNotFound, as IDs are only
+// known to whoever submitted them.
+func (invoker *AsyncInvoker) GetInvocation(id string, keyID string) (*AsyncInvocation, error) {
+	invoker.mutex.Lock()
+	inv, err := invoker.loadRecord(id)
+	invoker.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	} else if inv.KeyID != keyID {
+		return nil, ErrInvocationNotFound
+	}
+
+	inv.Header = nil
+	inv.Body = nil
+	return inv, nil
+}
+
+// resume finds invocations that were queued or running when the
+// worker last stopped, and returns their IDs (oldest first) after
+// saving them as queued again.  Leftover temp files are deleted.
+func (invoker *AsyncInvoker) resume() (*list.List, error) {
+	entries, err := os.ReadDir(invoker.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	unfinished := []*AsyncInvocation{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(invoker.dir, name))
+			continue
+		} else if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		inv, err := invoker.loadRecord(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			lambdaLog.With("file", name).Warnf("skipping unreadable async invocation: %v", err)
+			continue
+		}
+
+		if inv.State != ASYNC_QUEUED && inv.State != ASYNC_RUNNING {
+			continue
+		}
+
+		if inv.CancelRequested {
+			// cancelled while running, before the worker stopped
+			now := time.Now()
+			inv.State = ASYNC_CANCELLED
+			inv.Finished = &now
+			inv.Header = nil
+			inv.Body = nil
+			if err := invoker.saveRecord(inv); err != nil {
+				return nil, err
+			}
+		} else {
+			inv.State = ASYNC_QUEUED
+			inv.Started = nil
+			if err := invoker.saveRecord(inv); err != nil {
+				return nil, err
+			}
+			unfinished = append(unfinished, inv)
+		}
+	}
+
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].Submitted.Before(unfinished[j].Submitted)
+	})
+
+	backlog := list.New()
+	for _, inv := range unfinished {
+		backlog.PushBack(inv.ID)
+	}
+	if backlog.Len() > 0 {
+		lambdaLog.Infof("resuming %d async invocations from %s", backlog.Len(), invoker.dir)
+	}
+	return backlog, nil
+}
+
+// expire deletes the records of invocations that finished more than
+// limits.async_ttl_sec ago
+func (invoker *AsyncInvoker) expire() {
+	ttl := time.Duration(common.Conf.Limits.Async_ttl_sec) * time.Second
+	if ttl == 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(invoker.dir)
+	if err != nil {
+		lambdaLog.Warnf("could not list async invocations: %v", err)
+		return
+	}
+
+	invoker.mutex.Lock()
+	defer invoker.mutex.Unlock()
+
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		inv, err := invoker.loadRecord(id)
+		if err != nil || inv.Finished == nil || time.Since(*inv.Finished) < ttl {
+			continue
+		}
+		if err := os.Remove(invoker.recordPath(id)); err != nil {
+			lambdaLog.With("invocation", id).Warnf("could not delete expired async invocation: %v", err)
+		}
+	}
+}
+
+func (invoker *AsyncInvoker) expireTask() {
+	ticker := time.NewTicker(ASYNC_EXPIRE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			invoker.expire()
+		case <-invoker.stopChan:
+			return
+		}
+	}
+}
+
+// this task holds the backlog of queued invocations (which may be
+// much larger than what we can dispatch at once), handing them to
+// dispatchers in FIFO order
+func (invoker *AsyncInvoker) queueTask(backlog *list.List) {
+	for {
+		if backlog.Len() == 0 {
+			select {
+			case id := <-invoker.submitChan:
+				backlog.PushBack(id)
+			case <-invoker.stopChan:
+				return
+			}
+			continue
+		}
+
+		front := backlog.Front()
+		select {
+		case id := <-invoker.submitChan:
+			backlog.PushBack(id)
+		case invoker.workChan <- front.Value.(string):
+			backlog.Remove(front)
+		case <-invoker.stopChan:
+			return
+		}
+	}
+}
+
+func (invoker *AsyncInvoker) dispatchTask() {
+	for {
+		select {
+		case id := <-invoker.workChan:
+			if err := invoker.run(id); err != nil {
+				lambdaLog.With("invocation", id).Errorf("async invocation failed: %v", err)
+			}
+			atomic.AddInt64(&invoker.pending, -1)
+		case <-invoker.stopChan:
+			return
+		}
+	}
+}
+
+// Cancel cancels an invocation that hasn't finished, and returns
+// where it was (CANCELLED_QUEUED or CANCELLED_RUNNING).  A queued one
+// never runs; a running one is cancelled like a synchronous invocation
+// whose client went away (see cancel.go), and is recorded as cancelled
+// even if the lambda finishes before noticing.  Only the auth key
+// that submitted it (keyID) may cancel it.
+func (invoker *AsyncInvoker) Cancel(id string, keyID string) (string, error) {
+	invoker.mutex.Lock()
+	defer invoker.mutex.Unlock()
+
+	inv, err := invoker.loadRecord(id)
+	if err != nil {
+		return "", err
+	} else if inv.KeyID != keyID {
+		return "", ErrInvocationNotFound
+	}
+
+	switch inv.State {
+	case ASYNC_QUEUED:
+		now := time.Now()
+		inv.State = ASYNC_CANCELLED
+		inv.Finished = &now
+		inv.Header = nil
+		inv.Body = nil
+		return CANCELLED_QUEUED, invoker.saveRecord(inv)
+	case ASYNC_RUNNING:
+		inv.CancelRequested = true
+		if err := invoker.saveRecord(inv); err != nil {
+			return "", err
+		}
+		if cancel, ok := invoker.cancels[id]; ok {
+			cancel()
+		}
+		return CANCELLED_RUNNING, nil
+	default:
+		return "", ErrInvocationFinished
+	}
+}
+
+// run replays a saved request against the lambda, retrying with
+// backoff while the lambda's queue is full
+func (invoker *AsyncInvoker) run(id string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		invoker.mutex.Lock()
+		delete(invoker.cancels, id)
+		invoker.mutex.Unlock()
+		cancel()
+	}()
+
+	cancelled := false
+	inv, err := invoker.updateRecord(id, func(inv *AsyncInvocation) {
+		if inv.State == ASYNC_CANCELLED {
+			cancelled = true
+			return
+		}
+		now := time.Now()
+		inv.State = ASYNC_RUNNING
+		inv.Started = &now
+		invoker.cancels[id] = cancel
+	})
+	if err != nil || cancelled {
+		return err
+	}
+
+	// continues the trace of the request that queued it, if any
+	span := common.StartRequestSpan("async-invocation", inv.Header)
+	span.SetAttr("lambda", inv.Lambda)
+	span.SetAttr("invocation_id", id)
+	unbind := span.Bind()
+	defer func() {
+		unbind()
+		span.End()
+	}()
+
+	var resp *bufferedResponse
+	backoff := 10 * time.Millisecond
+	for {
+		r, err := http.NewRequest(inv.Method, inv.RequestURI, bytes.NewReader(inv.Body))
+		if err != nil {
+			return err
+		}
+		r.RequestURI = inv.RequestURI
+		r.Header = inv.Header
+		r = r.WithContext(ctx)
+
+		resp = newBufferedResponse()
+		invoker.lmgr.Invoke(inv.Lambda, resp, r)
+		if resp.statusCode != http.StatusTooManyRequests {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		case <-invoker.stopChan:
+			// run it again when the worker restarts
+			_, err := invoker.updateRecord(id, func(inv *AsyncInvocation) {
+				inv.State = ASYNC_QUEUED
+				inv.Started = nil
+			})
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("worker shutting down")
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff = time.Duration(common.Min(int(backoff)*2, int(time.Second)))
+	}
+
+	_, err = invoker.updateRecord(id, func(inv *AsyncInvocation) {
+		now := time.Now()
+		inv.State = ASYNC_DONE
+		if ctx.Err() != nil || inv.CancelRequested {
+			inv.State = ASYNC_CANCELLED
+		}
+		inv.Finished = &now
+		inv.StatusCode = resp.statusCode
+		if inv.StatusCode == 0 {
+			inv.StatusCode = http.StatusOK
+		}
+		inv.Result = resp.body.String()
+
+		// the request is no longer needed, so don't keep it
+		// around on disk
+		inv.Header = nil
+		inv.Body = nil
+	})
+	return err
+}
+
+// Pending returns how many submitted invocations are not yet done
+func (invoker *AsyncInvoker) Pending() int {
+	return int(atomic.LoadInt64(&invoker.pending))
+}
+
+// Cleanup stops dispatching queued invocations.  Records stay on disk,
+// and unfinished ones run when the worker starts again.
+func (invoker *AsyncInvoker) Cleanup() {
+	close(invoker.stopChan)
+}
@@ -0,0 +1,128 @@
+package lambda
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// cancellation
+//
+// Each invocation has a context, which is cancelled when its client
+// disconnects, or when it is cancelled by ID (DELETE
+// /invocations/<id>).  Clients may choose the request IDs of sync
+// invocations, so those can only be cancelled with the auth key that
+// started them.  A queued invocation is abandoned (see
+// admission.go), so no instance serves it.  A running one has its
+// round trip to the sandbox aborted, and if
+// limits.cancel_destroys_sandbox is set, the sandbox is destroyed
+// (rather than left to finish the handler, which later invocations
+// would wait for).  Either way, the client (if still there) gets a
+// STATUS_CANCELLED response.
+
+// nonstandard status (as used by nginx) for invocations whose client
+// closed the connection or cancelled them
+const STATUS_CANCELLED = 499
+
+// where an invocation was when it was cancelled
+const (
+	CANCELLED_QUEUED  = "queued"
+	CANCELLED_RUNNING = "running"
+)
+
+var ErrInvocationFinished = errors.New("invocation already finished")
+
+// cancelled says whether req's client went away or cancelled it
+func (req *Invocation) cancelled() bool {
+	return req.ctx.Err() != nil
+}
+
+// sendCancelled tells the client (if it's still listening) that req
+// was cancelled, and counts it
+func (f *LambdaFunc) sendCancelled(req *Invocation, stage string) {
+	atomic.AddInt64(&f.cancelled, 1)
+	cancelledMetric.With(f.name, stage).Inc()
+	f.logger().With("request", req.id).Debugf("invocation cancelled while %s", stage)
+
+	req.w.WriteHeader(STATUS_CANCELLED)
+	req.w.Write([]byte("invocation cancelled\n"))
+}
+
+// cancelDiscard says why to discard the sandbox that was running a
+// cancelled invocation ("" to keep it)
+func cancelDiscard() string {
+	if common.Conf.Limits.Cancel_destroys_sandbox {
+		return "invocation cancelled"
+	}
+	return ""
+}
+
+// sync invocations are tracked by request ID and the auth key that
+// started them
+type trackedID struct {
+	requestID string
+	keyID     string
+}
+
+func (req *Invocation) trackedID() trackedID {
+	return trackedID{requestID: req.id, keyID: req.keyID}
+}
+
+// track makes req cancellable by ID until untrack is called.  If
+// another invocation with the same ID (which clients may choose) was
+// already started with the same key, req can't be cancelled by ID.
+func (mgr *LambdaMgr) track(req *Invocation) {
+	mgr.invMutex.Lock()
+	defer mgr.invMutex.Unlock()
+	if _, ok := mgr.invocations[req.trackedID()]; !ok {
+		mgr.invocations[req.trackedID()] = req
+	}
+}
+
+func (mgr *LambdaMgr) untrack(req *Invocation) {
+	mgr.invMutex.Lock()
+	defer mgr.invMutex.Unlock()
+	if mgr.invocations[req.trackedID()] == req {
+		delete(mgr.invocations, req.trackedID())
+	}
+}
+
+// InvocationLambda returns the name of the lambda a sync invocation
+// (by request ID) or async invocation (by invocation ID) invokes, if
+// there is one that was started with the auth key keyID
+func (mgr *LambdaMgr) InvocationLambda(id string, keyID string) (string, bool) {
+	mgr.invMutex.Lock()
+	req, ok := mgr.invocations[trackedID{requestID: id, keyID: keyID}]
+	mgr.invMutex.Unlock()
+	if ok {
+		return req.lambda, true
+	}
+
+	inv, err := mgr.AsyncInvoker.GetInvocation(id, keyID)
+	if err != nil {
+		return "", false
+	}
+	return inv.Lambda, true
+}
+
+// CancelInvocation cancels a synchronous invocation in progress (by
+// request ID) or an asynchronous one that hasn't finished (by
+// invocation ID), if it was started with the auth key keyID, and
+// returns where it was (CANCELLED_QUEUED or CANCELLED_RUNNING).
+func (mgr *LambdaMgr) CancelInvocation(id string, keyID string) (string, error) {
+	mgr.invMutex.Lock()
+	req, ok := mgr.invocations[trackedID{requestID: id, keyID: keyID}]
+	mgr.invMutex.Unlock()
+
+	if ok {
+		stage := CANCELLED_QUEUED
+		if atomic.LoadInt32(&req.queueState) == invClaimed {
+			stage = CANCELLED_RUNNING
+		}
+		req.cancel()
+		return stage, nil
+	}
+
+	return mgr.AsyncInvoker.Cancel(id, keyID)
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
@@ -28,6 +27,7 @@ var handlerNameRegex = regexp.MustCompile(`^[A-Za-z0-9\.\-\_]+$`)
 type HandlerPuller struct {
 	prefix   string   // combine with name to get file path or URL
 	dirCache sync.Map // key=lambda name, value=version, directory path
+	aliasCache sync.Map // key=lambda name (without version), value=*aliasEntry
 	dirMaker *common.DirMaker
 }
 
@@ -111,9 +111,11 @@ func (cp *HandlerPuller) Pull(name string) (rt_type common.RuntimeType, targetDi
 	t := common.T0("pull-lambda")
 	defer t.T1()
 	
-	if !handlerNameRegex.MatchString(name) {
+	if base, version := splitLambdaName(name); !handlerNameRegex.MatchString(base) {
 		msg := "bad lambda name '%s', can only contain letters, numbers, period, dash, and underscore"
 		return rt_type, "", fmt.Errorf(msg, name)
+	} else if isVersioned(name) && !versionRegex.MatchString(version) {
+		return rt_type, "", fmt.Errorf("bad version '%s' of lambda '%s' (versions are positive integers)", version, base)
 	}
 
 	if cp.isRemote() {
@@ -167,7 +169,7 @@ func (cp *HandlerPuller) pullLocalFile(src, lambdaName string) (rt_type common.R
 	}
 
 	if stat.Mode().IsDir() {
-		log.Printf("Installing `%s` from a directory", stat.Name())
+		lambdaLog.Infof("Installing `%s` from a directory", stat.Name())
 
 		// this is really just a debug mode, and is not
 		// expected to be efficient
@@ -210,11 +212,11 @@ func (cp *HandlerPuller) pullLocalFile(src, lambdaName string) (rt_type common.R
 		return rt_type, "", err
 	}
 
-	log.Printf("Created new directory for lambda function at `%s`", targetDir)
+	lambdaLog.Infof("Created new directory for lambda function at `%s`", targetDir)
 
 	// Make sure we include the suffix
 	if strings.HasSuffix(stat.Name(), ".py") {
-		log.Printf("Installing `%s` from a python file", src)
+		lambdaLog.Infof("Installing `%s` from a python file", src)
 
 		err := Copy(src, filepath.Join(targetDir, "f.py"))
 		rt_type = common.RT_PYTHON
@@ -223,7 +225,7 @@ func (cp *HandlerPuller) pullLocalFile(src, lambdaName string) (rt_type common.R
 			return rt_type, "", fmt.Errorf("%s :: %s", err)
 		}
 	} else if strings.HasSuffix(stat.Name(), ".bin") {
-		log.Printf("Installing `%s` from binary file", src)
+		lambdaLog.Infof("Installing `%s` from binary file", src)
 
 		err := Copy(src, filepath.Join(targetDir, "f.bin"))
 		rt_type = common.RT_NATIVE
@@ -232,7 +234,7 @@ func (cp *HandlerPuller) pullLocalFile(src, lambdaName string) (rt_type common.R
 			return rt_type, "", fmt.Errorf("%s :: %s", err)
 		}
 	} else if strings.HasSuffix(stat.Name(), ".tar.gz") {
-		log.Printf("Installing `%s` from an archive file", src)
+		lambdaLog.Infof("Installing `%s` from an archive file", src)
 
 		cmd := exec.Command("tar", "-xzf", src, "--directory", targetDir)
 		if output, err := cmd.CombinedOutput(); err != nil {
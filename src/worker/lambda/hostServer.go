@@ -0,0 +1,191 @@
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// lambda-to-lambda calls
+//
+// Each instance serves HTTP on a Unix socket in its sandbox's scratch
+// dir, which the sandbox sees as /host/invoke.sock.  A handler POSTs
+// to /run/<lambda> on that socket to invoke another lambda, which goes
+// straight to the LambdaMgr (not through the worker's public port).
+//
+// The instance serves one invocation at a time, so a call is always
+// made on behalf of a known invocation: the callee's deadline can be
+// no later than the caller's, the call counts against the caller's
+// limit on calls per invocation, and chains of calls are cut off at
+// Limits.Max_call_depth.  Calls made when the caller isn't serving an
+// invocation (e.g., from a leftover background thread) are rejected.
+
+// name of the socket within the scratch dir (so /host/invoke.sock)
+const HOST_SOCKET_NAME = "invoke.sock"
+
+// callees are told who called them with this header
+const CALLER_HEADER = "X-OL-Caller"
+
+// context key for an invocation's depth (0 for invocations from
+// outside the worker, 1 for calls they make, etc).  It's in the
+// context rather than a header so that handlers can't forge it.
+type callDepthKey struct{}
+
+type hostServer struct {
+	linst *LambdaInstance
+
+	// protects everything below
+	mutex    sync.Mutex
+	server   *http.Server
+	sockPath string
+
+	// the invocation the instance is serving (nil between
+	// invocations)
+	current *Invocation
+}
+
+func newHostServer(linst *LambdaInstance) *hostServer {
+	return &hostServer{linst: linst}
+}
+
+// listen starts serving calls on a socket in scratchDir (for a new
+// sandbox), and stops serving on the previous one (if any)
+func (host *hostServer) listen(scratchDir string) error {
+	host.close()
+
+	sockPath := filepath.Join(scratchDir, HOST_SOCKET_NAME)
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	// the sandbox's processes may run as any user
+	if err := os.Chmod(sockPath, 0777); err != nil {
+		listener.Close()
+		return err
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(host.handle)}
+	go server.Serve(listener)
+
+	host.mutex.Lock()
+	host.server = server
+	host.sockPath = sockPath
+	host.mutex.Unlock()
+	return nil
+}
+
+// close stops serving calls (in-progress calls continue)
+func (host *hostServer) close() {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	if host.server != nil {
+		host.server.Close()
+		os.Remove(host.sockPath)
+		host.server = nil
+	}
+}
+
+// setCurrent records which invocation calls are made on behalf of
+func (host *hostServer) setCurrent(req *Invocation) {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+	host.current = req
+}
+
+// startCall checks whether the current invocation may make another
+// call, and if so, counts it
+func (host *hostServer) startCall() (caller *Invocation, status int, err error) {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	caller = host.current
+	if caller == nil {
+		return nil, http.StatusConflict, fmt.Errorf("calls may only be made while handling an invocation")
+	}
+
+	if maxDepth := common.Conf.Limits.Max_call_depth; caller.depth+1 > maxDepth {
+		return nil, http.StatusLoopDetected, fmt.Errorf("call depth would exceed %d (limits.max_call_depth)", maxDepth)
+	}
+
+	maxCalls := host.linst.maxCalls
+	if maxCalls == 0 {
+		maxCalls = common.Conf.Limits.Max_calls
+	}
+	if maxCalls > 0 && caller.calls >= maxCalls {
+		return nil, http.StatusTooManyRequests, fmt.Errorf("invocation already made %d calls (its limit)", maxCalls)
+	}
+	caller.calls++
+
+	return caller, 0, nil
+}
+
+// handle serves a call from the sandbox by invoking the callee
+// through the LambdaMgr
+func (host *hostServer) handle(w http.ResponseWriter, r *http.Request) {
+	f := host.linst.lfunc
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] != "run" || parts[1] == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("expected a request to /run/<lambda>\n"))
+		return
+	}
+	callee := parts[1]
+
+	caller, status, err := host.startCall()
+	if err != nil {
+		f.logger().With("callee", callee).Warnf("rejected call: %v", err)
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	internalCallsMetric.With(f.name, callee).Inc()
+
+	// the callee's deadline can't be later than the caller's
+	remaining := time.Until(caller.deadline)
+	if remaining <= 0 {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write([]byte("caller's deadline has already passed\n"))
+		return
+	}
+	timeout := remaining
+	if ms, err := strconv.Atoi(r.Header.Get(TIMEOUT_HEADER)); err == nil && ms > 0 {
+		if requested := time.Duration(ms) * time.Millisecond; requested < timeout {
+			timeout = requested
+		}
+	}
+
+	// the call is part of the caller's trace
+	span := common.StartSpan("call "+callee, caller.span, common.SPAN_CLIENT)
+	span.SetAttr("lambda", f.name)
+	span.SetAttr("callee", callee)
+	unbind := span.Bind()
+	defer func() {
+		unbind()
+		span.End()
+	}()
+
+	// the callee sees the same path it would if called through the
+	// worker's /run/ endpoint
+	ctx := context.WithValue(r.Context(), callDepthKey{}, caller.depth+1)
+	callReq := ForwardRequest(r.WithContext(ctx), "/run/"+callee)
+	callReq.Header.Set(TIMEOUT_HEADER, strconv.Itoa(common.Max(int(timeout.Milliseconds()), 1)))
+	callReq.Header.Set(CALLER_HEADER, f.name)
+	callReq.Header.Del(REQUEST_ID_HEADER)
+	if span == nil && caller.traceparent != "" {
+		callReq.Header.Set(common.TRACEPARENT_HEADER, caller.traceparent)
+	}
+
+	f.logger().With("request", caller.id, "callee", callee).Debugf("calling lambda (depth %d)", caller.depth+1)
+	f.lmgr.Invoke(callee, w, callReq)
+}
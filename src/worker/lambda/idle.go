@@ -0,0 +1,97 @@
+package lambda
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/worker/sandbox"
+)
+
+// idle instances
+//
+// Once its queue is empty, an instance keeps its sandbox running for
+// idle_grace_ms (so a steady trickle of invocations doesn't pay for a
+// pause and unpause each time), then pauses it.  Once it has been idle
+// for idle_ttl_sec, the instance destroys the sandbox, returning its
+// memory to the pool (the next invocation creates a new one).  Warm
+// instances (see prewarm.go) keep their paused sandboxes regardless of
+// the TTL.
+
+// idleGrace is how long an idle sandbox stays unpaused, given the
+// lambda's own idle_grace_ms (0 means the worker's)
+func idleGrace(lambdaMs int) time.Duration {
+	ms := common.Conf.Limits.Idle_grace_ms
+	if lambdaMs > 0 {
+		ms = lambdaMs
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// idleTTL is how long an idle sandbox is kept at all (0 means until
+// it is evicted), given the lambda's own idle_ttl_sec (0 means the
+// worker's)
+func idleTTL(lambdaSec int) time.Duration {
+	sec := common.Conf.Limits.Idle_ttl_sec
+	if lambdaSec > 0 {
+		sec = lambdaSec
+	}
+	return time.Duration(sec) * time.Second
+}
+
+func (linst *LambdaInstance) idleGrace() time.Duration {
+	return idleGrace(linst.idleGraceMs)
+}
+
+func (linst *LambdaInstance) idleTTL() time.Duration {
+	return idleTTL(linst.idleTtlSec)
+}
+
+// idleWait is how much longer a sandbox, idle since idleSince, should
+// be left as it is: unpaused (then paused), or paused (then
+// destroyed).  It returns false if it should be left as it is
+// indefinitely.
+func (linst *LambdaInstance) idleWait(paused bool, keepWarm bool, idleSince time.Time) (time.Duration, bool) {
+	var limit time.Duration
+	if !paused {
+		limit = linst.idleGrace()
+	} else if ttl := linst.idleTTL(); ttl > 0 && !keepWarm {
+		limit = ttl
+	} else {
+		return 0, false
+	}
+
+	if wait := limit - time.Since(idleSince); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// pauseSandbox pauses an idle sandbox, returning nil if it had to be
+// discarded instead
+func (linst *LambdaInstance) pauseSandbox(sb sandbox.Sandbox) sandbox.Sandbox {
+	f := linst.lfunc
+
+	if err := sb.Pause(); err != nil {
+		f.logger().With("sandbox", sb.ID()).Warnf("discard sandbox due to Pause error: %v", err)
+		linst.state.set("", false)
+		return nil
+	}
+
+	atomic.AddInt64(&f.pauses, 1)
+	pausesMetric.With(f.name).Inc()
+	linst.state.set(sb.ID(), true)
+	return sb
+}
+
+// expireSandbox destroys a sandbox that has been idle for the TTL
+func (linst *LambdaInstance) expireSandbox(sb sandbox.Sandbox) {
+	f := linst.lfunc
+
+	f.logger().With("sandbox", sb.ID()).Debugf("destroy sandbox idle for %v", linst.idleTTL())
+	sb.Destroy("idle for longer than idle_ttl_sec")
+
+	atomic.AddInt64(&f.idleDestroys, 1)
+	idleDestroysMetric.With(f.name).Inc()
+	linst.state.set("", false)
+}
@@ -0,0 +1,232 @@
+package lambda
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// admin operations on individual lambdas: refreshing code, killing
+// instances, disabling, and unloading
+
+// how often to look for idle lambdas to unload
+const UNLOAD_CHECK_INTERVAL = 10 * time.Second
+
+var ErrNotLoaded = errors.New("lambda is not loaded on this worker")
+var ErrLambdaBusy = errors.New("lambda has invocations in progress")
+
+// enter registers an invocation that is about to be sent to the
+// function's Task.  It returns false if the function has been
+// unloaded (so its Task is gone), in which case the caller should
+// get a fresh LambdaFunc from the LambdaMgr.
+func (f *LambdaFunc) enter() bool {
+	f.lmgr.mapMutex.Lock()
+	defer f.lmgr.mapMutex.Unlock()
+
+	if f.unloaded {
+		return false
+	}
+	f.users++
+	return true
+}
+
+// exit is called once an invocation that entered is done
+func (f *LambdaFunc) exit() {
+	f.lmgr.mapMutex.Lock()
+	defer f.lmgr.mapMutex.Unlock()
+
+	f.users--
+	f.lastUsed = time.Now()
+}
+
+// Refresh forgets the code cached for the named lambda, so it is
+// pulled again (into a new directory) on the next invocation.
+// Instances running the old code are replaced at that point.
+func (mgr *LambdaMgr) Refresh(name string) {
+	mgr.HandlerPuller.Reset(name)
+
+	if f := mgr.Lookup(name); f != nil {
+		done := make(chan bool)
+		select {
+		case f.refreshChan <- done:
+			<-done
+		case <-f.exited:
+			// unloaded meanwhile, which also forgets the code
+		}
+	}
+
+	lambdaLog.With("lambda", name).Infof("refreshed code")
+}
+
+// Quiesce kills every instance of the named lambda, returning how
+// many there were.  Each instance first finishes the invocation it
+// is running (if any); queued invocations are served by new
+// instances, which get sandboxes only when they are needed.
+func (mgr *LambdaMgr) Quiesce(name string) (int, error) {
+	f := mgr.Lookup(name)
+	if f == nil {
+		return 0, ErrNotLoaded
+	}
+
+	reply := make(chan int)
+	select {
+	case f.quiesceChan <- reply:
+	case <-f.exited:
+		return 0, ErrNotLoaded
+	}
+	killed := <-reply
+
+	f.logger().Infof("quiesced %d instances", killed)
+	return killed, nil
+}
+
+// Disable makes invocations of the named lambda fail (with a 503)
+// until Enable is called, or for the given duration (if positive).
+// The lambda need not be loaded, and stays disabled if unloaded.
+func (mgr *LambdaMgr) Disable(name string, duration time.Duration) {
+	mgr.mapMutex.Lock()
+	defer mgr.mapMutex.Unlock()
+
+	until := time.Time{}
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	mgr.disabled[name] = until
+
+	lambdaLog.With("lambda", name).Infof("disabled (for %v)", duration)
+}
+
+// Enable undoes Disable, returning whether the lambda was disabled
+func (mgr *LambdaMgr) Enable(name string) bool {
+	mgr.mapMutex.Lock()
+	defer mgr.mapMutex.Unlock()
+
+	_, ok := mgr.disabledUntil(name)
+	delete(mgr.disabled, name)
+
+	if ok {
+		lambdaLog.With("lambda", name).Infof("enabled")
+	}
+	return ok
+}
+
+// disabledUntil tells whether name is disabled, and until when (zero
+// if until enabled).  Caller must hold mapMutex.
+func (mgr *LambdaMgr) disabledUntil(name string) (until time.Time, ok bool) {
+	until, ok = mgr.disabled[name]
+	if ok && !until.IsZero() && time.Now().After(until) {
+		delete(mgr.disabled, name)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+// Disabled is the thread-safe version of disabledUntil.  Versions of
+// a lambda (name@version) are disabled along with it.
+func (mgr *LambdaMgr) Disabled(name string) (until time.Time, ok bool) {
+	mgr.mapMutex.Lock()
+	defer mgr.mapMutex.Unlock()
+
+	if until, ok = mgr.disabledUntil(name); !ok && isVersioned(name) {
+		until, ok = mgr.disabledUntil(baseLambdaName(name))
+	}
+	return until, ok
+}
+
+// Unload kills the named lambda's instances, deletes its code, and
+// forgets it entirely (the next invocation starts from scratch, as
+// if it had never been invoked).  This fails with ErrLambdaBusy if
+// invocations are in progress.
+func (mgr *LambdaMgr) Unload(name string) error {
+	return mgr.unload(name, 0)
+}
+
+// unload only if the lambda has been idle for at least minIdle
+func (mgr *LambdaMgr) unload(name string, minIdle time.Duration) error {
+	mgr.mapMutex.Lock()
+	f := mgr.lfuncMap[name]
+	if f == nil {
+		mgr.mapMutex.Unlock()
+		return ErrNotLoaded
+	}
+	if f.users > 0 || time.Since(f.lastUsed) < minIdle {
+		mgr.mapMutex.Unlock()
+		return ErrLambdaBusy
+	}
+
+	f.unloaded = true
+	delete(mgr.lfuncMap, name)
+
+	// while still holding the lock, so that a new LambdaFunc
+	// by the same name can't be handed the code dir we are
+	// about to delete
+	mgr.HandlerPuller.Reset(name)
+	mgr.mapMutex.Unlock()
+
+	f.Kill()
+
+	// Task has exited, so its fields are safe to read.  Instances
+	// that were retiring during an update (which the Task moved
+	// back to instances to kill them) may be on older code.
+	codeDirs := map[string]bool{}
+	if f.codeDir != "" {
+		codeDirs[f.codeDir] = true
+	}
+	for _, instances := range []*list.List{f.instances, f.retiring} {
+		for el := instances.Front(); el != nil; el = el.Next() {
+			codeDirs[el.Value.(*LambdaInstance).codeDir] = true
+		}
+	}
+	for codeDir := range codeDirs {
+		if err := os.RemoveAll(codeDir); err != nil {
+			f.logger().Warnf("could not delete %s while unloading: %v", codeDir, err)
+		}
+	}
+
+	common.DeleteMetrics("lambda", name)
+
+	f.logger().Infof("unloaded")
+	return nil
+}
+
+// unloadIdleTask periodically unloads lambdas that haven't been
+// invoked for Limits.Unload_idle_sec (except those keeping sandboxes
+// ready), until stopUnloader is closed
+func (mgr *LambdaMgr) unloadIdleTask() {
+	defer close(mgr.unloaderDone)
+
+	ticker := time.NewTicker(UNLOAD_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-mgr.stopUnloader:
+			return
+		}
+
+		idle := time.Duration(common.Conf.Limits.Unload_idle_sec) * time.Second
+		if idle <= 0 {
+			continue
+		}
+
+		names := []string{}
+		mgr.mapMutex.Lock()
+		for name, f := range mgr.lfuncMap {
+			if f.users == 0 && atomic.LoadInt32(&f.keepLoaded) == 0 && time.Since(f.lastUsed) > idle {
+				names = append(names, name)
+			}
+		}
+		mgr.mapMutex.Unlock()
+
+		// unload checks again, in case any were invoked
+		// since we looked
+		for _, name := range names {
+			mgr.unload(name, idle)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package lambda
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/worker/sandbox"
+)
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// LambdaConfig holds per-lambda settings, read from an optional
+// ol.yaml or ol.json file at the top of the lambda's code directory.
+// Any field left unset (zero) falls back to the worker-wide default
+// in common.Conf.Limits.
+type LambdaConfig struct {
+	// memory limit of each sandbox
+	Memory_mb int `json:"memory_mb" yaml:"memory_mb"`
+
+	// percent of a core each sandbox can use per period
+	CPU_percent int `json:"cpu_percent" yaml:"cpu_percent"`
+
+	// how many seconds may a single invocation run?
+	Max_runtime int `json:"max_runtime" yaml:"max_runtime"`
+
+	// how many processes can be created within each sandbox?
+	Procs int `json:"procs" yaml:"procs"`
+
+	// environment variables visible to the handler
+	Environment map[string]string `json:"environment" yaml:"environment"`
+
+	// upper bound on how many instances the autoscaler will start,
+	// and how many instances keep a sandbox ready even when idle
+	Max_instances int `json:"max_instances" yaml:"max_instances"`
+	Min_instances int `json:"min_instances" yaml:"min_instances"`
+
+	// how many invocations may wait for an instance, and for how
+	// many milliseconds (at most limits.max_queued, which sizes
+	// the queue)
+	Max_queued   int `json:"max_queued" yaml:"max_queued"`
+	Max_queue_ms int `json:"max_queue_ms" yaml:"max_queue_ms"`
+
+	// how long idle sandboxes stay unpaused, and how long they are
+	// kept at all
+	Idle_grace_ms int `json:"idle_grace_ms" yaml:"idle_grace_ms"`
+	Idle_ttl_sec  int `json:"idle_ttl_sec" yaml:"idle_ttl_sec"`
+
+	// autoscaling policy and tuning (overrides the worker's
+	// "scaling" config, field by field)
+	Scaling common.ScalingConfig `json:"scaling" yaml:"scaling"`
+
+	// how many other lambdas may each invocation call?
+	Max_calls int `json:"max_calls" yaml:"max_calls"`
+
+	// when the worker should invoke the lambda on its own
+	Schedules []LambdaSchedule `json:"schedules" yaml:"schedules"`
+}
+
+// LambdaSchedule is a cron schedule declared by the lambda itself
+type LambdaSchedule struct {
+	// optional; the schedule's ID is "<lambda>:<name>" (or
+	// "<lambda>:<n>" for the nth schedule, if unnamed)
+	Name string `json:"name" yaml:"name"`
+
+	// when to run, e.g., "*/15 * * * *" or "@daily"
+	Cron string `json:"cron" yaml:"cron"`
+
+	// passed to the lambda as the "detail" of the event
+	Event any `json:"event" yaml:"event"`
+}
+
+// LoadLambdaConfig parses ol.yaml or ol.json in codeDir (if either
+// exists), and checks that the settings are usable on this worker
+func LoadLambdaConfig(codeDir string) (*LambdaConfig, error) {
+	conf := &LambdaConfig{}
+
+	var found []string
+	for _, name := range []string{"ol.yaml", "ol.json"} {
+		path := filepath.Join(codeDir, name)
+		b, err := ioutil.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// having a config file is optional
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found = append(found, name)
+
+		if filepath.Ext(name) == ".yaml" {
+			dec := yaml.NewDecoder(bytes.NewReader(b))
+			dec.KnownFields(true)
+			err = dec.Decode(conf)
+		} else {
+			dec := json.NewDecoder(bytes.NewReader(b))
+			dec.DisallowUnknownFields()
+			err = dec.Decode(conf)
+		}
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not parse %s: %v", name, err)
+		}
+	}
+
+	if len(found) > 1 {
+		return nil, fmt.Errorf("lambda may have ol.yaml or ol.json, but not both")
+	}
+
+	if err := conf.check(); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+func (conf *LambdaConfig) check() error {
+	if conf.Memory_mb < 0 || conf.CPU_percent < 0 || conf.Max_runtime < 0 || conf.Procs < 0 || conf.Max_instances < 0 || conf.Min_instances < 0 || conf.Max_calls < 0 ||
+		conf.Max_queued < 0 || conf.Max_queue_ms < 0 || conf.Idle_grace_ms < 0 || conf.Idle_ttl_sec < 0 {
+		return fmt.Errorf("lambda config values may not be negative")
+	}
+
+	// same reasoning as in common.checkConf: the evictor needs
+	// room for at least two sandboxes
+	if common.Conf.Sandbox == "sock" && 2*conf.Memory_mb > common.Conf.Mem_pool_mb {
+		return fmt.Errorf("memory_mb of %d is too large for a %d MB memory pool", conf.Memory_mb, common.Conf.Mem_pool_mb)
+	}
+
+	if err := conf.Scaling.Check(); err != nil {
+		return err
+	}
+
+	for name := range conf.Environment {
+		if !envNameRegex.MatchString(name) {
+			return fmt.Errorf("bad environment variable name '%s'", name)
+		}
+	}
+
+	ids := map[string]bool{}
+	for _, spec := range conf.scheduleSpecs("lambda") {
+		if err := spec.Check(); err != nil {
+			return err
+		} else if ids[spec.ID] {
+			return fmt.Errorf("schedule name '%s' is used more than once", spec.ID)
+		}
+		ids[spec.ID] = true
+	}
+
+	return nil
+}
+
+// scheduleSpecs converts the lambda's schedules for the Scheduler
+// (which adds the "<lambda>:" prefix to IDs)
+func (conf *LambdaConfig) scheduleSpecs(lambda string) []common.ScheduleSpec {
+	specs := []common.ScheduleSpec{}
+	for i, sched := range conf.Schedules {
+		id := sched.Name
+		if id == "" {
+			id = fmt.Sprintf("%d", i)
+		}
+		specs = append(specs, common.ScheduleSpec{
+			ID:     id,
+			Lambda: lambda,
+			Cron:   sched.Cron,
+			Event:  sched.Event,
+		})
+	}
+	return specs
+}
+
+// applyTo copies the sandbox-level settings into meta
+func (conf *LambdaConfig) applyTo(meta *sandbox.SandboxMeta) {
+	meta.MemLimitMB = conf.Memory_mb
+	meta.CPUPercent = conf.CPU_percent
+	meta.MaxRuntimeSec = conf.Max_runtime
+	meta.Procs = conf.Procs
+	meta.Env = conf.Environment
+}
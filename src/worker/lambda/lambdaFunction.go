@@ -3,13 +3,14 @@ package lambda
 import (
 	"bufio"
 	"container/list"
+	"context"
 	"errors"
-	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
@@ -28,6 +29,7 @@ type LambdaFunc struct {
 	lastPull *time.Time
 	codeDir  string
 	meta     *sandbox.SandboxMeta
+	conf     *LambdaConfig
 
 	// lambda execution
 	funcChan  chan *Invocation // server to func
@@ -38,32 +40,237 @@ type LambdaFunc struct {
 	// send chan to the kill chan to destroy the instance, then
 	// wait for msg on sent chan to block until it is done
 	killChan chan chan bool
+
+	// send a chan here to receive a snapshot of the function's state
+	statusChan chan chan *LambdaStatus
+
+	// admin operations (see lambdaAdmin.go): send a chan, then
+	// wait for a reply on it
+	refreshChan chan chan bool
+	quiesceChan chan chan int
+
+	// send a chan here to have the function pull its code and
+	// get sandboxes ready; the reply comes once they are
+	prewarmChan chan chan error
+
+	// instances on replaced code, which are retired as instances
+	// on the new code get ready, and how many instances the update
+	// aims for (see rollout.go).  Only used by the Task.
+	retiring      *list.List
+	rolloutTarget int
+
+	// instances on the new code tell the Task here once they are
+	// ready (buffered, so wakeups coalesce)
+	rolloutChan chan bool
+
+	// closed when Task exits
+	exited chan bool
+
+	// the last failed refresh of the code, and how many there have
+	// been (see refresh.go)
+	refreshError    *codeRefresh
+	refreshFailures int
+
+	// was the function prewarmed?  (then it keeps at least one
+	// sandbox ready)
+	prewarmed bool
+
+	// invocations rejected by admission control (accessed
+	// atomically)
+	queueFull     int64
+	queueTimeouts int64
+
+	// invocations cancelled by their clients (accessed atomically;
+	// see cancel.go)
+	cancelled int64
+
+	// sandboxes paused, invocations served by sandboxes still
+	// running in their idle grace period, and sandboxes destroyed
+	// for being idle (accessed atomically; see idle.go)
+	pauses       int64
+	graceHits    int64
+	idleDestroys int64
+
+	// invocations in progress (between enter and exit), when the
+	// last one finished, and whether the function has been
+	// unloaded.  Protected by lmgr.mapMutex.
+	users    int
+	lastUsed time.Time
+	unloaded bool
+
+	// lambdas that keep sandboxes ready aren't unloaded when idle
+	// (set by Task, accessed atomically: 1 means keep)
+	keepLoaded int32
+}
+
+// clients may ask for a shorter (but never longer) deadline than
+// the lambda is allowed by passing this header
+const TIMEOUT_HEADER = "X-OL-Timeout-Ms"
+
+// identifies an invocation in the logs.  Taken from the request if
+// the client (or a proxy) set it, otherwise generated; either way it
+// is passed on to the lambda and echoed in the response.
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+var lambdaLog = common.NewLogger("lambda")
+
+// ForwardRequest returns a copy of r to be sent to a lambda, with
+// prefix removed from the front of the path.  The query string and
+// method are preserved, and the stripped prefix is passed along in
+// the X-Forwarded-Prefix header (e.g., so a WSGI app can generate
+// external URLs).
+func ForwardRequest(r *http.Request, prefix string) *http.Request {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+
+	fwd := r.Clone(r.Context())
+	fwd.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	fwd.URL.RawPath = ""
+	fwd.RequestURI = rest
+	if r.URL.RawQuery != "" {
+		fwd.RequestURI += "?" + r.URL.RawQuery
+	}
+
+	if prefix != "" {
+		fwd.Header.Set("X-Forwarded-Prefix", prefix)
+	}
+	return fwd
 }
 
 func (f *LambdaFunc) Invoke(w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
 	t := common.T0("LambdaFunc.Invoke")
 	defer t.T1()
 
+	// f may have been unloaded since the caller got it, in which
+	// case a new LambdaFunc takes over
+	for !f.enter() {
+		f = f.lmgr.Get(f.name)
+	}
+	defer f.exit()
+
+	invocationsMetric.With(f.name).Inc()
+	sw := &statusRecorder{ResponseWriter: w}
+	w = sw
+	span := t.Span()
+	defer func() {
+		if sw.statusCode == 0 {
+			sw.statusCode = http.StatusOK
+		}
+		responsesMetric.With(f.name, strconv.Itoa(sw.statusCode)).Inc()
+		latencyMetric.With(f.name).Observe(time.Since(t0).Seconds())
+
+		span.SetAttr("http.status_code", sw.statusCode)
+		if sw.statusCode >= 500 {
+			span.SetError(http.StatusText(sw.statusCode))
+		}
+	}()
+
 	done := make(chan bool)
-	req := &Invocation{w: w, r: r, done: done}
+	req := &Invocation{w: w, r: r, done: done, arrival: t0, span: span}
+
+	// set if another lambda made this call (see hostServer)
+	if depth, ok := r.Context().Value(callDepthKey{}).(int); ok {
+		req.depth = depth
+	}
+
+	// pass on the trace context, even if we aren't recording spans
+	req.traceparent = r.Header.Get(common.TRACEPARENT_HEADER)
+	if span != nil {
+		req.traceparent = span.Context().Traceparent()
+	}
+
+	req.id = r.Header.Get(REQUEST_ID_HEADER)
+	if req.id == "" {
+		id, err := newInvocationID()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("could not generate request ID\n"))
+			return
+		}
+		req.id = id
+		r.Header.Set(REQUEST_ID_HEADER, id)
+	}
+	w.Header().Set(REQUEST_ID_HEADER, req.id)
+
+	// cancelled if the client goes away, or by ID (see cancel.go)
+	req.keyID = common.AuthKeyID(r.Context())
+	req.lambda = f.name
+	req.ctx, req.cancel = context.WithCancel(r.Context())
+	defer req.cancel()
+	f.lmgr.track(req)
+	defer f.lmgr.untrack(req)
+
+	span.SetAttr("lambda", f.name)
+	span.SetAttr("request_id", req.id)
+
+	if until, disabled := f.lmgr.Disabled(f.name); disabled {
+		if !until.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("lambda is disabled\n"))
+		return
+	}
+
+	if val := r.Header.Get(TIMEOUT_HEADER); val != "" {
+		ms, err := strconv.Atoi(val)
+		if err != nil || ms <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(TIMEOUT_HEADER + " must be a positive number of milliseconds\n"))
+			return
+		}
+		req.requestedTimeout = time.Duration(ms) * time.Millisecond
+	}
 
 	// send invocation to lambda func task, if room in queue
 	select {
 	case f.funcChan <- req:
-		// block until it's done
-		<-done
+		// block until it's done (or cancelled before an
+		// instance claims it, in which case the instance that
+		// takes it from the queue returns it unserved)
+		select {
+		case <-done:
+		case <-req.ctx.Done():
+			if req.abandon() {
+				f.sendCancelled(req, CANCELLED_QUEUED)
+				return
+			}
+			// an instance is serving it, and will stop
+			<-done
+		}
 	default:
 		// queue cannot accept more, so reply with backoff
-		req.w.WriteHeader(http.StatusTooManyRequests)
-		req.w.Write([]byte("lambda function queue is full\n"))
+		f.reject(req, http.StatusTooManyRequests, REJECT_QUEUE_FULL, 1, "lambda function queue is full")
 	}
 }
 
 // add function name to each log message so we know which logs
 // correspond to which LambdaFuncs
+func (f *LambdaFunc) logger() *common.Logger {
+	return lambdaLog.With("lambda", f.name)
+}
+
 func (f *LambdaFunc) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [FUNC %s]", strings.TrimRight(msg, "\n"), f.name)
+	f.logger().Infof(format, args...)
+}
+
+// timeout returns how long an invocation may take, counting from
+// its arrival: the lambda's max_runtime (or the worker default),
+// possibly lowered by what the client requested
+func (f *LambdaFunc) timeout(requested time.Duration) time.Duration {
+	maxSec := common.Conf.Limits.Max_runtime_default
+	if f.conf != nil && f.conf.Max_runtime > 0 {
+		maxSec = f.conf.Max_runtime
+	}
+
+	timeout := time.Duration(maxSec) * time.Second
+	if requested > 0 && requested < timeout {
+		timeout = requested
+	}
+	return timeout
 }
 
 // parseMeta reads in a requirements.txt file that was built from pip-compile
@@ -96,35 +303,29 @@ func parseMeta(codeDir string) (meta *sandbox.SandboxMeta, err error) {
 	return meta, nil
 }
 
-// if there is any error:
-// 1. we won't switch to the new code
-// 2. we won't update pull time (so well check for a fix next time)
-func (f *LambdaFunc) pullHandlerIfStale() (err error) {
-	// check if there is newer code, download it if necessary
-	now := time.Now()
-	cacheNs := int64(common.Conf.Registry_cache_ms) * 1000000
-
-	// should we check for new code?
-	if f.lastPull != nil && int64(now.Sub(*f.lastPull)) < cacheNs {
-		return nil
-	}
-
+// prepareCode pulls the lambda's code, and if it differs from the
+// code in curDir, gets it ready to run (reading its config, and
+// installing its packages).  It returns nil if the code hasn't
+// changed.  If there is any error, the new code is discarded (the
+// caller keeps the current code, if any).
+//
+// This only reads fields that don't change, so it may run outside
+// the function's Task (see refresh.go).
+func (f *LambdaFunc) prepareCode(curDir string) (code *lambdaCode, err error) {
 	// is there new code?
 	rtType, codeDir, err := f.lmgr.HandlerPuller.Pull(f.name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if codeDir == f.codeDir {
-		return nil
+	if codeDir == curDir {
+		return nil, nil
 	}
 
-	f.rtType = rtType
-
 	defer func() {
 		if err != nil {
 			if err := os.RemoveAll(codeDir); err != nil {
-				log.Printf("could not cleanup %s after failed pull\n", codeDir)
+				f.logger().Warnf("could not cleanup %s after failed pull", codeDir)
 			}
 
 			if rtType == common.RT_PYTHON {
@@ -137,31 +338,44 @@ func (f *LambdaFunc) pullHandlerIfStale() (err error) {
 		}
 	}()
 
+	// per-lambda settings (memory, timeouts, etc) apply to every runtime
+	conf, err := LoadLambdaConfig(codeDir)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &sandbox.SandboxMeta{}
 	if rtType == common.RT_PYTHON {
 		// inspect new code for dependencies; if we can install
 		// everything necessary, start using new code
-		meta, err := parseMeta(codeDir)
+		meta, err = parseMeta(codeDir)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// make sure all specified dependencies are installed
 		// (but don't recursively find others)
 		for _, pkg := range meta.Installs {
 			if _, err := f.lmgr.PackagePuller.GetPkg(pkg); err != nil {
-				return err
+				return nil, err
 			}
 		}
 
 		f.lmgr.DepTracer.TraceFunction(codeDir, meta.Installs)
-		f.meta = meta
 	} else if rtType == common.RT_NATIVE {
-		log.Printf("Got native function")
+		f.logger().Debugf("got native function")
 	}
 
-	f.codeDir = codeDir
-	f.lastPull = &now
-	return nil
+	// versions don't have their own schedules (a schedule may
+	// invoke an alias instead)
+	if f.lmgr.Scheduler != nil && !isVersioned(f.name) {
+		if err := f.lmgr.SetLambdaSchedules(f.name, conf.scheduleSpecs(f.name)); err != nil {
+			return nil, err
+		}
+	}
+
+	conf.applyTo(meta)
+	return &lambdaCode{rtType: rtType, codeDir: codeDir, meta: meta, conf: conf}, nil
 }
 
 // this Task receives lambda requests, fetches new lambda code as
@@ -181,9 +395,11 @@ func (f *LambdaFunc) pullHandlerIfStale() (err error) {
 // 4. Invocation.done
 //
 // If either LambdaFunc.funcChan or LambdaFunc.instChan is full, we
-// respond to the client with a backoff message: StatusTooManyRequests
+// respond to the client with a backoff message: StatusTooManyRequests.
+// Invocations that wait too long in instChan get StatusServiceUnavailable
+// (see admission.go).
 func (f *LambdaFunc) Task() {
-	f.printf("debug: LambdaFunc.Task() runs on goroutine %d", common.GetGoroutineID())
+	f.logger().Debugf("LambdaFunc.Task() runs on goroutine %d", common.GetGoroutineID())
 
 	// we want to perform various cleanup actions, such as killing
 	// instances and deleting old code.  We want to do these
@@ -211,7 +427,7 @@ func (f *LambdaFunc) Task() {
 			switch op := msg.(type) {
 			case string:
 				if err := os.RemoveAll(op); err != nil {
-					f.printf("Async code cleanup could not delete %s, even after all instances using it killed: %v", op, err)
+					f.logger().Warnf("Async code cleanup could not delete %s, even after all instances using it killed: %v", op, err)
 				}
 			case chan bool:
 				<-op
@@ -219,10 +435,67 @@ func (f *LambdaFunc) Task() {
 		}
 	}()
 
+	// switch to new code
+	useCode := func(code *lambdaCode) {
+		oldCodeDir := f.codeDir
+		f.rtType = code.rtType
+		f.codeDir = code.codeDir
+		f.meta = code.meta
+		f.conf = code.conf
+
+		// instances on the old code are replaced gradually
+		// (see rollout.go), and the old code is deleted after
+		// the last of them exits
+		f.startRollout()
+		if oldCodeDir != "" && !f.codeDirInUse(oldCodeDir) {
+			cleanupChan <- oldCodeDir
+		}
+	}
+
+	// checks for new code (other than the first) run in the
+	// background, one at a time, and report here (see refresh.go)
+	refreshing := false
+	refreshDone := make(chan *codeRefresh, 1)
+
+	// check for new code if it may be stale.  Only an error
+	// loading the first code is returned (later ones are
+	// recorded by the refresh).
+	checkCode := func() error {
+		if refreshing || !f.codeStale() {
+			return nil
+		}
+
+		now := time.Now()
+		if f.codeDir == "" {
+			// nothing to serve until we have code, so
+			// wait for it
+			code, err := f.prepareCode("")
+			if err != nil {
+				return err
+			}
+			useCode(code)
+			f.lastPull = &now
+			return nil
+		}
+
+		refreshing = true
+		go func(curDir string) {
+			t := common.T0("LambdaFunc-RefreshCode")
+			code, err := f.prepareCode(curDir)
+			t.T1()
+			refreshDone <- &codeRefresh{code: code, err: err, started: now}
+		}(f.codeDir)
+		return nil
+	}
+
+	// prewarm requests waiting for warm instances
+	prewarmReplies := []chan error{}
+
 	// stats for autoscaling
 	outstandingReqs := 0
 	execMs := common.NewRollingAvg(10)
-	var lastScaling *time.Time
+	queueMs := common.NewRollingAvg(10)
+	scaler := &autoscaler{}
 	timeout := time.NewTimer(0)
 
 	for {
@@ -233,57 +506,145 @@ func (f *LambdaFunc) Task() {
 			}
 		case req := <-f.funcChan:
 			// msg: client -> function
+			scaler.arrived()
 
-			// check for new code, and cleanup old code
-			// (and instances that use it) if necessary
-			oldCodeDir := f.codeDir
-			if err := f.pullHandlerIfStale(); err != nil {
-				f.printf("Error checking for new lambda code at `%s`: %v", f.codeDir, err)
-				req.w.WriteHeader(http.StatusInternalServerError)
-				req.w.Write([]byte(err.Error() + "\n"))
-				req.done <- true
+			// cancelled while waiting for the Task (see
+			// cancel.go)
+			if req.abandoned() {
 				continue
 			}
 
-			if oldCodeDir != "" && oldCodeDir != f.codeDir {
-				el := f.instances.Front()
-				for el != nil {
-					waitChan := el.Value.(*LambdaInstance).AsyncKill()
-					cleanupChan <- waitChan
-					el = el.Next()
+			if err := checkCode(); err != nil {
+				f.logger().With("request", req.id).Errorf("Error checking for new lambda code at `%s`: %v", f.codeDir, err)
+				if req.claim() {
+					req.w.WriteHeader(http.StatusInternalServerError)
+					req.w.Write([]byte(err.Error() + "\n"))
+					req.done <- true
 				}
-				f.instances = list.New()
-
-				// cleanupChan is a FIFO, so this will
-				// happen after the cleanup task waits
-				// for all instance kills to finish
-				cleanupChan <- oldCodeDir
+				continue
 			}
 
 			f.lmgr.DepTracer.TraceInvocation(f.codeDir)
+			req.deadline = req.arrival.Add(f.timeout(req.requestedTimeout))
 
+			retrySec := retryAfterSec(len(f.instChan)+1, f.instances.Len(), execMs.Avg)
+			if len(f.instChan) >= f.maxQueued() {
+				if req.claim() {
+					f.reject(req, http.StatusTooManyRequests, REJECT_QUEUE_FULL, retrySec, "lambda instance queue is full (max_queued)")
+					req.done <- true
+				}
+				continue
+			}
+
+			f.expireQueued(req, retrySec)
 			select {
 			case f.instChan <- req:
 				// msg: function -> instance
 				outstandingReqs++
 			default:
 				// queue cannot accept more, so reply with backoff
-				req.w.WriteHeader(http.StatusTooManyRequests)
-				req.w.Write([]byte("lambda instance queue is full\n"))
-				req.done <- true
+				if req.claim() {
+					f.reject(req, http.StatusTooManyRequests, REJECT_QUEUE_FULL, retrySec, "lambda instance queue is full")
+					req.done <- true
+				}
 			}
 		case req := <-f.doneChan:
 			// msg: instance -> function
+			outstandingReqs--
 
+			// abandoned invocations were never served, and the
+			// client already got its response
+			if req.abandoned() {
+				break
+			}
 			execMs.Add(req.execMs)
-			outstandingReqs--
+			queueMs.Add(int(req.queueMs))
+			common.RecordMs("LambdaFunc-QueueWait", req.queueMs)
 
 			// msg: function -> client
 			req.done <- true
 
+		case reply := <-f.statusChan:
+			reply <- f.status(outstandingReqs, execMs.Avg, queueMs.Avg, refreshing)
+			continue
+
+		case refresh := <-refreshDone:
+			refreshing = false
+			f.lastPull = &refresh.started
+			if refresh.err != nil {
+				f.refreshFailed(refresh)
+				continue
+			}
+			f.refreshError = nil
+			if refresh.code == nil {
+				continue
+			}
+			f.logger().Infof("switching to new code at %s", refresh.code.codeDir)
+			useCode(refresh.code)
+
+		case <-f.rolloutChan:
+			// an instance on new code is ready, so an old
+			// one may retire (see rollout.go)
+
+		case reply := <-f.prewarmChan:
+			if err := checkCode(); err != nil {
+				reply <- err
+				continue
+			}
+			// keep at least one sandbox ready, even if
+			// min_instances is 0
+			f.prewarmed = true
+			prewarmReplies = append(prewarmReplies, reply)
+
+		case done := <-f.refreshChan:
+			// check for new code on the next invocation
+			f.lastPull = nil
+			done <- true
+			continue
+
+		case reply := <-f.quiesceChan:
+			waitChans := []chan bool{}
+			for el := f.instances.Front(); el != nil; el = el.Next() {
+				waitChans = append(waitChans, el.Value.(*LambdaInstance).AsyncKill())
+			}
+			oldCodeDirs := map[string]bool{}
+			for el := f.retiring.Front(); el != nil; el = el.Next() {
+				linst := el.Value.(*LambdaInstance)
+				waitChans = append(waitChans, linst.AsyncKill())
+				if linst.codeDir != f.codeDir {
+					oldCodeDirs[linst.codeDir] = true
+				}
+			}
+			f.instances = list.New()
+			f.retiring = list.New()
+			instancesMetric.With(f.name).Set(0)
+
+			// instances finish their current invocations
+			// first, so don't block the Task on them
+			allDone := make(chan bool)
+			go func() {
+				for _, waitChan := range waitChans {
+					<-waitChan
+				}
+				close(allDone)
+				reply <- len(waitChans)
+			}()
+
+			// an update was in progress, so delete the old
+			// code once its instances are gone
+			if len(oldCodeDirs) > 0 {
+				cleanupChan <- allDone
+				for codeDir := range oldCodeDirs {
+					cleanupChan <- codeDir
+				}
+			}
+			continue
+
 		case done := <-f.killChan:
 			// signal all instances to die, then wait for
 			// cleanup task to finish and exit
+			f.instances.PushBackList(f.retiring)
+			f.retiring = list.New()
 			el := f.instances.Front()
 			for el != nil {
 				waitChan := el.Value.(*LambdaInstance).AsyncKill()
@@ -293,87 +654,109 @@ func (f *LambdaFunc) Task() {
 			if f.codeDir != "" {
 				//cleanupChan <- f.codeDir
 			}
+			if refreshing {
+				cleanupChan <- f.discardRefresh(refreshDone)
+			}
 			close(cleanupChan)
 			<-cleanupTaskDone
+			close(f.exited)
 			done <- true
 			return
 		}
 
-		// POLICY: how many instances (i.e., virtual sandboxes) should we allocate?
-
-		// AUTOSCALING STEP 1: decide how many instances we want
-
-		// let's aim to have 1 sandbox per 10ms of outstanding work
-		// TODO make this configurable
-		inProgressWorkMs := outstandingReqs * execMs.Avg
-		desiredInstances := inProgressWorkMs / 10
-
-		// if we have, say, one job that will take 100
-		// seconds, spinning up 100 instances won't do any
-		// good, so cap by number of outstanding reqs
-		if outstandingReqs < desiredInstances {
-			desiredInstances = outstandingReqs
-		}
-
-		// always try to have one instance
-		if desiredInstances < 1 {
-			desiredInstances = 1
+		// code updates move instances to the new code before
+		// the autoscaler resumes (see rollout.go)
+		if f.retiring.Len() > 0 {
+			f.rolloutStep(cleanupChan)
 		}
 
-		// AUTOSCALING STEP 2: tweak how many instances we have, to get closer to our goal
+		queueDepthMetric.With(f.name).Set(float64(len(f.instChan)))
+		outstandingMetric.With(f.name).Set(float64(outstandingReqs))
+		instancesMetric.With(f.name).Set(float64(f.instances.Len() + f.retiring.Len()))
 
-		// make at most one scaling adjustment per 100ms
-		adjustFreq := time.Millisecond * 100
+		// POLICY: how many instances (i.e., virtual sandboxes)
+		// should we allocate?  (see scaling.go)
 		now := time.Now()
-		if lastScaling != nil {
-			elapsed := now.Sub(*lastScaling)
-			if elapsed < adjustFreq {
-				if desiredInstances != f.instances.Len() {
-					timeout = time.NewTimer(adjustFreq - elapsed)
-				}
-				continue
+		var recheck time.Duration
+		if f.retiring.Len() == 0 {
+			load := ScalingLoad{
+				Instances:      f.instances.Len(),
+				Outstanding:    outstandingReqs,
+				Queued:         len(f.instChan),
+				AvgExecMs:      execMs.Avg,
+				ArrivalsPerSec: scaler.arrivalRate(now),
+			}
+			var target int
+			target, recheck = scaler.plan(f.scalingConf(), f.warmInstances(), f.maxInstances(), load, now)
+
+			if f.instances.Len() != target {
+				f.printf("scale instances from %d to %d", f.instances.Len(), target)
+			}
+			for f.instances.Len() < target {
+				f.newInstance(false)
+			}
+			for f.instances.Len() > target {
+				waitChan := f.instances.Back().Value.(*LambdaInstance).AsyncKill()
+				f.instances.Remove(f.instances.Back())
+				cleanupChan <- waitChan
 			}
 		}
 
-		// kill or start at most one instance to get closer to
-		// desired number
-		if f.instances.Len() < desiredInstances {
-			f.printf("increase instances to %d", f.instances.Len()+1)
-			f.newInstance()
-			lastScaling = &now
-		} else if f.instances.Len() > desiredInstances {
-			f.printf("reduce instances to %d", f.instances.Len()-1)
-			waitChan := f.instances.Back().Value.(*LambdaInstance).AsyncKill()
-			f.instances.Remove(f.instances.Back())
-			cleanupChan <- waitChan
-			lastScaling = &now
+		// the first instances keep sandboxes ready (see prewarm.go)
+		if f.warmInstances() > 0 {
+			atomic.StoreInt32(&f.keepLoaded, 1)
+		} else {
+			atomic.StoreInt32(&f.keepLoaded, 0)
+		}
+		warming := f.keepWarm()
+		if len(prewarmReplies) > 0 {
+			replies := prewarmReplies
+			prewarmReplies = []chan error{}
+			go func() {
+				for _, done := range warming {
+					<-done
+				}
+				for _, reply := range replies {
+					reply <- nil
+				}
+			}()
 		}
 
-		if f.instances.Len() != desiredInstances {
-			// we can only adjust quickly, so we want to
-			// run through this loop again as soon as
-			// possible, even if there are no requests to
-			// service.
-			timeout = time.NewTimer(adjustFreq)
+		if recheck > 0 {
+			timeout = time.NewTimer(recheck)
 		}
 	}
 }
 
-func (f *LambdaFunc) newInstance() {
+// newInstance starts an instance on the current code.  If prepare is
+// set, it creates a sandbox before it takes any invocations.
+func (f *LambdaFunc) newInstance(prepare bool) *LambdaInstance {
 	if f.codeDir == "" {
 		panic("cannot start instance until code has been fetched")
 	}
 
 	linst := &LambdaInstance{
 		lfunc:    f,
+		rtType:   f.rtType,
 		codeDir:  f.codeDir,
 		meta:     f.meta,
+		conf:     f.conf,
 		killChan: make(chan chan bool, 1),
+		warmChan: make(chan bool, 2),
+		warmed:   make(chan bool),
+		prepare:  prepare,
+	}
+	if f.conf != nil {
+		linst.maxCalls = f.conf.Max_calls
+		linst.idleGraceMs = f.conf.Idle_grace_ms
+		linst.idleTtlSec = f.conf.Idle_ttl_sec
 	}
+	linst.host = newHostServer(linst)
 
 	f.instances.PushBack(linst)
 
 	go linst.Task()
+	return linst
 }
 
 func (f *LambdaFunc) Kill() {
@@ -1,15 +1,38 @@
 package lambda
 
 import (
+	"context"
+	"errors"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 	"github.com/open-lambda/open-lambda/ol/worker/sandbox"
 )
 
+// how the sandbox serving an invocation was readied, as reported in
+// the X-OL-Start header: already running (serving an earlier
+// request), unpaused, forked from a Zygote, or created from scratch
+const (
+	START_WARM     = "warm"
+	START_UNPAUSED = "unpaused"
+	START_ZYGOTE   = "zygote"
+	START_COLD     = "cold"
+)
+
+// timing headers (see Features.Timing_headers)
+const (
+	START_HEADER      = "X-OL-Start"
+	QUEUE_MS_HEADER   = "X-OL-Queue-Ms"
+	SANDBOX_MS_HEADER = "X-OL-Sandbox-Wait-Ms"
+	EXEC_MS_HEADER    = "X-OL-Exec-Ms"
+)
+
 // This is essentially a virtual sandbox.  It is backed by a real
 // Sandbox (when it is allowed to allocate one).  It pauses/unpauses
 // based on usage, and starts fresh instances when they die.
@@ -17,17 +40,47 @@ type LambdaInstance struct {
 	lfunc *LambdaFunc
 
 	// snapshot of LambdaFunc, at the time the LambdaInstance is created
-	codeDir string
-	meta    *sandbox.SandboxMeta
+	rtType   common.RuntimeType
+	codeDir  string
+	meta     *sandbox.SandboxMeta
+	conf     *LambdaConfig
+	maxCalls int
+
+	// the lambda's own idle settings (0 means the worker's; see
+	// idle.go)
+	idleGraceMs int
+	idleTtlSec  int
+
+	// serves calls the sandbox makes to other lambdas
+	host *hostServer
 
 	// send chan to the kill chan to destroy the instance, then
 	// wait for msg on sent chan to block until it is done
 	killChan chan chan bool
+
+	// sandbox ID and paused state, for introspection
+	state instanceState
+
+	// send true to warmChan to make the instance keep a sandbox
+	// ready (see prewarm.go).  warmed is closed once the first one
+	// is (or the instance gave up, or exited), and warmedOK is then
+	// 1 if it actually created the sandbox (accessed atomically).
+	warmChan chan bool
+	warmed   chan bool
+	warmedOK int32
+
+	// has warmChan been sent to?  (only used by the function's Task)
+	warmRequested bool
+
+	// create a sandbox (and close warmed) before taking any
+	// invocations?  (see rollout.go)
+	prepare bool
 }
 
 // this Task manages a single Sandbox (at any given time), and
 // forwards requests from the function queue to that Sandbox.
-// when there are no requests, the Sandbox is paused.
+// when there are no requests, the Sandbox is paused (after a grace
+// period), and eventually destroyed (see idle.go).
 //
 // These errors are handled as follows by Task:
 //
@@ -40,46 +93,144 @@ func (linst *LambdaInstance) Task() {
 	var sb sandbox.Sandbox
 	var err error
 
+	// is sb paused, and since when has it been idle?
+	paused := false
+	var idleSince time.Time
+
+	// keep a sandbox ready, even without requests?  (until
+	// creating one fails)
+	keepWarm := false
+	warmedClosed := false
+	defer func() {
+		if !warmedClosed {
+			close(linst.warmed)
+		}
+	}()
+
+	// create a sandbox ahead of any request, and tell the
+	// function's Task (through warmed) whether the first one was
+	// created
+	warm := func() {
+		if sb == nil {
+			if sb = linst.warmSandbox(); sb != nil {
+				paused, idleSince = true, time.Now()
+				linst.state.idle(idleSince)
+			}
+		}
+		if !warmedClosed {
+			if sb != nil {
+				atomic.StoreInt32(&linst.warmedOK, 1)
+			}
+			close(linst.warmed)
+			warmedClosed = true
+		}
+	}
+
+	if linst.prepare {
+		warm()
+	}
+
 	for {
+		if keepWarm && sb == nil {
+			if sb = linst.warmSandbox(); sb == nil {
+				keepWarm = false
+			} else {
+				paused, idleSince = true, time.Now()
+				linst.state.idle(idleSince)
+			}
+		}
+
+		// an idle sandbox is paused, then destroyed, if no
+		// request arrives in time
+		var idleTimer *time.Timer
+		var idleExpired <-chan time.Time
+		if sb != nil {
+			if wait, ok := linst.idleWait(paused, keepWarm, idleSince); ok {
+				idleTimer = time.NewTimer(wait)
+				idleExpired = idleTimer.C
+			}
+		}
+
 		// wait for a request (blocking) before making the
 		// Sandbox ready, or kill if we receive that signal
 
 		var req *Invocation
 		select {
 		case req = <-f.instChan:
+			if !linst.takeRequest(req) {
+				req = nil
+			}
+		case <-idleExpired:
+			idleTimer = nil
+			if !paused {
+				sb = linst.pauseSandbox(sb)
+				paused = true
+			} else {
+				linst.expireSandbox(sb)
+				sb = nil
+			}
+		case <-linst.warmChan:
+			warm()
+			keepWarm = sb != nil
 		case killed := <-linst.killChan:
 			if sb != nil {
 				rtLog := sb.GetRuntimeLog()
 				proxyLog := sb.GetProxyLog()
+				sbLog := f.logger().With("sandbox", sb.ID())
 				sb.Destroy("Lambda instance kill signal received")
 
-				log.Printf("Stopped sandbox")
+				sbLog.Infof("Stopped sandbox")
 
 				if common.Conf.Log_output {
 					if rtLog != "" {
-						log.Printf("Runtime output is:")
+						sbLog.Infof("Runtime output is:")
 
 						for _, line := range strings.Split(rtLog, "\n") {
-							log.Printf("   %s", line)
+							sbLog.Infof("   %s", line)
 						}
 					}
 
 					if proxyLog != "" {
-						log.Printf("Proxy output is:")
+						sbLog.Infof("Proxy output is:")
 
 						for _, line := range strings.Split(proxyLog, "\n") {
-							log.Printf("   %s", line)
+							sbLog.Infof("   %s", line)
 						}
 					}
 				}
 			}
+			linst.host.close()
 			killed <- true
 			return
 		}
 
-		t := common.T0("LambdaInstance-WaitSandbox")
-		// if we have a sandbox, try unpausing it to see if it is still alive
+		if idleTimer != nil {
+			idleTimer.Stop()
+		}
+		if req == nil {
+			continue
+		}
+		linst.state.idle(time.Time{})
+
+		// how long sandboxes sit idle between invocations (to
+		// tune the grace period and TTL)
 		if sb != nil {
+			common.RecordMs("LambdaInstance-IdleGap", time.Since(idleSince).Milliseconds())
+		}
+
+		// getting a sandbox ready is recorded in the trace of
+		// the request that needs it
+		unbind := req.span.Bind()
+
+		start := START_UNPAUSED
+		t := common.T0("LambdaInstance-WaitSandbox")
+		if sb != nil && !paused {
+			// still running, within the idle grace period
+			start = START_WARM
+			atomic.AddInt64(&f.graceHits, 1)
+		} else if sb != nil {
+			// if we have a sandbox, try unpausing it to see if it is still alive
+			//
 			// Unpause will often fail, because evictors
 			// are likely to prefer to evict paused
 			// sandboxes rather than inactive sandboxes.
@@ -87,7 +238,7 @@ func (linst *LambdaInstance) Task() {
 			// by just creating a new sandbox.
 			t2 := common.T0("LambdaInstance-WaitSandbox-Unpause")
 			if err := sb.Unpause(); err != nil {
-				f.printf("discard sandbox %s due to Unpause error: %v", sb.ID(), err)
+				f.logger().With("sandbox", sb.ID()).Warnf("discard sandbox due to Unpause error: %v", err)
 				sb = nil
 			}
 			t2.T1()
@@ -96,36 +247,22 @@ func (linst *LambdaInstance) Task() {
 		// if we don't already have a Sandbox, create one, and
 		// HTTP proxy over the channel
 		if sb == nil {
-			sb = nil
-
-			if f.lmgr.ZygoteProvider != nil && f.rtType == common.RT_PYTHON {
-				scratchDir := f.lmgr.scratchDirs.Make(f.name)
-
-				// we don't specify parent SB, because ImportCache.Create chooses it for us
-				sb, err = f.lmgr.ZygoteProvider.Create(f.lmgr.sbPool, true, linst.codeDir, scratchDir, linst.meta, f.rtType)
-				if err != nil {
-					f.printf("failed to get Sandbox from import cache")
-					sb = nil
-				}
-			}
-
-			log.Printf("Creating new sandbox")
-
-			// import cache is either disabled or it failed
-			if sb == nil {
-				t2 := common.T0("LambdaInstance-WaitSandbox-NoImportCache")
-				scratchDir := f.lmgr.scratchDirs.Make(f.name)
-				sb, err = f.lmgr.sbPool.Create(nil, true, linst.codeDir, scratchDir, linst.meta, f.rtType)
-				t2.T1()
-			}
-
+			sb, start, err = linst.createSandbox(f.logger().With("request", req.id))
 			if err != nil {
+				t.T1()
+				unbind()
+				linst.state.set("", false)
 				linst.TrySendError(req, http.StatusInternalServerError, "could not create Sandbox: "+err.Error()+"\n", nil)
 				f.doneChan <- req
 				continue // wait for another request before retrying
 			}
+			coldStartsMetric.With(f.name).Inc()
 		}
 		t.T1()
+		unbind()
+		paused = false
+		linst.state.set(sb.ID(), false)
+		req.start, req.sandboxWaitMs = start, t.Milliseconds
 
 		// below here, we're guaranteed (1) sb != nil, (2) proxy != nil, (3) sb is unpaused
 
@@ -134,43 +271,31 @@ func (linst *LambdaInstance) Task() {
 		for req != nil {
 			//f.printf("Forwarding request to sandbox")
 
+			// ServeRequests covers a batch of requests, so
+			// it isn't part of any one trace, but each
+			// round trip is
+			unbind := req.span.Bind()
 			t2 := common.T0("LambdaInstance-RoundTrip")
 
-			// get response from sandbox
-			url := "http://root" + req.r.RequestURI
-			httpReq, err := http.NewRequest(req.r.Method, url, req.r.Body)
-			if err != nil {
-				linst.TrySendError(req, http.StatusInternalServerError, "Could not create NewRequest: "+err.Error(), sb)
-			} else {
-				resp, err := sb.Client().Do(httpReq)
-
-				// copy response out
-				if err != nil {
-					linst.TrySendError(req, http.StatusBadGateway, "RoundTrip failed: "+err.Error()+"\n", sb)
-				} else {
-					// copy headers
-					// (adapted from copyHeaders: https://go.dev/src/net/http/httputil/reverseproxy.go)
-					for k, vv := range resp.Header {
-						for _, v := range vv {
-							req.w.Header().Add(k, v)
-						}
-					}
-					req.w.WriteHeader(resp.StatusCode)
-
-					// copy body
-					if _, err := io.Copy(req.w, resp.Body); err != nil {
-						// already used WriteHeader, so can't use that to surface on error anymore
-						msg := "reading lambda response failed: " + err.Error() + "\n"
-						f.printf("error: " + msg)
-						linst.TrySendError(req, 0, msg, sb)
-					}
-
-					resp.Body.Close()
-				}
+			if time.Now().After(req.deadline) {
+				// spent its whole budget waiting in the queue
+				linst.TrySendError(req, http.StatusGatewayTimeout, "lambda deadline expired before invocation could start", nil)
+			} else if req.cancelled() {
+				// cancelled while the sandbox was readied
+				f.sendCancelled(req, CANCELLED_QUEUED)
+			} else if reason := linst.hostRoundTrip(req, sb); reason != "" {
+				// the handler is stuck (or at least too
+				// slow), or was abandoned, so it can't be
+				// trusted with later requests
+				f.logger().With("sandbox", sb.ID(), "request", req.id).Warnf("discard sandbox after %s", reason)
+				sb.Destroy(reason)
+				sb = nil
+				linst.state.set("", false)
 			}
 
 			// notify instance that we're done
 			t2.T1()
+			unbind()
             // Record at least 1 ms of elapsed time
 			v := int(t2.Milliseconds)
 			if v == 0 {
@@ -183,17 +308,24 @@ func (linst *LambdaInstance) Task() {
 			// check whether we should shutdown (non-blocking)
 			select {
 			case killed := <-linst.killChan:
+				linst.host.close()
+				if sb == nil {
+					killed <- true
+					return
+				}
+
 				rtLog := sb.GetRuntimeLog()
+				sbLog := f.logger().With("sandbox", sb.ID())
 				sb.Destroy("Lambda instance kill signal received")
 
-				log.Printf("Stopped sandbox")
+				sbLog.Infof("Stopped sandbox")
 
 				if common.Conf.Log_output {
 					if rtLog != "" {
-						log.Printf("Runtime output is:")
+						sbLog.Infof("Runtime output is:")
 
 						for _, line := range strings.Split(rtLog, "\n") {
-							log.Printf("   %s", line)
+							sbLog.Infof("   %s", line)
 						}
 					}
 				}
@@ -203,25 +335,287 @@ func (linst *LambdaInstance) Task() {
 			default:
 			}
 
+			// a replacement sandbox is created once the
+			// next request arrives
+			if sb == nil {
+				break
+			}
+
 			// grab another request (non-blocking)
-			select {
-			case req = <-f.instChan:
-			default:
-				req = nil
+			if req = linst.pollRequest(); req != nil {
+				req.start = START_WARM
 			}
 		}
 
-		if sb != nil {
-			if err := sb.Pause(); err != nil {
-				f.printf("discard sandbox %s due to Pause error: %v", sb.ID(), err)
-				sb = nil
-			}
+		// pause right away, unless there is a grace period
+		idleSince = time.Now()
+		linst.state.idle(idleSince)
+		if sb != nil && linst.idleGrace() <= 0 {
+			sb = linst.pauseSandbox(sb)
+			paused = true
 		}
 
 		t.T1()
 	}
 }
 
+// takeRequest is called on each invocation the instance receives
+// from the queue.  It returns false if the invocation was abandoned
+// (see admission.go), in which case it goes straight back to the
+// function unserved.
+func (linst *LambdaInstance) takeRequest(req *Invocation) bool {
+	if !req.claim() {
+		linst.lfunc.doneChan <- req
+		return false
+	}
+	req.queueMs = time.Since(req.arrival).Milliseconds()
+	return true
+}
+
+// pollRequest takes the next invocation from the queue, or returns
+// nil if there is none (without blocking)
+func (linst *LambdaInstance) pollRequest() *Invocation {
+	for {
+		select {
+		case req := <-linst.lfunc.instChan:
+			if linst.takeRequest(req) {
+				return req
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// createSandbox creates a sandbox for the instance (forking a Zygote,
+// if possible), and says how (START_ZYGOTE or START_COLD)
+func (linst *LambdaInstance) createSandbox(logger *common.Logger) (sb sandbox.Sandbox, start string, err error) {
+	f := linst.lfunc
+
+	if f.lmgr.ZygoteProvider != nil && linst.rtType == common.RT_PYTHON {
+		scratchDir := f.lmgr.scratchDirs.Make(f.name)
+		linst.listenHost(scratchDir)
+
+		// we don't specify parent SB, because ImportCache.Create chooses it for us
+		sb, err = f.lmgr.ZygoteProvider.Create(f.lmgr.sbPool, true, linst.codeDir, scratchDir, linst.meta, linst.rtType)
+		if err == nil {
+			zygoteHitsMetric.With(f.name).Inc()
+			return sb, START_ZYGOTE, nil
+		}
+		logger.Warnf("failed to get Sandbox from import cache: %v", err)
+	}
+
+	logger.Debugf("Creating new sandbox")
+
+	// import cache is either disabled or it failed
+	t := common.T0("LambdaInstance-WaitSandbox-NoImportCache")
+	defer t.T1()
+	scratchDir := f.lmgr.scratchDirs.Make(f.name)
+	linst.listenHost(scratchDir)
+	sb, err = f.lmgr.sbPool.Create(nil, true, linst.codeDir, scratchDir, linst.meta, linst.rtType)
+	return sb, START_COLD, err
+}
+
+// warmSandbox creates a sandbox before any invocation needs it, and
+// pauses it until one does (see prewarm.go).  It returns nil if that
+// fails.
+func (linst *LambdaInstance) warmSandbox() sandbox.Sandbox {
+	logger := linst.lfunc.logger()
+
+	sb, _, err := linst.createSandbox(logger)
+	if err != nil {
+		logger.Warnf("could not create warm sandbox: %v", err)
+		return nil
+	}
+
+	if err := sb.Pause(); err != nil {
+		logger.With("sandbox", sb.ID()).Warnf("discard warm sandbox due to Pause error: %v", err)
+		sb.Destroy("could not pause warm sandbox")
+		return nil
+	}
+
+	logger.With("sandbox", sb.ID()).Debugf("created warm sandbox")
+	linst.state.set(sb.ID(), true)
+	return sb
+}
+
+// headers that only apply to a single connection, so they aren't
+// forwarded to sandboxes (see RFC 7230, section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// credentials for the worker itself (see common/auth.go), which
+// lambdas shouldn't see
+var workerAuthHeaders = []string{
+	"Authorization",
+	common.AUTH_API_KEY_HEADER,
+	common.AUTH_KEY_ID_HEADER,
+	common.AUTH_TIMESTAMP_HEADER,
+	common.AUTH_SIGNATURE_HEADER,
+}
+
+// copyRequestHeaders copies a client's request headers to the
+// request forwarded to a sandbox, except for hop-by-hop headers, and
+// the worker's credentials when auth is enabled
+// (adapted from ReverseProxy: https://go.dev/src/net/http/httputil/reverseproxy.go)
+func copyRequestHeaders(dst http.Header, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+
+	for _, v := range src["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				dst.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		dst.Del(k)
+	}
+	if common.Conf.Auth.Enabled {
+		for _, k := range workerAuthHeaders {
+			dst.Del(k)
+		}
+	}
+}
+
+// listenHost serves calls to other lambdas from the sandbox that is
+// about to be created with scratchDir.  The sandbox is still usable
+// if this fails; it just can't make calls.
+func (linst *LambdaInstance) listenHost(scratchDir string) {
+	if err := linst.host.listen(scratchDir); err != nil {
+		linst.lfunc.logger().Warnf("could not create %s for lambda-to-lambda calls: %v", HOST_SOCKET_NAME, err)
+	}
+}
+
+// hostRoundTrip is roundTrip, with calls the sandbox makes to other
+// lambdas meanwhile counted as part of req
+func (linst *LambdaInstance) hostRoundTrip(req *Invocation, sb sandbox.Sandbox) (discard string) {
+	linst.host.setCurrent(req)
+	defer linst.host.setCurrent(nil)
+	return linst.roundTrip(req, sb)
+}
+
+// roundTrip forwards req to sb and copies the response back to the
+// client, giving up at the invocation's deadline, or if it is
+// cancelled (see cancel.go).  If the sandbox was still working on req
+// then, it returns why the sandbox should be discarded ("" to keep
+// it).
+func (linst *LambdaInstance) roundTrip(req *Invocation, sb sandbox.Sandbox) (discard string) {
+	f := linst.lfunc
+
+	ctx, cancel := context.WithDeadline(req.ctx, req.deadline)
+	defer cancel()
+
+	// get response from sandbox
+	url := "http://root" + req.r.RequestURI
+	httpReq, err := http.NewRequestWithContext(ctx, req.r.Method, url, req.r.Body)
+	if err != nil {
+		linst.TrySendError(req, http.StatusInternalServerError, "Could not create NewRequest: "+err.Error(), sb)
+		return ""
+	}
+
+	copyRequestHeaders(httpReq.Header, req.r.Header)
+	httpReq.Header.Set(REQUEST_ID_HEADER, req.id)
+	if span := common.CurrentSpan(); span != nil {
+		span.SetAttr("sandbox", sb.ID())
+		span.Inject(httpReq.Header)
+	} else if req.traceparent != "" {
+		httpReq.Header.Set(common.TRACEPARENT_HEADER, req.traceparent)
+	}
+
+	sent := time.Now()
+	resp, err := sb.Client().Do(httpReq)
+	linst.recordTiming(req, time.Since(sent))
+	if err != nil {
+		if req.cancelled() {
+			f.sendCancelled(req, CANCELLED_RUNNING)
+			return cancelDiscard()
+		}
+		if isTimeout(ctx, err) {
+			linst.TrySendError(req, http.StatusGatewayTimeout, "lambda exceeded its deadline\n", nil)
+			return "invocation exceeded deadline"
+		}
+		linst.TrySendError(req, http.StatusBadGateway, "RoundTrip failed: "+err.Error()+"\n", sb)
+		return ""
+	}
+	defer resp.Body.Close()
+
+	// copy headers
+	// (adapted from copyHeaders: https://go.dev/src/net/http/httputil/reverseproxy.go)
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			req.w.Header().Add(k, v)
+		}
+	}
+	req.w.WriteHeader(resp.StatusCode)
+
+	// copy body
+	if _, err := io.Copy(req.w, resp.Body); err != nil {
+		if req.cancelled() {
+			// the client is gone (or gave up), so there is
+			// nobody to tell
+			atomic.AddInt64(&f.cancelled, 1)
+			cancelledMetric.With(f.name, CANCELLED_RUNNING).Inc()
+			return cancelDiscard()
+		}
+
+		// already used WriteHeader, so can't use that to surface on error anymore
+		msg := "reading lambda response failed: " + err.Error() + "\n"
+		f.logger().With("sandbox", sb.ID(), "request", req.id).Errorf("%s", msg)
+		linst.TrySendError(req, 0, msg, sb)
+		if isTimeout(ctx, err) {
+			return "invocation exceeded deadline"
+		}
+	}
+
+	return ""
+}
+
+// recordTiming counts how req was served in the per-lambda metrics,
+// and adds the timing headers to its response (if enabled).  exec
+// is how long the sandbox took to respond (excluding the body).
+func (linst *LambdaInstance) recordTiming(req *Invocation, exec time.Duration) {
+	f := linst.lfunc
+
+	startsMetric.With(f.name, req.start).Inc()
+	queueSecondsMetric.With(f.name).Add(float64(req.queueMs) / 1000)
+	sandboxWaitSecondsMetric.With(f.name).Add(float64(req.sandboxWaitMs) / 1000)
+	execSecondsMetric.With(f.name).Add(exec.Seconds())
+
+	if common.Conf.Features.Timing_headers {
+		h := req.w.Header()
+		h.Set(START_HEADER, req.start)
+		h.Set(QUEUE_MS_HEADER, strconv.FormatInt(req.queueMs, 10))
+		h.Set(SANDBOX_MS_HEADER, strconv.FormatInt(req.sandboxWaitMs, 10))
+		h.Set(EXEC_MS_HEADER, strconv.FormatInt(exec.Milliseconds(), 10))
+	}
+}
+
+// did err occur because the deadline passed?  The sandbox's
+// http.Client has its own timeout as a backstop, so check for that
+// as well as the context expiring.
+func isTimeout(ctx context.Context, err error) bool {
+	if ctx.Err() == context.DeadlineExceeded {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func (linst *LambdaInstance) TrySendError(req *Invocation, statusCode int, msg string, sb sandbox.Sandbox) {
 	if statusCode > 0 {
 		req.w.WriteHeader(statusCode)
@@ -235,7 +629,7 @@ func (linst *LambdaInstance) TrySendError(req *Invocation, statusCode int, msg s
 	}
 
 	if err != nil {
-		linst.lfunc.printf("TrySendError failed: %s\n", err.Error())
+		linst.lfunc.logger().With("request", req.id).Warnf("TrySendError failed: %s", err.Error())
 	}
 }
 
@@ -2,11 +2,14 @@ package lambda
 
 import (
 	"container/list"
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 	"github.com/open-lambda/open-lambda/ol/worker/lambda/packages"
@@ -23,14 +26,38 @@ type LambdaMgr struct {
 	*packages.PackagePuller // depends on sbPool and DepTracer
 	zygote.ZygoteProvider     // depends PackagePuller
 	*HandlerPuller          // depends on sbPool and ImportCache[optional]
+	*AsyncInvoker           // depends on everything above (via Get)
+	*common.Scheduler       // depends on everything above (via Get)
 
 	// storage dirs that we manage
 	codeDirs    *common.DirMaker
 	scratchDirs *common.DirMaker
 
-	// thread-safe map from a lambda's name to its LambdaFunc
+	// thread-safe map from a lambda's name to its LambdaFunc,
+	// and lambdas that are disabled (until the given time, or
+	// until enabled if zero).  Both are protected by mapMutex.
 	mapMutex sync.Mutex
 	lfuncMap map[string]*LambdaFunc
+	disabled map[string]time.Time
+
+	// close stopUnloader to stop unloadIdleTask, which closes
+	// unloaderDone when it exits
+	stopUnloader chan bool
+	unloaderDone chan bool
+
+	// invocations in progress, by request ID and key, so they
+	// can be cancelled (see cancel.go)
+	invMutex    sync.Mutex
+	invocations map[trackedID]*Invocation
+
+	// progress of prewarming (see prewarm.go)
+	prewarm prewarmProgress
+
+	// once draining, no new invocations are admitted; inflight
+	// counts those admitted but not yet finished
+	drainMutex sync.Mutex
+	draining   bool
+	inflight   int
 }
 
 // represents an HTTP request to be handled by a lambda instance
@@ -41,18 +68,67 @@ type Invocation struct {
 	// signal to client that response has been written to w
 	done chan bool
 
+	// request ID, for correlating log records
+	id string
+
+	// ID of the auth key the invocation was started with ("" if
+	// auth is disabled), and the lambda it invokes
+	keyID  string
+	lambda string
+
+	// span of the invocation (nil unless traced), and the
+	// traceparent to pass on to the lambda
+	span        *common.Span
+	traceparent string
+
+	// when the invocation arrived, and when it must be done by
+	// (queue time counts against the deadline)
+	arrival  time.Time
+	deadline time.Time
+
+	// shorter timeout requested by the client (0 if none)
+	requestedTimeout time.Duration
+
 	// how many milliseconds did ServeHTTP take?  (doesn't count
 	// queue time or Sandbox init)
 	execMs int
+
+	// how the sandbox was readied (START_WARM, etc), and how long
+	// the invocation waited for an instance, then for the sandbox
+	start         string
+	queueMs       int64
+	sandboxWaitMs int64
+
+	// how deep in a chain of lambda-to-lambda calls this is (0 if
+	// not called by a lambda), and how many calls it has made
+	// (protected by the hostServer's mutex)
+	depth int
+	calls int
+
+	// whether an instance has claimed the invocation, or it was
+	// abandoned after waiting too long or being cancelled
+	// (accessed atomically; see admission.go)
+	queueState int32
+
+	// rejects the invocation if it waits too long for an instance
+	// (set by the Task before queueing it, stopped by claim)
+	queueTimer *time.Timer
+
+	// done once the client goes away or cancels the invocation
+	// (see cancel.go)
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewLambdaMgr() (res *LambdaMgr, err error) {
 	mgr := &LambdaMgr{
-		lfuncMap: make(map[string]*LambdaFunc),
+		lfuncMap:    make(map[string]*LambdaFunc),
+		disabled:    make(map[string]time.Time),
+		invocations: make(map[trackedID]*Invocation),
 	}
 	defer func() {
 		if err != nil {
-			log.Printf("Cleanup Lambda Manager due to error: %v", err)
+			lambdaLog.Errorf("Cleanup Lambda Manager due to error: %v", err)
 			mgr.Cleanup()
 		}
 	}()
@@ -66,41 +142,70 @@ func NewLambdaMgr() (res *LambdaMgr, err error) {
 		return nil, err
 	}
 
-	log.Printf("Creating SandboxPool")
+	lambdaLog.Infof("Creating SandboxPool")
 	mgr.sbPool, err = sandbox.SandboxPoolFromConfig("sandboxes", common.Conf.Mem_pool_mb)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Creating DepTracer")
+	lambdaLog.Infof("Creating DepTracer")
 	mgr.DepTracer, err = packages.NewDepTracer(filepath.Join(common.Conf.Worker_dir, "dep-trace.json"))
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Creating PackagePuller")
+	lambdaLog.Infof("Creating PackagePuller")
 	mgr.PackagePuller, err = packages.NewPackagePuller(mgr.sbPool, mgr.DepTracer)
 	if err != nil {
 		return nil, err
 	}
 
 	if common.Conf.Features.Import_cache != "" {
-		log.Printf("Creating ImportCache")
+		lambdaLog.Infof("Creating ImportCache")
 		mgr.ZygoteProvider, err = zygote.NewZygoteProvider(mgr.codeDirs, mgr.scratchDirs, mgr.sbPool, mgr.PackagePuller)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	log.Printf("Creating HandlerPuller")
+	lambdaLog.Infof("Creating HandlerPuller")
 	mgr.HandlerPuller, err = NewHandlerPuller(mgr.codeDirs)
 	if err != nil {
 		return nil, err
 	}
 
+	lambdaLog.Infof("Creating AsyncInvoker")
+	mgr.AsyncInvoker, err = NewAsyncInvoker(mgr)
+	if err != nil {
+		return nil, err
+	}
+
+	lambdaLog.Infof("Creating Scheduler")
+	mgr.Scheduler, err = common.NewScheduler(&common.Conf.Scheduler, mgr.invokeScheduled)
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.stopUnloader = make(chan bool)
+	mgr.unloaderDone = make(chan bool)
+	go mgr.unloadIdleTask()
+
 	return mgr, nil
 }
 
+// invokeScheduled runs a scheduled invocation (unless draining)
+func (mgr *LambdaMgr) invokeScheduled(lambda string, w http.ResponseWriter, r *http.Request) {
+	release, ok := mgr.Admit()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(ErrDraining.Error()))
+		return
+	}
+	defer release()
+
+	mgr.Invoke(lambda, w, r)
+}
+
 // Returns an existing instance (if there is one), or creates a new one
 func (mgr *LambdaMgr) Get(name string) (f *LambdaFunc) {
 	mgr.mapMutex.Lock()
@@ -109,15 +214,24 @@ func (mgr *LambdaMgr) Get(name string) (f *LambdaFunc) {
 	f = mgr.lfuncMap[name]
 
 	if f == nil {
+		// the lambda's own max_queued can only lower this
+		queueSize := common.Max(common.Conf.Limits.Max_queued, 1)
 		f = &LambdaFunc{
 			lmgr:      mgr,
 			name:      name,
-			// TODO make these configurable
-			funcChan:  make(chan *Invocation, 1024),
-			instChan:  make(chan *Invocation, 1024),
-			doneChan:  make(chan *Invocation, 1024),
+			funcChan:  make(chan *Invocation, queueSize),
+			instChan:  make(chan *Invocation, queueSize),
+			doneChan:  make(chan *Invocation, queueSize),
 			instances: list.New(),
 			killChan:  make(chan chan bool, 1),
+			statusChan: make(chan chan *LambdaStatus),
+			refreshChan: make(chan chan bool),
+			prewarmChan: make(chan chan error),
+			retiring:    list.New(),
+			rolloutChan: make(chan bool, 1),
+			quiesceChan: make(chan chan int),
+			exited:    make(chan bool),
+			lastUsed:  time.Now(),
 		}
 
 		go f.Task()
@@ -138,20 +252,31 @@ func (_ *LambdaMgr) DumpStatsToLog() {
 		return float64(snapshot[name+".cnt"]*snapshot[name+".ms-avg"]) / 1000
 	}
 
+	// tail latencies of a single call (rather than cumulative)
+	tail := func(name string) string {
+		if snapshot[name+".cnt"] == 0 {
+			return ""
+		}
+		return fmt.Sprintf(" [p50=%d p90=%d p99=%d max=%d ms]",
+			snapshot[name+".ms-p50"], snapshot[name+".ms-p90"],
+			snapshot[name+".ms-p99"], snapshot[name+".ms-max"])
+	}
+
 	time := func(indent int, name string, parent string) {
 		selftime := sec(name)
 		ptime := sec(parent)
 		tabs := strings.Repeat("\t", indent)
 		if ptime > 0 {
-			log.Printf("%s%s: %.3f (%.1f%%)", tabs, name, selftime, selftime/ptime*100)
+			log.Printf("%s%s: %.3f (%.1f%%)%s", tabs, name, selftime, selftime/ptime*100, tail(name))
 		} else {
-			log.Printf("%s%s: %.3f", tabs, name, selftime)
+			log.Printf("%s%s: %.3f%s", tabs, name, selftime, tail(name))
 		}
 	}
 
-	log.Printf("Request Profiling (cumulative seconds):")
+	log.Printf("Request Profiling (cumulative seconds, with per-call percentiles):")
 	time(0, "LambdaFunc.Invoke", "")
 
+	time(1, "LambdaFunc-QueueWait", "LambdaFunc.Invoke")
 	time(1, "LambdaInstance-WaitSandbox", "LambdaFunc.Invoke")
 	time(2, "LambdaInstance-WaitSandbox-Unpause", "LambdaInstance-WaitSandbox")
 	time(2, "LambdaInstance-WaitSandbox-NoImportCache", "LambdaInstance-WaitSandbox")
@@ -168,18 +293,131 @@ func (_ *LambdaMgr) DumpStatsToLog() {
 	time(2, "LambdaInstance-RoundTrip", "LambdaInstance-ServeRequests")
 }
 
+// Admit is called before a client's invocation is started.  It
+// returns false if the worker is draining, in which case the
+// invocation must be rejected; otherwise release must be called
+// once the invocation has been handled.
+func (mgr *LambdaMgr) Admit() (release func(), ok bool) {
+	mgr.drainMutex.Lock()
+	defer mgr.drainMutex.Unlock()
+
+	if mgr.draining {
+		return nil, false
+	}
+
+	mgr.inflight += 1
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mgr.drainMutex.Lock()
+			mgr.inflight -= 1
+			mgr.drainMutex.Unlock()
+		})
+	}, true
+}
+
+// DrainStatus reports whether the worker is draining, and how many
+// invocations (sync, or async ones not yet done) are unfinished
+func (mgr *LambdaMgr) DrainStatus() (draining bool, inflight int) {
+	mgr.drainMutex.Lock()
+	draining, inflight = mgr.draining, mgr.inflight
+	mgr.drainMutex.Unlock()
+
+	if mgr.AsyncInvoker != nil {
+		inflight += mgr.AsyncInvoker.Pending()
+	}
+	return draining, inflight
+}
+
+// Drain stops admitting invocations, then waits for the ones already
+// admitted (including queued async invocations) to finish.  It gives
+// up after the grace period, or when abort is closed, returning how
+// many were still unfinished.
+func (mgr *LambdaMgr) Drain(grace time.Duration, abort <-chan bool) int {
+	mgr.drainMutex.Lock()
+	mgr.draining = true
+	mgr.drainMutex.Unlock()
+
+	deadline := time.After(grace)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	lastReport := time.Now()
+
+	for {
+		_, inflight := mgr.DrainStatus()
+		if inflight == 0 {
+			lambdaLog.Infof("drained all invocations")
+			return 0
+		}
+
+		if time.Since(lastReport) >= time.Second {
+			lambdaLog.Infof("draining: %d invocations unfinished", inflight)
+			lastReport = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			lambdaLog.Warnf("drain grace period expired with %d invocations unfinished", inflight)
+			return inflight
+		case <-abort:
+			lambdaLog.Warnf("drain aborted with %d invocations unfinished", inflight)
+			return inflight
+		}
+	}
+}
+
+// ConfReloaded applies config changes that are not simply picked up
+// the next time the setting is read (old is the previous config)
+func (mgr *LambdaMgr) ConfReloaded(old *common.Config) {
+	if mgr.Scheduler != nil {
+		if err := mgr.SetConfigSchedules(common.Conf.Scheduler.Schedules); err != nil {
+			lambdaLog.Errorf("could not update schedules: %v", err)
+		}
+	}
+
+	// queues are sized when lambdas are loaded (see admission.go)
+	if common.Conf.Limits.Max_queued > old.Limits.Max_queued {
+		lambdaLog.Warnf("limits.max_queued raised from %d to %d, but lambdas already loaded keep their queue sizes (see queue_capacity in /lambdas) until they are unloaded",
+			old.Limits.Max_queued, common.Conf.Limits.Max_queued)
+	}
+
+	if common.Conf.Mem_pool_mb != old.Mem_pool_mb {
+		if !sandbox.ResizePool(mgr.sbPool, common.Conf.Mem_pool_mb) {
+			lambdaLog.Warnf("%s sandbox pool cannot be resized, so mem_pool_mb has no effect", common.Conf.Sandbox)
+		}
+	}
+}
+
 func (mgr *LambdaMgr) Cleanup() {
+	// stop unloading first, as that needs mapMutex
+	if mgr.stopUnloader != nil {
+		close(mgr.stopUnloader)
+		<-mgr.unloaderDone
+	}
+
+	// no new scheduled invocations (those in progress were
+	// admitted, so draining waited for them)
+	if mgr.Scheduler != nil {
+		mgr.Scheduler.Stop()
+	}
+
 	mgr.mapMutex.Lock() // don't unlock, because this shouldn't be used anymore
 
 	mgr.DumpStatsToLog()
 
+	// stop dispatching async invocations (queued ones stay on disk)
+	if mgr.AsyncInvoker != nil {
+		mgr.AsyncInvoker.Cleanup()
+	}
+
 	// HandlerPuller+PackagePuller requires no cleanup
 
 	// 1. cleanup handler Sandboxes
 	// 2. cleanup Zygote Sandboxes (after the handlers, which depend on the Zygotes)
 	// 3. cleanup SandboxPool underlying both of above
 	for _, f := range mgr.lfuncMap {
-		log.Printf("Kill function: %s", f.name)
+		f.logger().Infof("Kill function")
 		f.Kill()
 	}
 
@@ -0,0 +1,320 @@
+package lambda
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long to wait for a busy LambdaFunc.Task to report its status
+const STATUS_TIMEOUT = 5 * time.Second
+
+var ErrStatusTimeout = errors.New("timed out waiting for lambda status")
+
+// the values of a lambda's environment variables often hold secrets,
+// so status shows this in their place
+const REDACTED_VALUE = "(redacted)"
+
+// LambdaStatus is a snapshot of a LambdaFunc, for introspection
+type LambdaStatus struct {
+	Name        string        `json:"name"`
+	Runtime     string        `json:"runtime"`
+	CodeDir     string        `json:"code_dir"`
+	CodeVersion string        `json:"code_version,omitempty"`
+	LastPull    *time.Time    `json:"last_pull,omitempty"`
+	Installs    []string      `json:"installs"`
+	Imports     []string      `json:"imports"`
+	Config      *LambdaConfig `json:"config,omitempty"`
+
+	// is a check for new code running in the background, how many
+	// have failed, and why the last one did (if it hasn't
+	// succeeded since)
+	Refreshing      bool       `json:"refreshing"`
+	RefreshFailures int        `json:"refresh_failures"`
+	RefreshError    string     `json:"refresh_error,omitempty"`
+	RefreshErrorAt  *time.Time `json:"refresh_error_at,omitempty"`
+
+	// disabled by an admin (until the given time, if any)
+	Disabled      bool       `json:"disabled"`
+	DisabledUntil *time.Time `json:"disabled_until,omitempty"`
+
+	// requests waiting for the function task, and for an
+	// instance, respectively
+	FuncQueued int `json:"func_queued"`
+	InstQueued int `json:"inst_queued"`
+
+	// requests handed to instances but not yet done
+	Outstanding int `json:"outstanding"`
+
+	// average execution time of the last few requests, and how
+	// long they waited for an instance
+	AvgExecMs  int `json:"avg_exec_ms"`
+	AvgQueueMs int `json:"avg_queue_ms"`
+
+	// admission control limits (0 means no limit), and how many
+	// invocations have been rejected because the queue was full,
+	// or because they waited too long.  MaxQueued is the limit in
+	// effect, which can't exceed QueueCapacity (fixed when the
+	// lambda was loaded).
+	MaxInstances  int   `json:"max_instances"`
+	MaxQueued     int   `json:"max_queued"`
+	QueueCapacity int   `json:"queue_capacity"`
+	MaxQueueMs    int64 `json:"max_queue_ms"`
+	QueueFull     int64 `json:"queue_full"`
+	QueueTimeouts int64 `json:"queue_timeouts"`
+
+	// invocations cancelled by their clients (see cancel.go)
+	Cancelled int64 `json:"cancelled"`
+
+	// instances that keep a sandbox ready (min_instances, or one
+	// if the lambda was prewarmed)
+	MinInstances  int  `json:"min_instances"`
+	WarmInstances int  `json:"warm_instances"`
+	Prewarmed     bool `json:"prewarmed"`
+
+	// idle settings (see idle.go), and how many sandboxes have been
+	// paused, served invocations without being paused, and been
+	// destroyed for being idle
+	IdleGraceMs  int64 `json:"idle_grace_ms"`
+	IdleTtlSec   int64 `json:"idle_ttl_sec"`
+	Pauses       int64 `json:"pauses"`
+	GraceHits    int64 `json:"grace_hits"`
+	IdleDestroys int64 `json:"idle_destroys"`
+
+	// set while instances move to new code (see rollout.go)
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+
+	Instances []InstanceStatus `json:"instances"`
+
+	// set instead of the above if the status couldn't be read
+	Error string `json:"error,omitempty"`
+}
+
+// RolloutStatus describes a rolling code update in progress: how many
+// instances it aims for, how many on the new code are ready, and how
+// many on old code remain
+type RolloutStatus struct {
+	Target   int `json:"target"`
+	Ready    int `json:"ready"`
+	Retiring int `json:"retiring"`
+}
+
+// InstanceStatus is a snapshot of a LambdaInstance
+type InstanceStatus struct {
+	CodeDir   string `json:"code_dir"`
+	SandboxID string `json:"sandbox_id,omitempty"`
+	Paused    bool   `json:"paused"`
+
+	// how long the sandbox has been idle (0 if it is busy)
+	IdleMs int64 `json:"idle_ms"`
+
+	// running replaced code, until instances on the new code are
+	// ready (see rollout.go)
+	Retiring bool `json:"retiring,omitempty"`
+}
+
+// instance state that is reported by Status (the instance's Task
+// owns everything else)
+type instanceState struct {
+	mutex     sync.Mutex
+	sandboxID string
+	paused    bool
+	idleSince time.Time
+}
+
+func (state *instanceState) set(sandboxID string, paused bool) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.sandboxID = sandboxID
+	state.paused = paused
+}
+
+// idle records when the sandbox became idle (zero when it gets busy)
+func (state *instanceState) idle(since time.Time) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.idleSince = since
+}
+
+func (linst *LambdaInstance) status() InstanceStatus {
+	linst.state.mutex.Lock()
+	defer linst.state.mutex.Unlock()
+	status := InstanceStatus{
+		CodeDir:   linst.codeDir,
+		SandboxID: linst.state.sandboxID,
+		Paused:    linst.state.paused,
+	}
+	if status.SandboxID != "" && !linst.state.idleSince.IsZero() {
+		status.IdleMs = time.Since(linst.state.idleSince).Milliseconds()
+	}
+	return status
+}
+
+// called by the function's Task, which owns the fields read here
+func (f *LambdaFunc) status(outstandingReqs int, avgExecMs int, avgQueueMs int, refreshing bool) *LambdaStatus {
+	status := &LambdaStatus{
+		Name:        f.name,
+		CodeDir:     f.codeDir,
+		LastPull:    f.lastPull,
+		Installs:    []string{},
+		Imports:     []string{},
+		Config:      redactConfig(f.conf),
+		FuncQueued:  len(f.funcChan),
+		InstQueued:  len(f.instChan),
+		Outstanding: outstandingReqs,
+		AvgExecMs:   avgExecMs,
+		AvgQueueMs:  avgQueueMs,
+		Instances:   []InstanceStatus{},
+
+		MaxInstances:  f.maxInstances(),
+		MaxQueued:     f.maxQueued(),
+		QueueCapacity: cap(f.instChan),
+		MaxQueueMs:    f.maxQueueWait().Milliseconds(),
+		QueueFull:     atomic.LoadInt64(&f.queueFull),
+		QueueTimeouts: atomic.LoadInt64(&f.queueTimeouts),
+		Cancelled:     atomic.LoadInt64(&f.cancelled),
+
+		MinInstances:  f.minInstances(),
+		WarmInstances: f.warmInstances(),
+		Prewarmed:     f.prewarmed,
+
+		Refreshing:      refreshing,
+		RefreshFailures: f.refreshFailures,
+
+		Pauses:       atomic.LoadInt64(&f.pauses),
+		GraceHits:    atomic.LoadInt64(&f.graceHits),
+		IdleDestroys: atomic.LoadInt64(&f.idleDestroys),
+	}
+
+	if f.conf != nil {
+		status.IdleGraceMs = idleGrace(f.conf.Idle_grace_ms).Milliseconds()
+		status.IdleTtlSec = int64(idleTTL(f.conf.Idle_ttl_sec).Seconds())
+	} else {
+		status.IdleGraceMs = idleGrace(0).Milliseconds()
+		status.IdleTtlSec = int64(idleTTL(0).Seconds())
+	}
+
+	if f.refreshError != nil {
+		status.RefreshError = f.refreshError.err.Error()
+		status.RefreshErrorAt = &f.refreshError.started
+	}
+
+	if until, ok := f.lmgr.Disabled(f.name); ok {
+		status.Disabled = true
+		if !until.IsZero() {
+			status.DisabledUntil = &until
+		}
+	}
+
+	if f.codeDir != "" {
+		status.Runtime = f.rtType.String()
+		if entry := f.lmgr.HandlerPuller.getCache(f.name); entry != nil && entry.path == f.codeDir {
+			status.CodeVersion = entry.version
+		}
+	}
+
+	if f.meta != nil {
+		status.Installs = append(status.Installs, f.meta.Installs...)
+		status.Imports = append(status.Imports, f.meta.Imports...)
+	}
+
+	for el := f.instances.Front(); el != nil; el = el.Next() {
+		status.Instances = append(status.Instances, el.Value.(*LambdaInstance).status())
+	}
+	for el := f.retiring.Front(); el != nil; el = el.Next() {
+		instance := el.Value.(*LambdaInstance).status()
+		instance.Retiring = true
+		status.Instances = append(status.Instances, instance)
+	}
+	if f.retiring.Len() > 0 {
+		status.Rollout = &RolloutStatus{
+			Target:   f.rolloutTarget,
+			Retiring: f.retiring.Len(),
+		}
+		for el := f.instances.Front(); el != nil; el = el.Next() {
+			if el.Value.(*LambdaInstance).isReady() {
+				status.Rollout.Ready++
+			}
+		}
+	}
+
+	return status
+}
+
+// redactConfig returns a copy of conf that only shows the names of
+// environment variables
+func redactConfig(conf *LambdaConfig) *LambdaConfig {
+	if conf == nil {
+		return nil
+	}
+
+	redacted := *conf
+	if conf.Environment != nil {
+		redacted.Environment = make(map[string]string, len(conf.Environment))
+		for name := range conf.Environment {
+			redacted.Environment[name] = REDACTED_VALUE
+		}
+	}
+	return &redacted
+}
+
+// Status asks the function's Task for a snapshot of its state
+func (f *LambdaFunc) Status() (*LambdaStatus, error) {
+	reply := make(chan *LambdaStatus, 1)
+
+	select {
+	case f.statusChan <- reply:
+	case <-f.exited:
+		return nil, ErrNotLoaded
+	case <-time.After(STATUS_TIMEOUT):
+		return nil, ErrStatusTimeout
+	}
+
+	select {
+	case status := <-reply:
+		return status, nil
+	case <-time.After(STATUS_TIMEOUT):
+		return nil, ErrStatusTimeout
+	}
+}
+
+// Lookup returns the named LambdaFunc, or nil if it hasn't been
+// created (unlike Get, this never creates one)
+func (mgr *LambdaMgr) Lookup(name string) *LambdaFunc {
+	mgr.mapMutex.Lock()
+	defer mgr.mapMutex.Unlock()
+	return mgr.lfuncMap[name]
+}
+
+// Lambdas returns the status of every LambdaFunc, sorted by name.
+// They are asked concurrently, so a few busy ones don't add up.
+func (mgr *LambdaMgr) Lambdas() []*LambdaStatus {
+	mgr.mapMutex.Lock()
+	funcs := make([]*LambdaFunc, 0, len(mgr.lfuncMap))
+	for _, f := range mgr.lfuncMap {
+		funcs = append(funcs, f)
+	}
+	mgr.mapMutex.Unlock()
+
+	sort.Slice(funcs, func(i, j int) bool {
+		return funcs[i].name < funcs[j].name
+	})
+
+	statuses := make([]*LambdaStatus, len(funcs))
+	var wg sync.WaitGroup
+	for i, f := range funcs {
+		wg.Add(1)
+		go func(i int, f *LambdaFunc) {
+			defer wg.Done()
+			status, err := f.Status()
+			if err != nil {
+				status = &LambdaStatus{Name: f.name, Error: err.Error()}
+			}
+			statuses[i] = status
+		}(i, f)
+	}
+	wg.Wait()
+	return statuses
+}
@@ -0,0 +1,68 @@
+package lambda
+
+import (
+	"net/http"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// per-lambda metrics, exported on /metrics
+var (
+	invocationsMetric = common.NewCounterVec("ol_lambda_invocations_total",
+		"Invocations received by the worker.", "lambda")
+	responsesMetric = common.NewCounterVec("ol_lambda_responses_total",
+		"Responses sent to clients, by HTTP status code.", "lambda", "code")
+	latencyMetric = common.NewHistogramVec("ol_lambda_invocation_seconds",
+		"Invocation latency, including queue time and sandbox startup.", nil, "lambda")
+	coldStartsMetric = common.NewCounterVec("ol_lambda_cold_starts_total",
+		"Sandboxes created to serve invocations (including those forked from a Zygote).", "lambda")
+	zygoteHitsMetric = common.NewCounterVec("ol_lambda_zygote_hits_total",
+		"Sandboxes created by forking a Zygote.", "lambda")
+	queueDepthMetric = common.NewGaugeVec("ol_lambda_queue_depth",
+		"Invocations waiting for an instance.", "lambda")
+	outstandingMetric = common.NewGaugeVec("ol_lambda_outstanding_requests",
+		"Invocations queued or running.", "lambda")
+	instancesMetric = common.NewGaugeVec("ol_lambda_instances",
+		"Lambda instances (each backed by at most one sandbox).", "lambda")
+	startsMetric = common.NewCounterVec("ol_lambda_starts_total",
+		"Invocations sent to a sandbox, by how the sandbox was readied (warm, unpaused, zygote, or cold).", "lambda", "start")
+	queueSecondsMetric = common.NewCounterVec("ol_lambda_queue_seconds_total",
+		"Time invocations spent waiting for an instance.", "lambda")
+	sandboxWaitSecondsMetric = common.NewCounterVec("ol_lambda_sandbox_wait_seconds_total",
+		"Time invocations spent waiting for a sandbox to be unpaused or created.", "lambda")
+	execSecondsMetric = common.NewCounterVec("ol_lambda_exec_seconds_total",
+		"Time sandboxes took to respond to invocations.", "lambda")
+	rejectedMetric = common.NewCounterVec("ol_lambda_rejected_total",
+		"Invocations turned away by admission control, by reason (queue_full or queue_timeout).", "lambda", "reason")
+	pausesMetric = common.NewCounterVec("ol_lambda_pauses_total",
+		"Idle sandboxes paused.", "lambda")
+	idleDestroysMetric = common.NewCounterVec("ol_lambda_idle_destroys_total",
+		"Sandboxes destroyed for being idle longer than idle_ttl_sec.", "lambda")
+	refreshFailuresMetric = common.NewCounterVec("ol_lambda_code_refresh_failures_total",
+		"Background checks for new code that failed (the lambda kept its current code).", "lambda")
+	cancelledMetric = common.NewCounterVec("ol_lambda_cancelled_total",
+		"Invocations cancelled by their clients (by disconnecting, or by ID), by where they were (queued or running).", "lambda", "stage")
+	internalCallsMetric = common.NewCounterVec("ol_lambda_internal_calls_total",
+		"Calls one lambda made to another through the host socket.", "lambda", "callee")
+)
+
+// remembers the status code written by a lambda (or by the worker on
+// its behalf), for metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *statusRecorder) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -18,6 +17,8 @@ import (
 	"github.com/open-lambda/open-lambda/ol/worker/sandbox"
 )
 
+var packagesLog = common.NewLogger("packages")
+
 // PackagePuller is the interface for installing pip packages locally.
 // The manager installs to the worker host from an optional pip
 // mirror.
@@ -93,18 +94,14 @@ func (pp *PackagePuller) InstallRecursive(installs []string) ([]string, error) {
 	// deps, leading to other installs
 	for i := 0; i < len(installs); i++ {
 		pkg := installs[i]
-		if common.Conf.Trace.Package {
-			log.Printf("On %v of %v", pkg, installs)
-		}
+		packagesLog.Debugf("On %v of %v", pkg, installs)
 		p, err := pp.GetPkg(pkg)
 		if err != nil {
 			return nil, err
 		}
 
-		if common.Conf.Trace.Package {
-			log.Printf("Package '%s' has deps %v", pkg, p.Meta.Deps)
-			log.Printf("Package '%s' has top-level modules %v", pkg, p.Meta.TopLevel)
-		}
+		packagesLog.With("package", pkg).Debugf("has deps %v", p.Meta.Deps)
+		packagesLog.With("package", pkg).Debugf("has top-level modules %v", p.Meta.TopLevel)
 
 		// push any previously unseen deps on the list of ones to install
 		for _, dep := range p.Meta.Deps {
@@ -162,15 +159,16 @@ func (pp *PackagePuller) sandboxInstall(p *Package) (err error) {
 	// same as scratchDir, which is the same as a sub-directory
 	// named after the package in the packages dir
 	scratchDir := filepath.Join(common.Conf.Pkgs_dir, p.Name)
-	log.Printf("do pip install, using scratchDir='%v'", scratchDir)
+	pkgLog := packagesLog.With("package", p.Name)
+	pkgLog.Infof("do pip install, using scratchDir='%v'", scratchDir)
 
 	alreadyInstalled := false
 	if _, err := os.Stat(scratchDir); err == nil {
 		// assume dir existence means it is installed already
-		log.Printf("%s appears already installed from previous run of OL", p.Name)
+		pkgLog.Infof("appears already installed from previous run of OL")
 		alreadyInstalled = true
 	} else {
-		log.Printf("run pip install %s from a new Sandbox to %s on host", p.Name, scratchDir)
+		pkgLog.Infof("run pip install from a new Sandbox to %s on host", scratchDir)
 		if err := os.Mkdir(scratchDir, 0700); err != nil {
 			return err
 		}
@@ -0,0 +1,165 @@
+package lambda
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// warm instances and prewarming
+//
+// The first min_instances instances of a lambda keep a sandbox created
+// (and paused, when idle), so invocations don't wait for one to be
+// created.  Their sandboxes are created as soon as the instances are
+// (e.g., after new code is pulled), rather than by the first
+// invocation, and again whenever they are lost (unless creating one
+// fails).  The evictor may still reclaim paused sandboxes if the
+// memory pool runs short.
+//
+// Lambdas listed in the prewarm manifest are loaded when the worker
+// starts: their code and packages are pulled, and (at least) one
+// sandbox is created, which also initializes the Zygotes it forks
+// from.  /status doesn't report the worker ready until that's done.
+
+// PrewarmManifest lists lambdas to prewarm (see
+// common.Config.Prewarm_manifest)
+type PrewarmManifest struct {
+	Lambdas []string `json:"lambdas"`
+}
+
+// LoadPrewarmManifest reads the manifest at path
+func LoadPrewarmManifest(path string) (*PrewarmManifest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read prewarm manifest: %v", err)
+	}
+
+	manifest := &PrewarmManifest{}
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		return nil, fmt.Errorf("could not parse prewarm manifest (%s): %v", path, err)
+	}
+	return manifest, nil
+}
+
+// minInstances is how many instances keep a sandbox ready, per the
+// lambda's config (or the worker's)
+func (f *LambdaFunc) minInstances() int {
+	if f.conf != nil && f.conf.Min_instances > 0 {
+		return f.conf.Min_instances
+	}
+	return common.Conf.Limits.Min_instances
+}
+
+// warmInstances is how many instances keep a sandbox ready
+// (min_instances, but at least one if the lambda was prewarmed, and
+// no more than max_instances)
+func (f *LambdaFunc) warmInstances() int {
+	warm := f.minInstances()
+	if f.prewarmed {
+		warm = common.Max(warm, 1)
+	}
+	if max := f.maxInstances(); max > 0 {
+		warm = common.Min(warm, max)
+	}
+	return warm
+}
+
+// keepWarm tells the first warmInstances() instances (that haven't
+// been told yet) to keep a sandbox ready.  It returns chans that are
+// closed once each of those instances has its first sandbox ready
+// (or failed to create it).  Called by the function's Task.
+func (f *LambdaFunc) keepWarm() []chan bool {
+	warming := []chan bool{}
+
+	el := f.instances.Front()
+	for i := 0; i < f.warmInstances() && el != nil; i++ {
+		linst := el.Value.(*LambdaInstance)
+		if !linst.warmRequested {
+			linst.warmRequested = true
+			linst.warmChan <- true
+		}
+		warming = append(warming, linst.warmed)
+		el = el.Next()
+	}
+
+	return warming
+}
+
+// Prewarm pulls the function's code and packages, and returns once
+// its warm instances have sandboxes ready
+func (f *LambdaFunc) Prewarm() error {
+	reply := make(chan error, 1)
+	select {
+	case f.prewarmChan <- reply:
+	case <-f.exited:
+		return ErrNotLoaded
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-f.exited:
+		return ErrNotLoaded
+	}
+}
+
+// prewarmProgress tracks the prewarming of the lambdas in the manifest
+type prewarmProgress struct {
+	mutex  sync.Mutex
+	total  int
+	done   int
+	failed []string
+}
+
+// Prewarm starts prewarming the named lambdas (all at once), in the
+// background; PrewarmStatus tells when they are all ready (or failed
+// to get ready).  For an alias, every version it routes to is
+// prewarmed.
+func (mgr *LambdaMgr) Prewarm(names []string) {
+	fullNames := []string{}
+	for _, name := range names {
+		versions, err := mgr.aliasVersions(name)
+		if err != nil {
+			lambdaLog.With("lambda", name).Errorf("could not prewarm: %v", err)
+			continue
+		}
+		fullNames = append(fullNames, versions...)
+	}
+
+	progress := &mgr.prewarm
+	progress.mutex.Lock()
+	progress.total += len(fullNames)
+	progress.mutex.Unlock()
+
+	for _, name := range fullNames {
+		go func(name string) {
+			logger := lambdaLog.With("lambda", name)
+			logger.Infof("prewarming")
+			err := mgr.Get(name).Prewarm()
+
+			progress.mutex.Lock()
+			defer progress.mutex.Unlock()
+			progress.done++
+			if err != nil {
+				logger.Errorf("could not prewarm: %v", err)
+				progress.failed = append(progress.failed, name)
+			} else {
+				logger.Infof("prewarmed")
+			}
+		}(name)
+	}
+}
+
+// PrewarmStatus reports whether prewarming is still underway, and how
+// far along it is
+func (mgr *LambdaMgr) PrewarmStatus() (warming bool, done int, total int, failed []string) {
+	progress := &mgr.prewarm
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+
+	warming = progress.done < progress.total
+	return warming, progress.done, progress.total, append([]string{}, progress.failed...)
+}
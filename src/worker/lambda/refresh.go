@@ -0,0 +1,76 @@
+package lambda
+
+import (
+	"os"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+	"github.com/open-lambda/open-lambda/ol/worker/sandbox"
+)
+
+// code refresh (stale-while-revalidate)
+//
+// A lambda's first code is pulled by the invocation that loads it,
+// which waits (there is nothing else to run).  After that, once the
+// code is older than registry_cache_ms, the next invocation starts a
+// refresh in the background (pulling, unpacking, and installing
+// packages) and is served by the current code, as are invocations
+// that arrive until the refresh is done.  Then the function's Task
+// switches to the new code, if any, in one step.  A failed refresh
+// leaves the current code in place, and is reported in the lambda's
+// status and metrics (rather than to invocations); the next one is
+// tried once registry_cache_ms has passed again.
+
+// lambdaCode is a version of a lambda's code, ready to run
+type lambdaCode struct {
+	rtType  common.RuntimeType
+	codeDir string
+	meta    *sandbox.SandboxMeta
+	conf    *LambdaConfig
+}
+
+// codeRefresh is the outcome of a background check for new code
+type codeRefresh struct {
+	// nil if the code hasn't changed (or err is set)
+	code    *lambdaCode
+	err     error
+	started time.Time
+}
+
+// codeStale says whether to check for new code (never, once we have a
+// version's code, as versions are immutable)
+func (f *LambdaFunc) codeStale() bool {
+	if f.lastPull == nil {
+		return true
+	}
+	if isVersioned(f.name) {
+		return false
+	}
+	cache := time.Duration(common.Conf.Registry_cache_ms) * time.Millisecond
+	return time.Since(*f.lastPull) >= cache
+}
+
+// refreshFailed records a failed refresh.  Called by the Task.
+func (f *LambdaFunc) refreshFailed(refresh *codeRefresh) {
+	f.logger().Errorf("could not refresh code (still serving %s): %v", f.codeDir, refresh.err)
+	f.refreshError = refresh
+	f.refreshFailures++
+	refreshFailuresMetric.With(f.name).Inc()
+}
+
+// discardRefresh returns a chan that is closed once the refresh in
+// progress is done, and any code it prepared has been deleted.  Called
+// by the Task when it is killed.
+func (f *LambdaFunc) discardRefresh(refreshDone chan *codeRefresh) chan bool {
+	done := make(chan bool)
+	go func() {
+		refresh := <-refreshDone
+		if refresh.code != nil {
+			if err := os.RemoveAll(refresh.code.codeDir); err != nil {
+				f.logger().Warnf("could not cleanup %s after discarding refresh: %v", refresh.code.codeDir, err)
+			}
+		}
+		close(done)
+	}()
+	return done
+}
@@ -0,0 +1,203 @@
+package lambda
+
+import (
+	"container/list"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// rolling code updates
+//
+// When a lambda switches to new code (see refresh.go), its instances
+// on the old code are retired gradually rather than killed at once.
+// They keep serving invocations while instances on the new code
+// start, and each new instance creates a sandbox before it takes any
+// invocations.  As new instances get ready, old ones finish their
+// current invocation and exit, keeping at most
+// limits.update_max_surge instances beyond the lambda's instance
+// count when the update began, and at most
+// limits.update_max_unavailable fewer than that ready.  Old code is
+// deleted once the last instance using it has exited.
+//
+// If an instance on the new code can't create a sandbox, the update
+// is abandoned: instances on the new code are killed and it is
+// deleted, and the lambda goes back to the code its newest retiring
+// instances run.  Those serve (and scale) as before, and the failure
+// is reported like a failed refresh (see refresh.go), so the new code
+// is tried again once registry_cache_ms has passed.
+//
+// The autoscaler holds the instance count until the update is done.
+
+// rolloutLimits returns how many instances an update may add beyond
+// the rollout target, and how many it may leave unready (at least one
+// of them is positive, so updates make progress)
+func rolloutLimits() (surge int, unavailable int) {
+	surge = common.Conf.Limits.Update_max_surge
+	unavailable = common.Conf.Limits.Update_max_unavailable
+	if surge == 0 && unavailable == 0 {
+		surge = 1
+	}
+	return surge, unavailable
+}
+
+// startRollout retires the function's instances, which run code that
+// has just been replaced.  Called by the Task.
+func (f *LambdaFunc) startRollout() {
+	if f.retiring.Len() == 0 {
+		// an update that replaces one still in progress
+		// keeps the first one's target
+		f.rolloutTarget = f.instances.Len()
+	}
+	f.retiring.PushBackList(f.instances)
+	f.instances = list.New()
+
+	if f.retiring.Len() > 0 {
+		f.printf("rolling %d instances to %s", f.retiring.Len(), f.codeDir)
+	}
+}
+
+// rolloutStep starts instances on the new code, and retires old ones
+// as the new ones get ready, within the rollout limits.  Called by
+// the Task whenever anything changes, until no old instances remain.
+func (f *LambdaFunc) rolloutStep(cleanupChan chan any) {
+	surge, unavailable := rolloutLimits()
+	target := f.rolloutTarget
+
+	ready, failed := 0, 0
+	for el := f.instances.Front(); el != nil; el = el.Next() {
+		linst := el.Value.(*LambdaInstance)
+		if linst.isReady() {
+			ready++
+		} else if linst.isWarmed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		f.abandonRollout(failed, cleanupChan)
+		return
+	}
+
+	for f.retiring.Len() > 0 && ready+f.retiring.Len()-1 >= target-unavailable {
+		f.retireOne(cleanupChan)
+	}
+
+	for f.instances.Len() < target && f.instances.Len()+f.retiring.Len() < target+surge {
+		f.prepareInstance(f.newInstance(true))
+	}
+
+	if f.retiring.Len() == 0 {
+		f.printf("rolled %d instances to %s", f.instances.Len(), f.codeDir)
+	}
+}
+
+// abandonRollout goes back to the code the newest retiring instances
+// run, after failed instances on the new code couldn't create a
+// sandbox.  Retiring instances on that code serve again, and any on
+// even older code (from an update this one replaced) retire now, so
+// the autoscaler resumes.
+func (f *LambdaFunc) abandonRollout(failed int, cleanupChan chan any) {
+	failedCodeDir := f.codeDir
+	err := fmt.Errorf("abandoned update to %s: %d instances on it could not create a sandbox", failedCodeDir, failed)
+
+	for el := f.instances.Front(); el != nil; el = el.Next() {
+		cleanupChan <- el.Value.(*LambdaInstance).AsyncKill()
+	}
+
+	newest := f.retiring.Back().Value.(*LambdaInstance)
+	f.rtType = newest.rtType
+	f.codeDir = newest.codeDir
+	f.meta = newest.meta
+	f.conf = newest.conf
+
+	retiring := f.retiring
+	f.instances = list.New()
+	f.retiring = list.New()
+	for el := retiring.Front(); el != nil; el = el.Next() {
+		linst := el.Value.(*LambdaInstance)
+		if linst.codeDir == f.codeDir {
+			f.instances.PushBack(linst)
+		} else {
+			f.retiring.PushBack(linst)
+		}
+	}
+	for f.retiring.Len() > 0 {
+		f.retireOne(cleanupChan)
+	}
+
+	// cleanupChan is a FIFO, so this will happen after the
+	// instances on the failed code are gone.  The puller would
+	// hand back the deleted directory, so it starts over.
+	cleanupChan <- failedCodeDir
+	f.lmgr.HandlerPuller.Reset(f.name)
+
+	// the failed code may have changed the lambda's schedules
+	if f.lmgr.Scheduler != nil && !isVersioned(f.name) && f.conf != nil {
+		if err := f.lmgr.SetLambdaSchedules(f.name, f.conf.scheduleSpecs(f.name)); err != nil {
+			f.logger().Warnf("could not restore schedules: %v", err)
+		}
+	}
+
+	f.refreshFailed(&codeRefresh{err: err, started: *f.lastPull})
+}
+
+// prepareInstance tells the Task (via rolloutChan) once a new
+// instance has created its first sandbox (or failed to)
+func (f *LambdaFunc) prepareInstance(linst *LambdaInstance) {
+	go func() {
+		<-linst.warmed
+		select {
+		case f.rolloutChan <- true:
+		default:
+			// the Task already has a wakeup pending
+		}
+	}()
+}
+
+// retireOne kills the oldest retiring instance, once it finishes its
+// current invocation, then deletes its code, unless other instances
+// still use it
+func (f *LambdaFunc) retireOne(cleanupChan chan any) {
+	el := f.retiring.Front()
+	linst := el.Value.(*LambdaInstance)
+	f.retiring.Remove(el)
+
+	cleanupChan <- linst.AsyncKill()
+	if !f.codeDirInUse(linst.codeDir) {
+		// cleanupChan is a FIFO, so this will happen after
+		// the cleanup task waits for the kill to finish
+		cleanupChan <- linst.codeDir
+	}
+}
+
+// codeDirInUse says whether the current code or any instance that
+// hasn't been retired uses codeDir
+func (f *LambdaFunc) codeDirInUse(codeDir string) bool {
+	if codeDir == f.codeDir {
+		return true
+	}
+	for el := f.retiring.Front(); el != nil; el = el.Next() {
+		if el.Value.(*LambdaInstance).codeDir == codeDir {
+			return true
+		}
+	}
+	return false
+}
+
+// isReady says whether the instance created the sandbox it was asked
+// to
+func (linst *LambdaInstance) isReady() bool {
+	return linst.isWarmed() && atomic.LoadInt32(&linst.warmedOK) == 1
+}
+
+// isWarmed says whether the instance has finished trying to create
+// the sandbox it was asked to (see prewarm.go)
+func (linst *LambdaInstance) isWarmed() bool {
+	select {
+	case <-linst.warmed:
+		return true
+	default:
+		return false
+	}
+}
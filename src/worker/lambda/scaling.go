@@ -0,0 +1,201 @@
+package lambda
+
+import (
+	"math"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// autoscaling
+//
+// Whenever its state changes, a LambdaFunc's Task asks a ScalingPolicy
+// how many instances it should have, then an autoscaler moves toward
+// that number: clamped to the min and max instances (but always at
+// least one, which costs little until it has a sandbox), by at most
+// scaling.step instances per scaling.interval_ms, and only scaling
+// down once the policy has wanted fewer instances for
+// scaling.scale_down_delay_ms.  Policies are chosen (and tuned) by the
+// "scaling" section of the worker config, or of a lambda's ol.yaml.
+
+// ScalingLoad is what a ScalingPolicy knows about a lambda
+type ScalingLoad struct {
+	// current instances
+	Instances int
+
+	// invocations queued or running, and those of them queued
+	Outstanding int
+	Queued      int
+
+	// average execution time of the last few invocations
+	AvgExecMs int
+
+	// invocations per second recently (smoothed)
+	ArrivalsPerSec float64
+}
+
+// ScalingPolicy decides how many instances a lambda should have
+// (before the min and max are applied)
+type ScalingPolicy interface {
+	DesiredInstances(load ScalingLoad) int
+}
+
+// NewScalingPolicy returns the policy that conf names
+func NewScalingPolicy(conf common.ScalingConfig) ScalingPolicy {
+	switch conf.Policy {
+	case common.SCALING_CONCURRENCY:
+		return &concurrencyPolicy{target: common.Max(conf.Target_concurrency, 1)}
+	case common.SCALING_PREDICTIVE:
+		return &predictivePolicy{target: common.Max(conf.Target_concurrency, 1)}
+	default:
+		return &workPolicy{workMs: common.Max(conf.Work_ms, 1)}
+	}
+}
+
+// workPolicy aims for one instance per workMs of outstanding work
+type workPolicy struct {
+	workMs int
+}
+
+func (p *workPolicy) DesiredInstances(load ScalingLoad) int {
+	desired := load.Outstanding * load.AvgExecMs / p.workMs
+
+	// if we have, say, one job that will take 100 seconds,
+	// spinning up 100 instances won't do any good, so cap by
+	// number of outstanding reqs
+	return common.Min(desired, load.Outstanding)
+}
+
+// concurrencyPolicy aims for target outstanding invocations per
+// instance
+type concurrencyPolicy struct {
+	target int
+}
+
+func (p *concurrencyPolicy) DesiredInstances(load ScalingLoad) int {
+	return ceilDiv(load.Outstanding, p.target)
+}
+
+// predictivePolicy aims to have enough instances for the invocations
+// expected to be running at once (arrival rate times execution time),
+// so instances are ready before a queue builds up, and are kept
+// through brief lulls in a steady stream of invocations
+type predictivePolicy struct {
+	target int
+}
+
+func (p *predictivePolicy) DesiredInstances(load ScalingLoad) int {
+	expected := load.ArrivalsPerSec * float64(load.AvgExecMs) / 1000
+	predicted := int(math.Ceil(expected / float64(p.target)))
+	return common.Max(predicted, ceilDiv(load.Outstanding, p.target))
+}
+
+func ceilDiv(x int, y int) int {
+	return (x + y - 1) / y
+}
+
+// autoscaler tracks what a LambdaFunc's Task needs for scaling
+// decisions (it is only used by the Task)
+type autoscaler struct {
+	lastScaling time.Time
+
+	// when the policy started wanting fewer instances than the
+	// lambda has (zero if it doesn't)
+	scaleDownSince time.Time
+
+	// invocations that arrived since rateStart, and the smoothed
+	// arrival rate before that
+	arrivals  int
+	rateStart time.Time
+	rate      float64
+}
+
+// arrived counts an invocation, for the arrival rate
+func (as *autoscaler) arrived() {
+	as.arrivals++
+}
+
+// arrivalRate returns the smoothed arrivals per second, updating it
+// about once per second (with older seconds weighing less each time)
+func (as *autoscaler) arrivalRate(now time.Time) float64 {
+	if as.rateStart.IsZero() {
+		as.rateStart = now
+		return as.rate
+	}
+
+	elapsed := now.Sub(as.rateStart)
+	if elapsed >= time.Second {
+		sample := float64(as.arrivals) / elapsed.Seconds()
+		weight := 1 - math.Pow(0.5, elapsed.Seconds())
+		as.rate += weight * (sample - as.rate)
+		if as.rate < 0.01 {
+			as.rate = 0
+		}
+		as.arrivals = 0
+		as.rateStart = now
+	}
+	return as.rate
+}
+
+// plan decides how many instances the lambda should have now, and
+// how soon to plan again even if nothing else happens (0 means only
+// once something does)
+func (as *autoscaler) plan(conf common.ScalingConfig, minInstances int, maxInstances int, load ScalingLoad, now time.Time) (target int, recheck time.Duration) {
+	desired := NewScalingPolicy(conf).DesiredInstances(load)
+	if min := common.Max(minInstances, 1); desired < min {
+		desired = min
+	}
+	if maxInstances > 0 && desired > maxInstances {
+		desired = maxInstances
+	}
+
+	// the predictive policy needs to see the arrival rate decay
+	// once invocations stop arriving
+	if conf.Policy == common.SCALING_PREDICTIVE && as.rate > 0 {
+		recheck = time.Second
+	}
+
+	current := load.Instances
+	if desired == current {
+		as.scaleDownSince = time.Time{}
+		return current, recheck
+	}
+
+	interval := time.Duration(conf.Interval_ms) * time.Millisecond
+	if elapsed := now.Sub(as.lastScaling); elapsed < interval {
+		return current, interval - elapsed
+	}
+
+	step := common.Max(conf.Step, 1)
+	if desired > current {
+		as.scaleDownSince = time.Time{}
+		target = common.Min(current+step, desired)
+	} else {
+		if as.scaleDownSince.IsZero() {
+			as.scaleDownSince = now
+		}
+		delay := time.Duration(conf.Scale_down_delay_ms) * time.Millisecond
+		if waited := now.Sub(as.scaleDownSince); waited < delay {
+			return current, delay - waited
+		}
+		target = common.Max(current-step, desired)
+	}
+
+	as.lastScaling = now
+	if target != desired {
+		// we can only adjust so quickly, so come back as
+		// soon as we can, even if there are no requests
+		recheck = interval
+	}
+	return target, recheck
+}
+
+// scalingConf is the worker's scaling config, with the lambda's
+// own settings (if any) taking precedence
+func (f *LambdaFunc) scalingConf() common.ScalingConfig {
+	conf := common.Conf.Scaling
+	if f.conf != nil {
+		conf = conf.Override(f.conf.Scaling)
+	}
+	return conf
+}
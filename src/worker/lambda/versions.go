@@ -0,0 +1,264 @@
+package lambda
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// versions and aliases
+//
+// Besides the usual artifact for a lambda (e.g., hello.tar.gz), the
+// registry may hold immutable numbered versions of it, named with an
+// "@" (e.g., hello@1.tar.gz, hello@2.py).  Each is invoked by its full
+// name (/run/hello@2), and is a separate LambdaFunc, with its own
+// instances, stats, and metrics.  As versions never change, their
+// code is pulled only once.
+//
+// A lambda may also have aliases, listed in hello.aliases.json next to
+// its versions in the registry, each of which routes invocations
+// between versions by weight.  For example:
+//
+//	{"prod": {"3": 95, "4": 5}, "canary": {"4": 1}}
+//
+// sends 5% of /run/hello@prod invocations to hello@4, and the rest to
+// hello@3.  The file is re-read at most every registry_cache_ms, so
+// editing it promotes (or rolls back) a version on every worker.
+
+// responses to aliased invocations say which version served them
+const VERSION_HEADER = "X-OL-Version"
+
+// suffix of a lambda's alias file in the registry
+const ALIAS_FILE_SUFFIX = ".aliases.json"
+
+var versionRegex = regexp.MustCompile(`^[1-9][0-9]*$`)
+var aliasNameRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9\-\_]*$`)
+
+var ErrAliasNotFound = errors.New("no such alias")
+
+// aliasRoute is a version that an alias sends a share of invocations to
+type aliasRoute struct {
+	version string
+	weight  int
+}
+
+// aliasEntry caches a lambda's aliases (nil if it has none)
+type aliasEntry struct {
+	fetched time.Time
+	aliases map[string][]aliasRoute
+}
+
+// splitLambdaName splits "name@ref" into name and ref ("" if there
+// is no "@"), where ref is a version or an alias
+func splitLambdaName(fullName string) (name string, ref string) {
+	if i := strings.LastIndex(fullName, "@"); i >= 0 {
+		return fullName[:i], fullName[i+1:]
+	}
+	return fullName, ""
+}
+
+// baseLambdaName strips any version or alias from a lambda's name
+func baseLambdaName(fullName string) string {
+	name, _ := splitLambdaName(fullName)
+	return name
+}
+
+// isVersioned tells whether the name is of a specific version
+func isVersioned(fullName string) bool {
+	_, ref := splitLambdaName(fullName)
+	return ref != ""
+}
+
+// parseAliases reads the contents of an alias file
+func parseAliases(raw []byte) (map[string][]aliasRoute, error) {
+	var weights map[string]map[string]int
+	if err := json.Unmarshal(raw, &weights); err != nil {
+		return nil, err
+	}
+
+	aliases := map[string][]aliasRoute{}
+	for alias, versions := range weights {
+		if !aliasNameRegex.MatchString(alias) {
+			return nil, fmt.Errorf("bad alias name '%s' (must start with a letter, then letters, digits, '-' or '_')", alias)
+		}
+
+		routes := []aliasRoute{}
+		total := 0
+		for version, weight := range versions {
+			if !versionRegex.MatchString(version) {
+				return nil, fmt.Errorf("alias '%s': bad version '%s' (versions are positive integers)", alias, version)
+			}
+			if weight < 0 {
+				return nil, fmt.Errorf("alias '%s': version %s has a negative weight", alias, version)
+			}
+			if weight > 0 {
+				routes = append(routes, aliasRoute{version, weight})
+				total += weight
+			}
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("alias '%s' does not route to any version", alias)
+		}
+
+		// deterministic order, for picking by weight
+		sort.Slice(routes, func(i, j int) bool {
+			return routes[i].version < routes[j].version
+		})
+		aliases[alias] = routes
+	}
+
+	return aliases, nil
+}
+
+// pickVersion chooses one of the routes, with probability
+// proportional to its weight
+func pickVersion(routes []aliasRoute) string {
+	total := 0
+	for _, route := range routes {
+		total += route.weight
+	}
+
+	n := rand.Intn(total)
+	for _, route := range routes {
+		if n < route.weight {
+			return route.version
+		}
+		n -= route.weight
+	}
+	panic("unreachable")
+}
+
+// loadAliases returns the aliases of the named lambda (nil if it has
+// none), re-reading them from the registry if the cached copy is
+// older than registry_cache_ms
+func (cp *HandlerPuller) loadAliases(name string) (map[string][]aliasRoute, error) {
+	if !handlerNameRegex.MatchString(name) {
+		return nil, fmt.Errorf("bad lambda name '%s'", name)
+	}
+
+	if cached, ok := cp.aliasCache.Load(name); ok {
+		entry := cached.(*aliasEntry)
+		if time.Since(entry.fetched) < time.Duration(common.Conf.Registry_cache_ms)*time.Millisecond {
+			return entry.aliases, nil
+		}
+	}
+
+	var raw []byte
+	var err error
+	if cp.isRemote() {
+		raw, err = cp.fetchRemoteAliases(cp.prefix + "/" + name + ALIAS_FILE_SUFFIX)
+	} else {
+		raw, err = ioutil.ReadFile(filepath.Join(cp.prefix, name) + ALIAS_FILE_SUFFIX)
+		if os.IsNotExist(err) {
+			raw, err = nil, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read aliases of %s: %v", name, err)
+	}
+
+	var aliases map[string][]aliasRoute
+	if raw != nil {
+		if aliases, err = parseAliases(raw); err != nil {
+			return nil, fmt.Errorf("bad %s%s: %v", name, ALIAS_FILE_SUFFIX, err)
+		}
+	}
+
+	cp.aliasCache.Store(name, &aliasEntry{fetched: time.Now(), aliases: aliases})
+	return aliases, nil
+}
+
+// fetchRemoteAliases downloads an alias file (nil if there is none)
+func (cp *HandlerPuller) fetchRemoteAliases(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Resolve maps the name of an alias (name@alias) to the name of one
+// of the versions it routes to (name@version), picked by weight.
+// Other names are returned as they are.
+func (mgr *LambdaMgr) Resolve(fullName string) (string, error) {
+	name, ref := splitLambdaName(fullName)
+	if ref == "" || versionRegex.MatchString(ref) {
+		return fullName, nil
+	}
+
+	aliases, err := mgr.HandlerPuller.loadAliases(name)
+	if err != nil {
+		return "", err
+	}
+
+	routes, ok := aliases[ref]
+	if !ok {
+		return "", fmt.Errorf("%w '%s' for lambda %s", ErrAliasNotFound, ref, name)
+	}
+	return name + "@" + pickVersion(routes), nil
+}
+
+// aliasVersions returns the names of all the versions that an alias
+// routes to (or just the name, if it isn't an alias)
+func (mgr *LambdaMgr) aliasVersions(fullName string) ([]string, error) {
+	name, ref := splitLambdaName(fullName)
+	if ref == "" || versionRegex.MatchString(ref) {
+		return []string{fullName}, nil
+	}
+
+	aliases, err := mgr.HandlerPuller.loadAliases(name)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, ok := aliases[ref]
+	if !ok {
+		return nil, fmt.Errorf("%w '%s' for lambda %s", ErrAliasNotFound, ref, name)
+	}
+
+	names := []string{}
+	for _, route := range routes {
+		names = append(names, name+"@"+route.version)
+	}
+	return names, nil
+}
+
+// Invoke invokes the named lambda, first resolving it to a version
+// if it is an alias
+func (mgr *LambdaMgr) Invoke(fullName string, w http.ResponseWriter, r *http.Request) {
+	resolved, err := mgr.Resolve(fullName)
+	if err != nil {
+		lambdaLog.With("lambda", fullName).Warnf("could not resolve: %v", err)
+		if errors.Is(err, ErrAliasNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	if resolved != fullName {
+		_, version := splitLambdaName(resolved)
+		w.Header().Set(VERSION_HEADER, version)
+	}
+	mgr.Get(resolved).Invoke(w, r)
+}
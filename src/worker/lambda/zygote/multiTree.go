@@ -1,7 +1,6 @@
 package zygote
 
 import (
-	"log"
 	"math/rand"
 	"runtime"
 
@@ -24,7 +23,7 @@ func NewMultiTree(codeDirs *common.DirMaker, scratchDirs *common.DirMaker, sbPoo
 	default:
 		tree_count = cpus * 2
 	}
-	log.Printf("Starting MultiTree ZygoteProvider with %d trees (tree count equals CPU count, with min of 3 and max of 10).", tree_count)
+	zygoteLog.Infof("Starting MultiTree ZygoteProvider with %d trees (tree count equals CPU count, with min of 3 and max of 10).", tree_count)
 
 	trees := make([]*ImportCache, tree_count)
 	for i := range trees {
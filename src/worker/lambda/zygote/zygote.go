@@ -1,7 +1,6 @@
 package zygote
 
 import (
-	"log"
 	"fmt"
 
 	"github.com/open-lambda/open-lambda/ol/common"
@@ -9,12 +8,14 @@ import (
 	"github.com/open-lambda/open-lambda/ol/worker/sandbox"
 )
 
+var zygoteLog = common.NewLogger("zygote")
+
 func NewZygoteProvider(codeDirs *common.DirMaker, scratchDirs *common.DirMaker, sbPool sandbox.SandboxPool, pp *packages.PackagePuller) (ZygoteProvider, error) {
 	switch impl := common.Conf.Features.Import_cache; impl {
 	case "tree":
 		return NewImportCache(codeDirs, scratchDirs, sbPool, pp)
 	case "multitree":
-		log.Printf("ZygoteProvider %s is very experimental.", impl)
+		zygoteLog.Infof("ZygoteProvider %s is very experimental.", impl)
 		return NewMultiTree(codeDirs, scratchDirs, sbPool, pp)
 	default:
 		return nil, fmt.Errorf("ZygoteProvider '%s' is not implemented", impl)
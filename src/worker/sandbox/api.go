@@ -85,10 +85,13 @@ type Sandbox interface {
 }
 
 type SandboxMeta struct {
-	Installs   []string
-	Imports    []string
-	MemLimitMB int
-	CPUPercent int
+	Installs      []string
+	Imports       []string
+	MemLimitMB    int
+	CPUPercent    int
+	MaxRuntimeSec int
+	Procs         int
+	Env           map[string]string
 }
 
 type SandboxError string
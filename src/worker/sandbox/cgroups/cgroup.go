@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"strconv"
 	"strings"
@@ -21,10 +20,7 @@ type CgroupImpl struct {
 }
 
 func (cg *CgroupImpl) printf(format string, args ...any) {
-	if common.Conf.Trace.Cgroups {
-		msg := fmt.Sprintf(format, args...)
-		log.Printf("%s [CGROUP %s: %s]", strings.TrimRight(msg, "\n"), cg.pool.Name, cg.name)
-	}
+	cgroupLog.With("pool", cg.pool.Name, "cgroup", cg.name).Debugf(format, args...)
 }
 
 func (cg *CgroupImpl) Name() string {
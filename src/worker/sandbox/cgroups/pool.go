@@ -3,10 +3,8 @@ package cgroups
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
-	"strings"
 	"syscall"
 	"time"
 
@@ -17,6 +15,8 @@ import (
 // If there are more than 2*CGROUP_RESERVE available, they'll be released.
 const CGROUP_RESERVE = 16
 
+var cgroupLog = common.NewLogger("cgroup")
+
 type CgroupPool struct {
 	Name     string
 	ready    chan *CgroupImpl
@@ -72,8 +72,7 @@ func (pool *CgroupPool) NewCgroup() Cgroup {
 // add ID to each log message so we know which logs correspond to
 // which containers
 func (pool *CgroupPool) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [CGROUP POOL %s]", strings.TrimRight(msg, "\n"), pool.Name)
+	cgroupLog.With("pool", pool.Name).Infof(format, args...)
 }
 
 func (pool *CgroupPool) cgTask() {
@@ -159,11 +158,15 @@ func (pool *CgroupPool) Destroy() {
 	}
 }
 
-func (pool *CgroupPool) GetCg(memLimitMB int, moveMemCharge bool, cpuPercent int) Cgroup {
+func (pool *CgroupPool) GetCg(memLimitMB int, moveMemCharge bool, cpuPercent int, procs int) Cgroup {
 	cg := <-pool.ready
 	cg.SetMemLimitMB(memLimitMB)
 	cg.SetCPUPercent(cpuPercent)
 
+	// recycled cgroups may have been used by a lambda with a
+	// different process limit
+	cg.WriteInt("pids.max", int64(procs))
+
 	// FIXME not supported in CG2?
 	var _ = moveMemCharge
 
@@ -94,19 +94,30 @@ func (pool *DockerPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir
 		pkgDirs = append(pkgDirs, "/packages/"+pkg+"/files")
 	}
 
+	env := []string{"PYTHONPATH=" + strings.Join(pkgDirs, ":")}
+	for k, v := range meta.Env {
+		env = append(env, k+"="+v)
+	}
+
+	pidsLimit := int64(meta.Procs)
+
 	container, err := pool.client.CreateContainer(
 		docker.CreateContainerOptions{
 			Config: &docker.Config{
 				Cmd:    []string{"/spin"},
 				Image:  dockerutil.LAMBDA_IMAGE,
 				Labels: pool.labels,
-				Env:    []string{"PYTHONPATH=" + strings.Join(pkgDirs, ":")},
+				Env:    env,
 			},
 			HostConfig: &docker.HostConfig{
-				Binds:   volumes,
-				CapAdd:  pool.caps,
-				PidMode: pool.pidMode,
-				Runtime: pool.dockerRuntime,
+				Binds:     volumes,
+				CapAdd:    pool.caps,
+				PidMode:   pool.pidMode,
+				Runtime:   pool.dockerRuntime,
+				Memory:    int64(meta.MemLimitMB) * 1024 * 1024,
+				CPUPeriod: 100000,
+				CPUQuota:  int64(meta.CPUPercent) * 1000,
+				PidsLimit: &pidsLimit,
 			},
 		},
 	)
@@ -150,7 +161,7 @@ func (pool *DockerPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir
 
 	c.httpClient = &http.Client{
 		Transport: &http.Transport{Dial: dial},
-		Timeout: time.Second * time.Duration(common.Conf.Limits.Max_runtime_default),
+		Timeout: time.Second * time.Duration(meta.MaxRuntimeSec),
 	}
 
 	// wrap to make thread-safe and handle container death
@@ -3,8 +3,6 @@ package sandbox
 import (
 	"container/list"
 	"fmt"
-	"log"
-	"strings"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 )
@@ -18,6 +16,11 @@ const FREE_SANDBOXES_PERCENT_GOAL = 20
 // the maximum number of evictions we'll do concurrently
 const CONCURRENT_EVICTIONS = 8
 
+var evictorLog = common.NewLogger("evictor")
+
+var evictionsMetric = common.NewCounterVec("ol_evictions_total",
+	"Sandboxes the evictor chose to destroy (forced evictions may interrupt requests).", "kind")
+
 type SOCKEvictor struct {
 	// used to track memory pressure
 	mem *MemPool
@@ -111,10 +114,7 @@ func (evictor *SOCKEvictor) nextEvent(block bool) *SandboxEvent {
 }
 
 func (_ *SOCKEvictor) printf(format string, args ...any) {
-	if common.Conf.Trace.Evictor {
-		msg := fmt.Sprintf(format, args...)
-		log.Printf("%s [EVICTOR]", strings.TrimRight(msg, "\n"))
-	}
+	evictorLog.Debugf(format, args...)
 }
 
 // update state based on messages sent to this task.  this may be
@@ -181,6 +181,12 @@ func (evictor *SOCKEvictor) evictFront(queue *list.List, force bool) {
 	evictor.printf("Evict Sandbox %v", sb.ID())
 	evictor.move(sb, evictor.evicting)
 
+	if force {
+		evictionsMetric.With("forced").Inc()
+	} else {
+		evictionsMetric.With("idle").Inc()
+	}
+
 	// destroy async (we'll know when it's done, because
 	// we'll see a evDestroy event later on our chan)
 	go func() {
@@ -203,7 +209,7 @@ func (evictor *SOCKEvictor) doEvictions() {
 
 	// how many sandboxes would we like to be able to spin up,
 	// without waiting for more memory?
-	freeGoal := 1 + ((evictor.mem.totalMB/memLimitMB)-2)*FREE_SANDBOXES_PERCENT_GOAL/100
+	freeGoal := 1 + ((evictor.mem.getTotalMB()/memLimitMB)-2)*FREE_SANDBOXES_PERCENT_GOAL/100
 
 	// how many shoud we try to evict?
 	//
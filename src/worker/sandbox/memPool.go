@@ -3,17 +3,25 @@ package sandbox
 import (
 	"container/list"
 	"fmt"
-	"log"
-	"strings"
+	"sync"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 )
 
+var memPoolLog = common.NewLogger("mempool")
+
+var memAvailableMetric = common.NewGaugeVec("ol_mem_pool_available_mb",
+	"Memory in the pool not allocated to any sandbox.", "pool")
+var memTotalMetric = common.NewGaugeVec("ol_mem_pool_total_mb",
+	"Memory managed by the pool.", "pool")
+
 type MemPool struct {
 	name string
 
-	// how much memory is being managed (includes free and allocated)
+	// how much memory is being managed (includes free and allocated);
+	// only memTask changes it, but others may read it (with mutex)
 	totalMB int
+	mutex   sync.Mutex
 
 	// a task listens on this, with requests to decrement memory
 	// (which may block) or increment it
@@ -28,6 +36,10 @@ type memReq struct {
 	// how much we're requesting
 	mb int
 
+	// if set, mb is a new total size for the pool, rather than an
+	// adjustment to available memory
+	resize bool
+
 	// any response means the memory is allocated; the particular
 	// number indicates the total remaining memory available in
 	// the pool
@@ -48,10 +60,7 @@ func NewMemPool(name string, totalMB int) *MemPool {
 }
 
 func (pool *MemPool) printf(format string, args ...any) {
-	if common.Conf.Trace.Memory {
-		msg := fmt.Sprintf(format, args...)
-		log.Printf("%s [MEM POOL %s]", strings.TrimRight(msg, "\n"), pool.name)
-	}
+	memPoolLog.With("pool", pool.name).Debugf(format, args...)
 }
 
 // this task is responsible for tracking available memory in the
@@ -59,6 +68,8 @@ func (pool *MemPool) printf(format string, args ...any) {
 // requesters until enough is free
 func (pool *MemPool) memTask() {
 	availableMB := pool.totalMB
+	memTotalMetric.With(pool.name).Set(float64(pool.totalMB))
+	memAvailableMetric.With(pool.name).Set(float64(availableMB))
 
 	for {
 		req, ok := <-pool.memRequests
@@ -66,12 +77,22 @@ func (pool *MemPool) memTask() {
 			return
 		}
 
-		if pool.totalMB+req.mb < 0 {
+		if req.resize {
+			// shrinking may leave availableMB negative, in
+			// which case requests wait until enough memory
+			// is released (the evictor will be freeing it)
+			pool.mutex.Lock()
+			availableMB += req.mb - pool.totalMB
+			pool.totalMB = req.mb
+			pool.mutex.Unlock()
+
+			memPoolLog.With("pool", pool.name).Infof("resized to %d MB (%d MB available)", req.mb, availableMB)
+			memTotalMetric.With(pool.name).Set(float64(req.mb))
+			req.resp <- availableMB
+		} else if pool.totalMB+req.mb < 0 {
 			panic(fmt.Sprintf("received request for %d MB to pool of total size %d MB",
 				-req.mb, pool.totalMB))
-		}
-
-		if req.mb >= 0 {
+		} else if req.mb >= 0 {
 			availableMB += req.mb
 			pool.printf("%d of %d MB available", availableMB, pool.totalMB)
 			req.resp <- availableMB
@@ -90,6 +111,8 @@ func (pool *MemPool) memTask() {
 				req.resp <- availableMB
 			}
 		}
+
+		memAvailableMetric.With(pool.name).Set(float64(availableMB))
 	}
 }
 
@@ -115,3 +138,24 @@ func (pool *MemPool) adjustAvailableMB(mb int) (availableMB int) {
 func (pool *MemPool) getAvailableMB() (availableMB int) {
 	return pool.adjustAvailableMB(0)
 }
+
+func (pool *MemPool) getTotalMB() (totalMB int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.totalMB
+}
+
+// Resize changes the total memory managed by the pool, returning the
+// memory available after the change.  Memory already allocated stays
+// allocated, so after shrinking, available memory may be negative
+// until enough is released.
+func (pool *MemPool) Resize(totalMB int) (availableMB int) {
+	req := &memReq{
+		mb:     totalMB,
+		resize: true,
+		resp:   make(chan int),
+	}
+
+	pool.memRequests <- req
+	return <-req.resp
+}
@@ -9,9 +9,7 @@ package sandbox
 
 import (
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
 	"sync"
 
 	"github.com/open-lambda/open-lambda/ol/common"
@@ -52,8 +50,7 @@ func (sb *safeSandbox) startNotifyingListeners(eventHandlers []SandboxEventFunc)
 
 // like regular printf, with suffix indicating which sandbox produced the message
 func (sb *safeSandbox) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [SB %s]", strings.TrimRight(msg, "\n"), sb.Sandbox.ID())
+	sandboxLog.With("sandbox", sb.Sandbox.ID()).Infof(format, args...)
 }
 
 // propogate event to anybody who signed up to listen (e.g., an evictor)
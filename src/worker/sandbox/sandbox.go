@@ -23,9 +23,27 @@ func SandboxPoolFromConfig(name string, sizeMb int) (cf SandboxPool, err error)
 	return nil, fmt.Errorf("invalid sandbox type: '%s'", common.Conf.Sandbox)
 }
 
+// ResizePool changes the memory a pool may give to its sandboxes.  It
+// returns false if the pool doesn't manage memory (only SOCK pools do).
+func ResizePool(pool SandboxPool, sizeMb int) bool {
+	sockPool, ok := pool.(*SOCKPool)
+	if !ok {
+		return false
+	}
+	sockPool.mem.Resize(sizeMb)
+	return true
+}
+
+// fillMetaDefaults returns a copy of meta with unset limits taken from
+// the current config.  The caller's meta is shared by every sandbox of
+// a lambda, so it is left alone: the defaults may change on a config
+// reload, and sandboxes may be created concurrently.
 func fillMetaDefaults(meta *SandboxMeta) *SandboxMeta {
 	if meta == nil {
 		meta = &SandboxMeta{}
+	} else {
+		copied := *meta
+		meta = &copied
 	}
 	if meta.MemLimitMB == 0 {
 		meta.MemLimitMB = common.Conf.Limits.Mem_mb
@@ -33,12 +51,19 @@ func fillMetaDefaults(meta *SandboxMeta) *SandboxMeta {
 	if meta.CPUPercent == 0 {
 		meta.CPUPercent = common.Conf.Limits.CPU_percent
 	}
+	if meta.MaxRuntimeSec == 0 {
+		meta.MaxRuntimeSec = common.Conf.Limits.Max_runtime_default
+	}
+	if meta.Procs == 0 {
+		meta.Procs = common.Conf.Limits.Procs
+	}
 	return meta
 }
 
 func (meta *SandboxMeta) String() string {
-	return fmt.Sprintf("<installs=[%s], imports=[%s], mem-limit-mb=%v>",
-		strings.Join(meta.Installs, ","), strings.Join(meta.Imports, ","), meta.MemLimitMB)
+	return fmt.Sprintf("<installs=[%s], imports=[%s], mem-limit-mb=%v, cpu-percent=%v, max-runtime-sec=%v, procs=%v>",
+		strings.Join(meta.Installs, ","), strings.Join(meta.Imports, ","), meta.MemLimitMB,
+		meta.CPUPercent, meta.MaxRuntimeSec, meta.Procs)
 }
 
 func (e SandboxError) Error() string {
@@ -3,14 +3,12 @@ package sandbox
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"sync/atomic"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
@@ -44,8 +42,7 @@ type SOCKContainer struct {
 // add ID to each log message so we know which logs correspond to
 // which containers
 func (container *SOCKContainer) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [SOCK %s]", strings.TrimRight(msg, "\n"), container.id)
+	sandboxLog.With("sandbox", container.id).Infof(format, args...)
 }
 
 // ID returns the unique identifier of this container
@@ -85,12 +82,13 @@ func (container *SOCKContainer) freshProc() (err error) {
 			}
 		}
 
-		cmd = exec.Command(
-			"chroot", container.containerRootDir,
-			"env", "RUST_BACKTRACE=full", "/runtimes/native/server", strconv.Itoa(1),
-			strconv.FormatBool(common.Conf.Features.Enable_seccomp),
-
-		)
+		args := []string{"chroot", container.containerRootDir, "env", "RUST_BACKTRACE=full"}
+		for k, v := range container.meta.Env {
+			args = append(args, k+"="+v)
+		}
+		args = append(args, "/runtimes/native/server", strconv.Itoa(1),
+			strconv.FormatBool(common.Conf.Features.Enable_seccomp))
+		cmd = exec.Command(args[0], args[1:]...)
 	} else {
 		return fmt.Errorf("Unsupported runtime")
 	}
@@ -260,7 +258,7 @@ func (container *SOCKContainer) Unpause() (err error) {
 		// block until we have enough mem to upsize limit to the
 		// normal size before unpausing
 		oldLimit := container.cg.GetMemLimitMB()
-		newLimit := common.Conf.Limits.Mem_mb
+		newLimit := container.meta.MemLimitMB
 		container.pool.mem.adjustAvailableMB(oldLimit - newLimit)
 		container.cg.SetMemLimitMB(newLimit)
 	}
@@ -1,6 +1,7 @@
 package sandbox
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -22,6 +23,8 @@ const SOCK_GUEST_INIT = "/ol-init"
 
 var nextId int64
 
+var sandboxLog = common.NewLogger("sandbox")
+
 // SOCKPool is a ContainerFactory that creats docker containeres.
 type SOCKPool struct {
 	name          string
@@ -101,7 +104,7 @@ func (pool *SOCKPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir st
 	// don't want to use this cgroup feature, because the child
 	// would take the blame for ALL of the parent's allocations
 	moveMemCharge := (parent == nil)
-	cSock.cg = pool.cgPool.GetCg(meta.MemLimitMB, moveMemCharge, meta.CPUPercent)
+	cSock.cg = pool.cgPool.GetCg(meta.MemLimitMB, moveMemCharge, meta.CPUPercent, meta.Procs)
 	t2.T1()
 	cSock.printf("use cgroup %s", cSock.cg.Name)
 
@@ -126,6 +129,15 @@ func (pool *SOCKPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir st
 		// add installed packages to the path, and import the modules we'll need
 		var pyCode []string
 
+		// per-lambda environment (JSON strings are valid Python literals)
+		if len(meta.Env) > 0 {
+			env, err := json.Marshal(meta.Env)
+			if err != nil {
+				return nil, err
+			}
+			pyCode = append(pyCode, "os.environ.update("+string(env)+")")
+		}
+
 		for _, pkg := range meta.Installs {
 			path := "'/packages/" + pkg + "/files'"
 			pyCode = append(pyCode, "if os.path.exists("+path+"):")
@@ -192,7 +204,7 @@ func (pool *SOCKPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir st
 
 	cSock.client = &http.Client{
 		Transport: &http.Transport{Dial: dial},
-		Timeout: time.Second * time.Duration(common.Conf.Limits.Max_runtime_default),
+		Timeout: time.Second * time.Duration(meta.MaxRuntimeSec),
 	}
 
 	// event handling
@@ -201,8 +213,7 @@ func (pool *SOCKPool) Create(parent Sandbox, isLeaf bool, codeDir, scratchDir st
 }
 
 func (pool *SOCKPool) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [SOCK POOL %s]", strings.TrimRight(msg, "\n"), pool.name)
+	sandboxLog.With("pool", pool.name).Infof(format, args...)
 }
 
 // handler(...) will be called everytime a sandbox-related event occurs,
@@ -219,7 +230,7 @@ func (pool *SOCKPool) Cleanup() {
 	// user is required to kill all containers before they call
 	// this.  If they did, the memory pool should be full.
 	pool.printf("make sure all memory is free")
-	pool.mem.adjustAvailableMB(-pool.mem.totalMB)
+	pool.mem.adjustAvailableMB(-pool.mem.getTotalMB())
 	pool.printf("memory pool emptied")
 
 	pool.cgPool.Destroy()
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-lambda/open-lambda/ol/common"
+)
+
+// mux patterns registered for lambda_routes, mapped to the lambda
+// each one invokes (so auth can check the key may run it)
+var routePatterns = map[string]string{}
+
+// finds which lambda an invocation (by ID, as the given key sees it)
+// is of, so auth can check the key may run it (set by the lambda
+// server)
+var invocationLambda func(id string, keyID string) (string, bool)
+
+type authError struct {
+	status int
+	msg    string
+}
+
+func (err *authError) Error() string {
+	return err.msg
+}
+
+// authHandler checks credentials (if auth is enabled) before letting
+// mux dispatch a request.  Invocations need a key with the invoke
+// scope that may run the lambda; everything else needs admin.
+func authHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := &common.Conf.Auth
+		if !auth.Enabled || auth.IsPublic(r.URL.Path) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := authenticate(auth, r)
+		if err == nil {
+			err = authorize(key, mux, r)
+		}
+
+		if err != nil {
+			aerr := err.(*authError)
+			keyID := ""
+			if key != nil {
+				keyID = key.ID
+			}
+			serverLog.With("remote", r.RemoteAddr, "key", keyID).Warnf("rejected %s %s: %s", r.Method, r.URL.Path, aerr.msg)
+
+			if aerr.status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="open-lambda"`)
+			}
+			w.WriteHeader(aerr.status)
+			w.Write([]byte(aerr.msg + "\n"))
+			return
+		}
+
+		// e.g., so only this key may cancel invocations it
+		// started
+		mux.ServeHTTP(w, common.WithAuthKeyID(r, key.ID))
+	})
+}
+
+// authenticate finds the key a request was made with, from either an
+// API key or an HMAC signature
+func authenticate(auth *common.AuthConfig, r *http.Request) (*common.AuthKey, error) {
+	if id := r.Header.Get(common.AUTH_KEY_ID_HEADER); id != "" {
+		return authenticateSigned(auth, id, r)
+	}
+
+	secret := r.Header.Get(common.AUTH_API_KEY_HEADER)
+	if bearer := r.Header.Get("Authorization"); secret == "" && strings.HasPrefix(bearer, "Bearer ") {
+		secret = strings.TrimPrefix(bearer, "Bearer ")
+	}
+	if secret == "" {
+		return nil, &authError{http.StatusUnauthorized, "missing credentials"}
+	}
+
+	key := auth.KeyBySecret(secret)
+	if key == nil {
+		return nil, &authError{http.StatusUnauthorized, "unknown API key"}
+	}
+	return key, nil
+}
+
+func authenticateSigned(auth *common.AuthConfig, id string, r *http.Request) (*common.AuthKey, error) {
+	key := auth.KeyByID(id)
+	if key == nil {
+		return nil, &authError{http.StatusUnauthorized, "unknown key ID"}
+	}
+
+	timestamp := r.Header.Get(common.AUTH_TIMESTAMP_HEADER)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, &authError{http.StatusUnauthorized, "missing or bad " + common.AUTH_TIMESTAMP_HEADER}
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(auth.Max_skew_sec)*time.Second {
+		return nil, &authError{http.StatusUnauthorized, "request timestamp is too far from the worker's clock"}
+	}
+
+	// the body is part of the signature, so read it here and
+	// put it back for the handler
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, &authError{http.StatusBadRequest, fmt.Sprintf("could not read body: %v", err)}
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := common.RequestSignature(key.Secret, r.Method, r.RequestURI, timestamp, body)
+	actual := r.Header.Get(common.AUTH_SIGNATURE_HEADER)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(actual))) {
+		return nil, &authError{http.StatusUnauthorized, "bad request signature"}
+	}
+
+	return key, nil
+}
+
+// authorize checks that key has the scope needed for the handler mux
+// would dispatch r to
+func authorize(key *common.AuthKey, mux *http.ServeMux, r *http.Request) error {
+	_, pattern := mux.Handler(r)
+
+	lambdaName, isInvoke := "", false
+	switch pattern {
+	case RUN_PATH, RUN_ASYNC_PATH:
+		isInvoke = true
+		if parts := getURLComponents(r); len(parts) >= 2 {
+			lambdaName = parts[1]
+		}
+	case INVOCATIONS_PATH:
+		// polling or cancelling an invocation needs a key that
+		// may run its lambda.  Only the key that started an
+		// invocation may poll or cancel it (others get a 404, see
+		// lambda.CancelInvocation); sync invocations are
+		// cancelled by request ID, which clients may choose.
+		if !key.HasScope(common.AUTH_SCOPE_INVOKE) {
+			return &authError{http.StatusForbidden, fmt.Sprintf("key '%s' lacks the invoke scope", key.ID)}
+		}
+		parts := getURLComponents(r)
+		if len(parts) != 2 || invocationLambda == nil {
+			return nil
+		}
+		lambdaName, isInvoke = invocationLambda(parts[1], key.ID)
+		if !isInvoke {
+			// unknown, so the handler replies 404
+			return nil
+		}
+	default:
+		lambdaName, isInvoke = routePatterns[pattern]
+	}
+
+	if !isInvoke {
+		if !key.HasScope(common.AUTH_SCOPE_ADMIN) {
+			return &authError{http.StatusForbidden, fmt.Sprintf("key '%s' lacks the admin scope", key.ID)}
+		}
+		return nil
+	}
+
+	if !key.MayInvoke(lambdaName) {
+		return &authError{http.StatusForbidden, fmt.Sprintf("key '%s' may not invoke '%s'", key.ID, lambdaName)}
+	}
+	return nil
+}
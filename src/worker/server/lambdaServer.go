@@ -1,10 +1,14 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/open-lambda/open-lambda/ol/common"
 	"github.com/open-lambda/open-lambda/ol/worker/lambda"
@@ -38,33 +42,337 @@ func getURLComponents(r *http.Request) []string {
 //
 // curl localhost:8080/run/<lambda-name>
 // curl -X POST localhost:8080/run/<lambda-name> -d '{}'
+// curl localhost:8080/run/<lambda-name>/some/sub/path?key=val
 // ...
+//
+// Anything after <lambda-name> is forwarded to the lambda as the
+// request path (the lambda sees "/" if there is nothing after the name)
 func (s *LambdaServer) RunLambda(w http.ResponseWriter, r *http.Request) {
 	t := common.T0("web-request")
 	defer t.T1()
 
-	// TODO re-enable logging once it is configurable
-	// log.Printf("Received request to %s\n", r.URL.Path)
+	serverLog.Debugf("Received request to %s", r.URL.Path)
 
 	// components represent run[0]/<name_of_sandbox>[1]/<extra_things>...
 	// ergo we want [1] for name of sandbox
 	urlParts := getURLComponents(r)
-	if len(urlParts) < 2 {
+	if len(urlParts) < 2 || urlParts[1] == "" {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected invocation format: /run/<lambda-name>[/<path>]"))
+		return
+	}
+
+	release, ok := s.lambdaMgr.Admit()
+	if !ok {
+		rejectDraining(w)
+		return
+	}
+	defer release()
+
+	img := urlParts[1]
+	defer traceRequest(r, img)()
+	s.lambdaMgr.Invoke(img, w, lambda.ForwardRequest(r, RUN_PATH+img))
+}
+
+// traceRequest starts the span for an invocation request (a child of
+// its traceparent, if any), and binds it to this goroutine, so the
+// phases of the invocation are recorded beneath it.  Call the
+// returned function once the request is handled.
+func traceRequest(r *http.Request, lambdaName string) (end func()) {
+	span := common.StartRequestSpan("web-request", r.Header)
+	span.SetAttr("lambda", lambdaName)
+	span.SetAttr("http.method", r.Method)
+	span.SetAttr("http.target", r.URL.RequestURI())
+	unbind := span.Bind()
+
+	return func() {
+		unbind()
+		span.End()
+	}
+}
+
+// tell the client to try elsewhere (or later), as this worker is
+// shutting down
+func rejectDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(lambda.ErrDraining.Error() + "\n"))
+}
+
+// RouteLambda returns a handler for one of the configured
+// lambda_routes.  A route is either a host name, in which case every
+// request to that host goes to the lambda with its path untouched,
+// or a path prefix, which is stripped before forwarding.  Routing
+// between them is left to http.ServeMux: host patterns take
+// precedence, then the longest matching prefix.
+func (s *LambdaServer) RouteLambda(route string, name string) (pattern string, handler http.HandlerFunc) {
+	prefix := ""
+	if strings.HasPrefix(route, "/") {
+		pattern = route
+		prefix = strings.TrimSuffix(route, "/")
+	} else {
+		pattern = route + "/"
+	}
+
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		t := common.T0("web-request")
+		defer t.T1()
+
+		release, ok := s.lambdaMgr.Admit()
+		if !ok {
+			rejectDraining(w)
+			return
+		}
+		defer release()
+
+		defer traceRequest(r, name)()
+		s.lambdaMgr.Invoke(name, w, lambda.ForwardRequest(r, prefix))
+	}
+	return pattern, handler
+}
+
+// checkRoutes makes sure no lambda_routes prefix falls under an
+// endpoint already registered with mux (e.g., /lambdas/echo/ would
+// take over the admin operations on echo).  Host routes are meant to
+// take over everything for their host, so they aren't checked.
+func checkRoutes(mux *http.ServeMux, routes map[string]string) error {
+	for route := range routes {
+		if !strings.HasPrefix(route, "/") {
+			continue
+		}
+		r, err := http.NewRequest("GET", route, nil)
+		if err != nil {
+			return fmt.Errorf("bad lambda_routes prefix '%s': %v", route, err)
+		}
+		if _, pattern := mux.Handler(r); pattern != "" {
+			return fmt.Errorf("lambda_routes prefix '%s' would take over the worker's own %s endpoint", route, pattern)
+		}
+	}
+	return nil
+}
+
+// RunLambdaAsync queues an invocation and immediately returns its ID:
+//
+// curl -X POST localhost:8080/run-async/<lambda-name> -d '{}'
+// {"id": "<invocation-id>"}
+//
+// The outcome can later be fetched from /invocations/<invocation-id>
+func (s *LambdaServer) RunLambdaAsync(w http.ResponseWriter, r *http.Request) {
+	urlParts := getURLComponents(r)
+	if len(urlParts) < 2 || urlParts[1] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected invocation format: /run-async/<lambda-name>[/<path>]\n"))
+		return
+	}
+
+	id, err := s.lambdaMgr.InvokeAsync(urlParts[1], lambda.ForwardRequest(r, RUN_ASYNC_PATH+urlParts[1]))
+	if errors.Is(err, lambda.ErrDraining) {
+		rejectDraining(w)
+		return
+	} else if err != nil {
+		serverLog.Errorf("could not queue async invocation of %s: %v", urlParts[1], err)
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("expected invocation format: /run/<lambda-name>"))
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if b, err := json.Marshal(map[string]string{"id": id}); err != nil {
+		panic(err)
 	} else {
-		// components represent run[0]/<name_of_sandbox>[1]/<extra_things>...
-		// ergo we want [1] for name of sandbox
-		urlParts := getURLComponents(r)
-		if len(urlParts) == 2 {
-			img := urlParts[1]
-			s.lambdaMgr.Get(img).Invoke(w, r)
+		w.Write(b)
+	}
+}
+
+// GetInvocation returns the status (and result, once done) of an
+// async invocation, or cancels an invocation (sync, by request ID,
+// or async) that hasn't finished:
+//
+// curl localhost:8080/invocations/<invocation-id>
+// curl -X DELETE localhost:8080/invocations/<invocation-or-request-id>
+func (s *LambdaServer) GetInvocation(w http.ResponseWriter, r *http.Request) {
+	urlParts := getURLComponents(r)
+	if len(urlParts) != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: /invocations/<invocation-id>\n"))
+		return
+	}
+
+	if r.Method == "DELETE" {
+		s.cancelInvocation(w, urlParts[1], common.AuthKeyID(r.Context()))
+		return
+	}
+
+	inv, err := s.lambdaMgr.GetInvocation(urlParts[1], common.AuthKeyID(r.Context()))
+	if errors.Is(err, lambda.ErrInvocationNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if b, err := json.MarshalIndent(inv, "", "\t"); err != nil {
+		panic(err)
+	} else {
+		w.Write(b)
+	}
+}
+
+func (s *LambdaServer) cancelInvocation(w http.ResponseWriter, id string, keyID string) {
+	stage, err := s.lambdaMgr.CancelInvocation(id, keyID)
+	if errors.Is(err, lambda.ErrInvocationNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	} else if errors.Is(err, lambda.ErrInvocationFinished) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if b, err := json.Marshal(map[string]string{"id": id, "cancelled": stage}); err != nil {
+		panic(err)
+	} else {
+		w.Write(b)
+	}
+}
+
+// Lambdas describes the lambdas this worker has loaded (code,
+// queues, instances, etc), as JSON:
+//
+// curl localhost:8080/lambdas
+// curl localhost:8080/lambdas/<lambda-name>
+//
+// Asking about a lambda doesn't load it (unlike invoking it), so
+// unknown names get a 404.
+//
+// Admin operations are POSTed to /lambdas/<lambda-name>/<op> (see
+// LambdaAdmin).
+func (s *LambdaServer) Lambdas(w http.ResponseWriter, r *http.Request) {
+	urlParts := getURLComponents(r)
+
+	var result any
+	switch len(urlParts) {
+	case 1:
+		result = s.lambdaMgr.Lambdas()
+	case 2:
+		f := s.lambdaMgr.Lookup(urlParts[1])
+		if f == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("lambda '%s' is not loaded on this worker\n", urlParts[1])))
+			return
+		}
+
+		status, err := f.Status()
+		if err == lambda.ErrNotLoaded {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("lambda '%s' is not loaded on this worker\n", urlParts[1])))
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		result = status
+	case 3:
+		s.LambdaAdmin(w, r, urlParts[1], urlParts[2])
+		return
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expected format: /lambdas[/<lambda-name>[/<op>]]\n"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if b, err := json.MarshalIndent(result, "", "\t"); err != nil {
+		panic(err)
+	} else {
+		w.Write(b)
+	}
+}
+
+// LambdaAdmin performs an admin operation on a lambda:
+//
+// curl -X POST localhost:8080/lambdas/<lambda-name>/refresh
+// curl -X POST localhost:8080/lambdas/<lambda-name>/quiesce
+// curl -X POST localhost:8080/lambdas/<lambda-name>/disable?sec=60
+// curl -X POST localhost:8080/lambdas/<lambda-name>/enable
+// curl -X POST localhost:8080/lambdas/<lambda-name>/unload
+//
+// refresh re-pulls the code on the next invocation, quiesce kills
+// the instances (after they finish their current invocations),
+// disable makes invocations fail with 503 (until enabled, or for
+// sec seconds), and unload forgets the lambda entirely (only when
+// no invocations are in progress).
+func (s *LambdaServer) LambdaAdmin(w http.ResponseWriter, r *http.Request, name string, op string) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(fmt.Sprintf("%s requires POST\n", op)))
+		return
+	}
+
+	var msg string
+	var err error
+	switch op {
+	case "refresh":
+		s.lambdaMgr.Refresh(name)
+		msg = "code will be re-pulled on the next invocation"
+	case "quiesce":
+		var killed int
+		killed, err = s.lambdaMgr.Quiesce(name)
+		msg = fmt.Sprintf("killed %d instances", killed)
+	case "disable":
+		sec := 0
+		if val := r.URL.Query().Get("sec"); val != "" {
+			if sec, err = strconv.Atoi(val); err != nil || sec < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("sec must be a non-negative number of seconds\n"))
+				return
+			}
+		}
+		s.lambdaMgr.Disable(name, time.Duration(sec)*time.Second)
+		msg = "disabled"
+		if sec > 0 {
+			msg = fmt.Sprintf("disabled for %d seconds", sec)
+		}
+	case "enable":
+		if s.lambdaMgr.Enable(name) {
+			msg = "enabled"
 		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("expected invocation format: /run/<lambda-name>"))
+			msg = "was not disabled"
 		}
+	case "unload":
+		err = s.lambdaMgr.Unload(name)
+		msg = "unloaded"
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("unknown op '%s' (expected refresh, quiesce, disable, enable, or unload)\n", op)))
+		return
 	}
+
+	if err == lambda.ErrNotLoaded {
+		w.WriteHeader(http.StatusNotFound)
+	} else if err == lambda.ErrLambdaBusy {
+		w.WriteHeader(http.StatusConflict)
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	if err != nil {
+		msg = err.Error()
+	}
+	w.Write([]byte(fmt.Sprintf("%s: %s\n", name, msg)))
 }
 
 func (s *LambdaServer) Debug(w http.ResponseWriter, _ *http.Request) {
@@ -75,10 +383,35 @@ func (s *LambdaServer) cleanup() {
 	s.lambdaMgr.Cleanup()
 }
 
+func (s *LambdaServer) drain(grace time.Duration, abort <-chan bool) {
+	s.lambdaMgr.Drain(grace, abort)
+}
+
+func (s *LambdaServer) drainStatus() (draining bool, inflight int) {
+	return s.lambdaMgr.DrainStatus()
+}
+
+func (s *LambdaServer) warmStatus() (warming bool, done int, total int) {
+	warming, done, total, _ = s.lambdaMgr.PrewarmStatus()
+	return warming, done, total
+}
+
+func (s *LambdaServer) confReloaded(old *common.Config) {
+	s.lambdaMgr.ConfReloaded(old)
+}
+
 // NewLambdaServer creates a server based on the passed config."
 func NewLambdaServer() (*LambdaServer, error) {
 	log.Printf("Starting new lambda server")
 
+	var manifest *lambda.PrewarmManifest
+	if path := common.Conf.Prewarm_manifest; path != "" {
+		var err error
+		if manifest, err = lambda.LoadPrewarmManifest(path); err != nil {
+			return nil, err
+		}
+	}
+
 	lambdaMgr, err := lambda.NewLambdaMgr()
 	if err != nil {
 		return nil, err
@@ -88,11 +421,36 @@ func NewLambdaServer() (*LambdaServer, error) {
 		lambdaMgr: lambdaMgr,
 	}
 
+	if manifest != nil {
+		serverLog.Infof("Prewarm %d lambdas from %s", len(manifest.Lambdas), common.Conf.Prewarm_manifest)
+		lambdaMgr.Prewarm(manifest.Lambdas)
+	}
+
 	log.Printf("Setups Handlers")
 	port := fmt.Sprintf(":%s", common.Conf.Worker_port)
 	http.HandleFunc(RUN_PATH, server.RunLambda)
+	http.HandleFunc(RUN_ASYNC_PATH, server.RunLambdaAsync)
+	http.HandleFunc(INVOCATIONS_PATH, server.GetInvocation)
+	invocationLambda = lambdaMgr.InvocationLambda
+	http.HandleFunc(LAMBDAS_PATH, server.Lambdas)
+	http.HandleFunc(LAMBDAS_PATH+"/", server.Lambdas)
+	http.HandleFunc(SCHEDULES_PATH, lambdaMgr.Scheduler.HandleHTTP)
+	http.HandleFunc(SCHEDULES_PATH+"/", lambdaMgr.Scheduler.HandleHTTP)
 	http.HandleFunc(DEBUG_PATH, server.Debug)
 
+	// after the worker's own endpoints, so routes can be checked
+	// against them
+	if err := checkRoutes(http.DefaultServeMux, common.Conf.Lambda_routes); err != nil {
+		lambdaMgr.Cleanup()
+		return nil, err
+	}
+	for route, name := range common.Conf.Lambda_routes {
+		pattern, handler := server.RouteLambda(route, name)
+		serverLog.Infof("Route %s to lambda %s", pattern, name)
+		http.HandleFunc(pattern, handler)
+		routePatterns[pattern] = name
+	}
+
 	log.Printf("Execute handler by POSTing to localhost%s%s%s\n", port, RUN_PATH, "<lambda>")
 	log.Printf("Get status by sending request to localhost%s%s\n", port, STATUS_PATH)
 
@@ -13,6 +13,7 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"syscall"
+	"time"
   "sync"
 
 	"github.com/open-lambda/open-lambda/ol/common"
@@ -20,28 +21,67 @@ import (
 
 const (
 	RUN_PATH       = "/run/"
+	RUN_ASYNC_PATH = "/run-async/"
+	INVOCATIONS_PATH = "/invocations/"
+	LAMBDAS_PATH     = "/lambdas"
+	SCHEDULES_PATH   = "/schedules"
 	PID_PATH       = "/pid"
 	STATUS_PATH    = "/status"
 	STATS_PATH     = "/stats"
+	METRICS_PATH   = "/metrics"
 	DEBUG_PATH     = "/debug"
 	PPROF_MEM_PATH = "/pprof/mem"
 	PPROF_CPU_START_PATH = "/pprof/cpu-start"
 	PPROF_CPU_STOP_PATH  = "/pprof/cpu-stop" 
+	LOGGING_PATH   = "/admin/logging"
+	RELOAD_PATH    = "/admin/reload"
 )
 
 type cleanable interface {
 	cleanup()
 }
 
+// servers that can let in-flight work finish before cleanup
+type drainable interface {
+	drain(grace time.Duration, abort <-chan bool)
+	drainStatus() (draining bool, inflight int)
+}
+
+// set once the server is created, if it supports draining
+var drainer drainable
+
+// servers that get ready (e.g., prewarm lambdas) after they start
+type warmable interface {
+	warmStatus() (warming bool, done int, total int)
+}
+
+// set once the server is created, if it has to warm up
+var warmer warmable
+
+// servers with state derived from the config (beyond reading
+// common.Conf as needed), which must be updated when it's reloaded
+type reloadable interface {
+	confReloaded(old *common.Config)
+}
+
+// ConfigSource returns the path of the config to use when reloading
+// (regenerating it first if necessary, e.g., to apply command-line
+// overrides).  If nil, the config cannot be reloaded.
+var ConfigSource func() (string, error)
+
+// set once the server is created
+var reloadServer cleanable
+
 // temporary file storing cpu profiled data
 const CPU_TEMP_PATTERN = ".cpu.*.prof"
 var cpuTemp *os.File
 var lock sync.Mutex
 
+var serverLog = common.NewLogger("server")
+
 // HandleGetPid returns process ID, useful for making sure we're talking to the expected server
-func HandleGetPid(w http.ResponseWriter, _ *http.Request) {
-	// TODO re-enable once logging is configurable
-	//log.Printf("Received request to %s\n", r.URL.Path)
+func HandleGetPid(w http.ResponseWriter, r *http.Request) {
+	serverLog.Debugf("Received request to %s", r.URL.Path)
 
 	wbody := []byte(strconv.Itoa(os.Getpid()) + "\n")
 	if _, err := w.Write(wbody); err != nil {
@@ -49,18 +89,35 @@ func HandleGetPid(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
-// Status writes "ready" to the response.
-func Status(w http.ResponseWriter, _ *http.Request) {
-	// TODO re-enable once logging is configurable
-	//log.Printf("Received request to %s\n", r.URL.Path)
+// Status writes "ready" to the response, or reports progress with a
+// 503 while the worker is warming up (so load balancers wait before
+// sending it requests), or once it has started draining (so they stop).
+func Status(w http.ResponseWriter, r *http.Request) {
+	serverLog.Debugf("Received request to %s", r.URL.Path)
+
+	if drainer != nil {
+		if draining, inflight := drainer.drainStatus(); draining {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(fmt.Sprintf("draining: %d invocations unfinished\n", inflight)))
+			return
+		}
+	}
+
+	if warmer != nil {
+		if warming, done, total := warmer.warmStatus(); warming {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(fmt.Sprintf("warming up: %d of %d lambdas prewarmed\n", done, total)))
+			return
+		}
+	}
 
 	if _, err := w.Write([]byte("ready\n")); err != nil {
 		log.Printf("error in Status: %v", err)
 	}
 }
 
-func Stats(w http.ResponseWriter, _ *http.Request) {
-	//log.Printf("Received request to %s\n", r.URL.Path)
+func Stats(w http.ResponseWriter, r *http.Request) {
+	serverLog.Debugf("Received request to %s", r.URL.Path)
 	snapshot := common.SnapshotStats()
 	if b, err := json.MarshalIndent(snapshot, "", "\t"); err != nil {
 		panic(err)
@@ -69,6 +126,110 @@ func Stats(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+// Metrics writes counters, gauges and histograms in the Prometheus
+// text format, for scraping
+func Metrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	common.WriteMetrics(w)
+}
+
+// Logging shows (GET) or changes (POST) the log settings of the
+// running worker.  Fields omitted from a POST body keep their
+// current values, e.g.:
+//
+// curl -X POST localhost:5000/admin/logging -d '{"subsystems": {"evictor": "debug"}}'
+//
+// Changes are not saved to the config file, so they only last until
+// the worker restarts.
+func Logging(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		conf := common.GetLogging()
+		if err := json.NewDecoder(r.Body).Decode(&conf); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("could not parse log settings: %v\n", err)))
+			return
+		}
+
+		if err := common.SetLogging(conf); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		serverLog.Infof("log settings changed to %+v", common.GetLogging())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.MarshalIndent(common.GetLogging(), "", "\t")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// reloadConf re-reads the config, applying changes to settings that
+// can change while the worker runs (see common.ReloadConf)
+func reloadConf() (changes []string, err error) {
+	if ConfigSource == nil {
+		return nil, fmt.Errorf("this worker does not know where its config came from")
+	}
+	path, err := ConfigSource()
+	if err != nil {
+		return nil, err
+	}
+
+	old, changes, err := common.ReloadConf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if r, ok := reloadServer.(reloadable); ok {
+		r.confReloaded(old)
+	}
+
+	if len(changes) == 0 {
+		serverLog.Infof("reloaded config from %s (no changes)", path)
+	}
+	for _, change := range changes {
+		serverLog.Infof("reloaded config from %s: %s", path, change)
+	}
+	return changes, nil
+}
+
+// ReloadConfig (POST) re-reads the worker's config, like SIGHUP, and
+// returns the settings that changed.  Changes to settings that are
+// only read at startup are rejected (with a 409) and nothing is
+// applied, e.g.:
+//
+// curl -X POST localhost:5000/admin/reload
+func ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	changes, err := reloadConf()
+	if err != nil {
+		serverLog.Warnf("could not reload config: %v", err)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	b, err := json.MarshalIndent(map[string][]string{"changes": changes}, "", "\t")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
 func PprofMem(w http.ResponseWriter, _ *http.Request) {
 	runtime.GC()
 	w.Header().Add("Content-Type", "application/octet-stream")
@@ -152,8 +313,17 @@ func PprofCpuStop(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
-func shutdown(pidPath string, server cleanable) {
+// shutdown lets in-flight invocations finish (if the server supports
+// that), then cleans up and exits.  Closing abort cuts the drain short.
+func shutdown(pidPath string, server cleanable, abort <-chan bool) {
+	if d, ok := server.(drainable); ok {
+		grace := time.Duration(common.Conf.Limits.Drain_grace_sec) * time.Second
+		log.Printf("Draining in-flight invocations (up to %v)", grace)
+		d.drain(grace, abort)
+	}
+
 	server.cleanup()
+	common.StopTracing()
 	statsPath := filepath.Join(common.Conf.Worker_dir, "stats.json")
 	snapshot := common.SnapshotStats()
 	rc := 0
@@ -217,13 +387,21 @@ func Main() (err error) {
 		return err
 	}
 
+	if err := common.StartTracing(&common.Conf.Tracing, "ol-worker"); err != nil {
+		os.Remove(pidPath)
+		return fmt.Errorf("could not start tracing: %v", err)
+	}
+
 	// things shared by all servers
 	http.HandleFunc(PID_PATH, HandleGetPid)
 	http.HandleFunc(STATUS_PATH, Status)
 	http.HandleFunc(STATS_PATH, Stats)
+	http.HandleFunc(METRICS_PATH, Metrics)
 	http.HandleFunc(PPROF_MEM_PATH, PprofMem)
 	http.HandleFunc(PPROF_CPU_START_PATH, PprofCpuStart)
 	http.HandleFunc(PPROF_CPU_STOP_PATH, PprofCpuStop)
+	http.HandleFunc(LOGGING_PATH, Logging)
+	http.HandleFunc(RELOAD_PATH, ReloadConfig)
 
 	var s cleanable
 	switch common.Conf.Server_mode {
@@ -238,19 +416,61 @@ func Main() (err error) {
 		os.Remove(pidPath)
 		return err
 	}
+	if d, ok := s.(drainable); ok {
+		drainer = d
+	}
+	if wm, ok := s.(warmable); ok {
+		warmer = wm
+	}
+	reloadServer = s
+
+	// SIGHUP reloads the config
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("Received SIGHUP, reloading config.")
+			if _, err := reloadConf(); err != nil {
+				serverLog.Warnf("could not reload config: %v", err)
+			}
+		}
+	}()
 
-	// clean up if signal hits us (e.g., from ctrl-C)
+	// clean up if signal hits us (e.g., from ctrl-C).  A second
+	// signal skips waiting for in-flight invocations.
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	signal.Notify(c, os.Interrupt, syscall.SIGINT)
 	go func() {
 		<-c
 		log.Printf("Received kill signal, cleaning up.")
-		shutdown(pidPath, s)
+		abort := make(chan bool)
+		go func() {
+			<-c
+			log.Printf("Received second kill signal, skipping drain.")
+			close(abort)
+		}()
+		shutdown(pidPath, s, abort)
 	}()
 
 	port := fmt.Sprintf("%s:%s", common.Conf.Worker_url, common.Conf.Worker_port)
-	err = http.ListenAndServe(port, nil)
+	httpServer := &http.Server{
+		Addr:    port,
+		Handler: authHandler(http.DefaultServeMux),
+	}
+	httpServer.TLSConfig, err = common.ServerTLSConfig(&common.Conf.TLS)
+	if err != nil {
+		s.cleanup()
+		os.Remove(pidPath)
+		return fmt.Errorf("could not load TLS files: %v", err)
+	}
+
+	if httpServer.TLSConfig != nil {
+		// certs come from TLSConfig (and are reloaded when they change)
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
 
 	// if ListenAndServer returned, there must have been some issue
 	// (probably a port collision)
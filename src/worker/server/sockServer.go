@@ -197,6 +197,12 @@ func (server *SOCKServer) cleanup() {
 	server.sbPool.Cleanup()
 }
 
+func (server *SOCKServer) confReloaded(old *common.Config) {
+	if common.Conf.Mem_pool_mb != old.Mem_pool_mb {
+		sandbox.ResizePool(server.sbPool, common.Conf.Mem_pool_mb)
+	}
+}
+
 // NewSOCKServer creates a server based on the passed config."
 func NewSOCKServer() (*SOCKServer, error) {
 	log.Printf("Start SOCK Server")
@@ -6,9 +6,13 @@ def page_not_found(e):
 app = Flask("hi")
 app.register_error_handler(404, page_not_found)
 
-# TODO: modify wrappers so "/" is the root
-@app.route("/run/flask-test")
+# the worker strips /run/flask-test, so "/" is the root of the app
+@app.route("/")
 def hi():
   print("in hi() of flask-test/f.py")
   teapot = 418 # I'm a teapot (https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/418)
   return Response("hi\n", status=teapot, headers={"A":"B"})
+
+@app.route("/echo/<path:subpath>", methods=["GET", "POST"])
+def echo(subpath):
+  return {"method": request.method, "path": subpath, "args": request.args}